@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
@@ -11,17 +13,41 @@ import (
 	"time"
 
 	"github.com/elazarl/goproxy"
-	"github.com/elazarl/goproxy/ext/auth"
 	"github.com/gin-gonic/gin"
+	"github.com/zulkan/zulgoproxy/cache"
+	"github.com/zulkan/zulgoproxy/certs"
 	"github.com/zulkan/zulgoproxy/config"
 	"github.com/zulkan/zulgoproxy/database"
 	"github.com/zulkan/zulgoproxy/handlers"
 	"github.com/zulkan/zulgoproxy/logger"
 	"github.com/zulkan/zulgoproxy/middleware"
+	"github.com/zulkan/zulgoproxy/models"
+	"github.com/zulkan/zulgoproxy/proxy"
+	"github.com/zulkan/zulgoproxy/resolver"
 	"github.com/zulkan/zulgoproxy/ui"
+	"github.com/zulkan/zulgoproxy/upstream"
 )
 
-var cfg *config.Config
+const proxyRealm = "ZulgoProxy"
+
+var (
+	cfg            *config.Config
+	proxyAuth      *proxy.Authenticator
+	mitmAuthority  *certs.Authority
+	ruleEngine     *proxy.RuleEngine
+	headerRewriter *proxy.HeaderRewriter
+	egressSelector *proxy.EgressSelector
+	errorPages     *proxy.ErrorPages
+	policyEnforcer *proxy.PolicyEnforcer
+	upstreamRouter *upstream.Router
+	serverCerts    certs.ServerCertificates
+	destGuard      *proxy.DestinationGuard
+	dnsResolver    *resolver.Resolver
+	usageTracker   *proxy.UsageTracker
+	connections    *proxy.ConnectionRegistry
+	pacGenerator   *proxy.PACGenerator
+	httpCache      *cache.Store
+)
 
 func main() {
 	// Load configuration
@@ -41,6 +67,118 @@ func main() {
 		logger.Fatal("Failed to initialize database: %v", err)
 	}
 
+	// Proxy credentials are verified against the user store
+	proxyAuth = proxy.NewAuthenticator(time.Duration(cfg.Auth.ProxyCacheTTL) * time.Second)
+
+	// Destination rules are cached in memory and reloaded on change
+	ruleEngine = proxy.NewRuleEngine()
+	if err := ruleEngine.Reload(); err != nil {
+		logger.Fatal("Failed to load destination rules: %v", err)
+	}
+
+	// Header rewrite rules, cached the same way
+	headerRewriter = proxy.NewHeaderRewriter()
+	if err := headerRewriter.Reload(); err != nil {
+		logger.Fatal("Failed to load header rules: %v", err)
+	}
+
+	// Error pages customized by admins, cached the same way
+	errorPages = proxy.NewErrorPages()
+	if err := errorPages.Reload(); err != nil {
+		logger.Fatal("Failed to load error pages: %v", err)
+	}
+	proxy.UseErrorPages(errorPages)
+
+	// PAC files are built from the bypass lists and rebuilt when rules change
+	pacGenerator, err = proxy.NewPACGenerator(cfg.PAC, ruleEngine)
+	if err != nil {
+		logger.Fatal("Invalid PAC configuration: %v", err)
+	}
+
+	// Per-user and per-role access policies
+	policyEnforcer = proxy.NewPolicyEnforcer()
+	if err := policyEnforcer.Reload(); err != nil {
+		logger.Fatal("Failed to load access policies: %v", err)
+	}
+
+	// Traffic accounting for quotas
+	usageTracker, err = proxy.NewUsageTracker()
+	if err != nil {
+		logger.Fatal("Failed to load traffic usage: %v", err)
+	}
+
+	// Shared response cache
+	if cfg.Cache.Enabled {
+		httpCache, err = cache.NewStore(cfg.Cache.Dir, cfg.Cache.MaxSizeMB<<20, cfg.Cache.MaxObjectSizeMB<<20)
+		if err != nil {
+			logger.Fatal("Failed to open response cache: %v", err)
+		}
+	}
+
+	// Live connection table and concurrency caps
+	connections = proxy.NewConnectionRegistry(cfg.Server.MaxConnections)
+	usageTracker.Meter(connections, policyEnforcer.For)
+
+	// Destination name resolution with host overrides and caching
+	dnsResolver, err = resolver.New(cfg.DNS)
+	if err != nil {
+		logger.Fatal("Invalid DNS configuration: %v", err)
+	}
+	if err := dnsResolver.Reload(); err != nil {
+		logger.Fatal("Failed to load host overrides: %v", err)
+	}
+
+	// Refuse internal destinations
+	if cfg.SSRF.Enabled {
+		destGuard, err = proxy.NewDestinationGuard(cfg.SSRF, dnsResolver.LookupIP)
+		if err != nil {
+			logger.Fatal("Invalid SSRF configuration: %v", err)
+		}
+	}
+
+	// Source addresses of direct connections, per user, role or destination
+	egressSelector, err = proxy.NewEgressSelector(cfg.Egress)
+	if err != nil {
+		logger.Fatal("Invalid egress configuration: %v", err)
+	}
+	if err := egressSelector.Reload(); err != nil {
+		logger.Fatal("Failed to load egress rules: %v", err)
+	}
+
+	// Upstream proxy chaining
+	upstreamRouter, err = upstream.NewRouter(cfg.Upstream, destGuard, dnsResolver)
+	if err != nil {
+		logger.Fatal("Invalid upstream configuration: %v", err)
+	}
+
+	// Load or generate the interception CA
+	if cfg.MITM.Enabled {
+		mitmAuthority, err = certs.LoadOrCreateAuthority(cfg.MITM.CACertFile, cfg.MITM.CAKeyFile)
+		if err != nil {
+			logger.Fatal("Failed to load interception CA: %v", err)
+		}
+		logger.Info("TLS interception enabled for %d hosts and %d users", len(cfg.MITM.Hosts), len(cfg.MITM.Users))
+	}
+
+	// Certificate for the proxy and API listeners, from ACME or from files
+	// that are reloaded when renewed
+	if cfg.Server.EnableHTTPS && cfg.ACME.Enabled {
+		acmeCerts, err := certs.NewACMEManager(cfg.ACME)
+		if err != nil {
+			logger.Fatal("Invalid ACME configuration: %v", err)
+		}
+		serverCerts = acmeCerts
+		if cfg.ACME.HTTPPort > 0 {
+			go startACMEChallengeServer(acmeCerts)
+		}
+		go acmeCerts.Obtain()
+	} else if cfg.Server.EnableHTTPS {
+		serverCerts, err = certs.LoadKeyPair(cfg.Server.CertFile, cfg.Server.KeyFile)
+		if err != nil {
+			logger.Fatal("Failed to load TLS certificate: %v", err)
+		}
+	}
+
 	// Setup graceful shutdown
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
@@ -48,25 +186,101 @@ func main() {
 	go func() {
 		<-c
 		logger.Info("Shutting down gracefully...")
+		usageTracker.Flush()
 		os.Exit(0)
 	}()
 
 	// Start proxy server
-	go startProxyServer()
+	proxyServer := newProxyServer()
+	go startProxyServer(proxyServer)
+
+	// Start transparent listener
+	if cfg.Server.TransparentPort > 0 {
+		go startTransparentServer(proxyServer)
+	}
+
+	// Start SOCKS5 server
+	if cfg.Server.SOCKSPort > 0 {
+		go startSOCKSServer()
+	}
 
 	// Start API server
 	startAPIServer()
 }
 
-func startProxyServer() {
-	proxy := goproxy.NewProxyHttpServer()
-	proxy.Verbose = cfg.Server.LogLevel == "debug"
+// newProxyServer builds the proxy handler shared by the explicit and
+// transparent listeners.
+func newProxyServer() http.Handler {
+	server := goproxy.NewProxyHttpServer()
+	server.Verbose = cfg.Server.LogLevel == "debug"
+	// goproxy skips upstream verification by default, which would hide
+	// forged certificates from clients of intercepted tunnels
+	server.Tr.TLSClientConfig = &tls.Config{}
+	// Plain requests and tunnels are routed direct or via an upstream proxy
+	server.Tr.Proxy = upstreamRouter.ProxyURL
+	server.Tr.DialContext = upstreamRouter.TransportDial
+	server.ConnectDial = upstreamRouter.Dial
+
+	server.OnRequest().DoFunc(filterIP)
+	server.OnRequest().DoFunc(rewriteRequestHeaders)
+	// Connections are pooled per egress source address
+	egressTransport := proxy.NewEgressTransport(server.Tr)
+	// Requests the cache does not answer count towards their upstream's load
+	routed := upstreamRouter.Transport(egressTransport)
+	var transport http.RoundTripper = routed
+	if httpCache != nil {
+		transport = cache.NewTransport(httpCache, transport)
+	}
+	// WebSocket upgrades skip the cache
+	transport = proxy.NewWebSocketTransport(transport, routed)
+	// Runs only for requests filterIP let through
+	server.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.RoundTripper = forwardRequest(transport)
+		return req, nil
+	})
+	handler := proxy.HandleWebSockets(server)
+	var interceptor *proxy.Interceptor
+	if mitmAuthority != nil {
+		interceptor = proxy.NewInterceptor(handler)
+	}
+	server.OnRequest().HandleConnect(getHandleConnect(interceptor))
+	server.OnResponse().DoFunc(rewriteResponseHeaders)
+	server.OnResponse().DoFunc(proxy.LogResponse)
+	return handler
+}
 
-	proxy.OnRequest().DoFunc(filterIP)
-	proxy.OnRequest().HandleConnect(getHandleConnect())
+func startProxyServer(server http.Handler) {
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler: server,
+		// CONNECT hijacks the connection, which HTTP/2 does not allow
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	}
 
-	logger.Info("Proxy server starting on port %d", cfg.Server.Port)
-	logger.Fatal("Proxy server error: %v", http.ListenAndServe(fmt.Sprintf(":%d", cfg.Server.Port), proxy))
+	logger.Info("Proxy server starting on port %d%s", cfg.Server.Port, tlsSuffix())
+	logger.Fatal("Proxy server error: %v", listenAndServe(httpServer))
+}
+
+// listenAndServe serves srv over TLS when HTTPS is enabled.
+func listenAndServe(srv *http.Server) error {
+	if serverCerts == nil {
+		return srv.ListenAndServe()
+	}
+	srv.TLSConfig = serverCerts.TLSConfig()
+	return srv.ListenAndServeTLS("", "")
+}
+
+// startACMEChallengeServer answers ACME http-01 challenges.
+func startACMEChallengeServer(acmeCerts *certs.ACMEManager) {
+	logger.Info("ACME challenge server starting on port %d", cfg.ACME.HTTPPort)
+	logger.Fatal("ACME challenge server error: %v", http.ListenAndServe(fmt.Sprintf(":%d", cfg.ACME.HTTPPort), acmeCerts.HTTPHandler()))
+}
+
+func tlsSuffix() string {
+	if serverCerts == nil {
+		return ""
+	}
+	return " (TLS)"
 }
 
 func startAPIServer() {
@@ -80,15 +294,17 @@ func startAPIServer() {
 	rateLimiter := middleware.NewRateLimiter(100, time.Minute)
 	router.Use(middleware.RateLimitMiddleware(rateLimiter))
 
-	// Add logging middleware
-	router.Use(middleware.ProxyLoggingMiddleware())
-
 	// Health check endpoints (no auth required)
-	healthHandler := handlers.NewHealthHandler()
+	healthHandler := handlers.NewHealthHandler(dnsResolver)
 	router.GET("/health", healthHandler.Health)
 	router.GET("/health/readiness", healthHandler.Readiness)
 	router.GET("/health/liveness", healthHandler.Liveness)
 
+	// Proxy auto-config for browsers and WPAD
+	pacHandler := handlers.NewPACHandler(pacGenerator, cfg.Server.Port, serverCerts != nil)
+	router.GET("/proxy.pac", pacHandler.GetPAC)
+	router.GET("/wpad.dat", pacHandler.GetPAC)
+
 	// Auth endpoints
 	authHandler := handlers.NewAuthHandler(cfg)
 	auth := router.Group("/api/auth")
@@ -104,7 +320,8 @@ func startAPIServer() {
 	api.Use(middleware.AuthMiddleware(cfg))
 	{
 		// User management (admin only)
-		userHandler := handlers.NewUserHandler()
+		userHandler := handlers.NewUserHandler(proxyAuth)
+		usageHandler := handlers.NewUsageHandler(usageTracker, policyEnforcer)
 		users := api.Group("/users")
 		users.Use(middleware.AdminMiddleware())
 		{
@@ -113,6 +330,78 @@ func startAPIServer() {
 			users.POST("", userHandler.CreateUser)
 			users.PUT("/:id", userHandler.UpdateUser)
 			users.DELETE("/:id", userHandler.DeleteUser)
+			users.GET("/:id/usage", usageHandler.GetUsage)
+		}
+
+		// Destination rules (admin only)
+		ruleHandler := handlers.NewRuleHandler(ruleEngine)
+		rules := api.Group("/rules")
+		rules.Use(middleware.AdminMiddleware())
+		{
+			rules.GET("", ruleHandler.GetRules)
+			rules.GET("/:id", ruleHandler.GetRule)
+			rules.POST("", ruleHandler.CreateRule)
+			rules.PUT("/:id", ruleHandler.UpdateRule)
+			rules.DELETE("/:id", ruleHandler.DeleteRule)
+		}
+
+		// Header rewrite rules (admin only)
+		headerRuleHandler := handlers.NewHeaderRuleHandler(headerRewriter)
+		headerRules := api.Group("/header-rules")
+		headerRules.Use(middleware.AdminMiddleware())
+		{
+			headerRules.GET("", headerRuleHandler.GetHeaderRules)
+			headerRules.GET("/:id", headerRuleHandler.GetHeaderRule)
+			headerRules.POST("", headerRuleHandler.CreateHeaderRule)
+			headerRules.PUT("/:id", headerRuleHandler.UpdateHeaderRule)
+			headerRules.DELETE("/:id", headerRuleHandler.DeleteHeaderRule)
+		}
+
+		// Egress source address rules (admin only)
+		egressRuleHandler := handlers.NewEgressRuleHandler(egressSelector)
+		egressRules := api.Group("/egress-rules")
+		egressRules.Use(middleware.AdminMiddleware())
+		{
+			egressRules.GET("", egressRuleHandler.GetEgressRules)
+			egressRules.GET("/:id", egressRuleHandler.GetEgressRule)
+			egressRules.POST("", egressRuleHandler.CreateEgressRule)
+			egressRules.PUT("/:id", egressRuleHandler.UpdateEgressRule)
+			egressRules.DELETE("/:id", egressRuleHandler.DeleteEgressRule)
+		}
+
+		// Error page templates (admin only)
+		errorPageHandler := handlers.NewErrorPageHandler(errorPages)
+		errorPageRoutes := api.Group("/error-pages")
+		errorPageRoutes.Use(middleware.AdminMiddleware())
+		{
+			errorPageRoutes.GET("", errorPageHandler.GetErrorPages)
+			errorPageRoutes.GET("/:outcome/preview", errorPageHandler.PreviewErrorPage)
+			errorPageRoutes.PUT("/:outcome", errorPageHandler.UpdateErrorPage)
+			errorPageRoutes.DELETE("/:outcome", errorPageHandler.DeleteErrorPage)
+		}
+
+		// DNS host overrides (admin only)
+		hostOverrideHandler := handlers.NewHostOverrideHandler(dnsResolver)
+		hostOverrides := api.Group("/host-overrides")
+		hostOverrides.Use(middleware.AdminMiddleware())
+		{
+			hostOverrides.GET("", hostOverrideHandler.GetHostOverrides)
+			hostOverrides.GET("/:id", hostOverrideHandler.GetHostOverride)
+			hostOverrides.POST("", hostOverrideHandler.CreateHostOverride)
+			hostOverrides.PUT("/:id", hostOverrideHandler.UpdateHostOverride)
+			hostOverrides.DELETE("/:id", hostOverrideHandler.DeleteHostOverride)
+		}
+
+		// Access policies (admin only)
+		policyHandler := handlers.NewPolicyHandler(policyEnforcer)
+		policies := api.Group("/policies")
+		policies.Use(middleware.AdminMiddleware())
+		{
+			policies.GET("", policyHandler.GetPolicies)
+			policies.GET("/:id", policyHandler.GetPolicy)
+			policies.POST("", policyHandler.CreatePolicy)
+			policies.PUT("/:id", policyHandler.UpdatePolicy)
+			policies.DELETE("/:id", policyHandler.DeletePolicy)
 		}
 
 		// Change password (for authenticated users)
@@ -128,7 +417,7 @@ func startAPIServer() {
 		}
 
 		// Admin endpoints
-		adminHandler := handlers.NewAdminHandler()
+		adminHandler := handlers.NewAdminHandler(serverCerts)
 		admin := api.Group("/admin")
 		admin.Use(middleware.AdminMiddleware())
 		{
@@ -136,21 +425,258 @@ func startAPIServer() {
 			admin.GET("/system", adminHandler.GetSystemInfo)
 			admin.DELETE("/logs/purge", adminHandler.PurgeOldLogs)
 		}
+
+		// Upstream pool health (admin only)
+		upstreamHandler := handlers.NewUpstreamHandler(upstreamRouter)
+		admin.GET("/upstreams", upstreamHandler.GetPools)
+
+		// Live connection table (admin only)
+		connectionHandler := handlers.NewConnectionHandler(connections)
+		admin.GET("/connections", connectionHandler.GetConnections)
+		admin.DELETE("/connections/:id", connectionHandler.CloseConnection)
+
+		// Response cache stats and purge (admin only)
+		cacheHandler := handlers.NewCacheHandler(httpCache)
+		admin.GET("/cache", cacheHandler.GetStats)
+		admin.DELETE("/cache", cacheHandler.Purge)
+
+		// Resolver cache and lookup diagnostics
+		dnsHandler := handlers.NewDNSHandler(dnsResolver)
+		admin.GET("/dns", dnsHandler.GetStats)
+		admin.GET("/dns/lookup", dnsHandler.Lookup)
+		admin.DELETE("/dns/cache", dnsHandler.FlushCache)
+
+		// Interception CA download (admin only)
+		certificateHandler := handlers.NewCertificateHandler(mitmAuthority)
+		admin.GET("/ca-certificate", certificateHandler.DownloadCA)
 	}
 
 	// Serve UI
 	ui.AddRoutes(router)
 
 	apiPort := cfg.Server.Port + 1
-	logger.Info("API server starting on port %d", apiPort)
-	logger.Fatal("API server error: %v", http.ListenAndServe(fmt.Sprintf(":%d", apiPort), router))
+	logger.Info("API server starting on port %d%s", apiPort, tlsSuffix())
+	logger.Fatal("API server error: %v", listenAndServe(&http.Server{Addr: fmt.Sprintf(":%d", apiPort), Handler: router}))
 }
 
 func filterIP(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 	logger.Debug("Request from %s to %s", req.RemoteAddr, req.URL.String())
+
+	var user *models.User
+	allowed := true
+	if tunnel := proxy.StateFromContext(req.Context()); tunnel != nil && tunnel.Intercepted {
+		// Requests decrypted from an intercepted tunnel were authorized at CONNECT
+		user = tunnel.User
+	} else {
+		user, allowed = authorizeProxyRequest(req)
+	}
+
+	state := proxy.NewRequestState(user)
+	if req.Body != nil && req.Body != http.NoBody {
+		state.RequestBody = proxy.NewCountingReadCloser(req.Body)
+		req.Body = state.RequestBody
+	}
+	ctx.UserData = state
+	// Lets the transport route the request by its user
+	*req = *req.WithContext(proxy.WithState(req.Context(), state))
+
+	if !allowed {
+		logger.Warn("Proxy authentication required for %s from %s", req.URL.Host, req.RemoteAddr)
+		return req, proxy.AuthRequiredResponse(req, proxyRealm)
+	}
+
+	if rule := matchRule(state, req.URL.Host, req.URL.String()); rule != nil && rule.Action == models.RuleActionDeny {
+		logger.Info("Request to %s from %s blocked by rule %d", req.URL.Host, req.RemoteAddr, rule.ID)
+		return req, proxy.BlockedResponse(req, req.URL.Host, rule)
+	}
+
+	policy := policyEnforcer.For(user)
+	if resp := checkPolicy(state, req, req.URL.Host, policy); resp != nil {
+		return req, resp
+	}
+	if resp := checkDestination(state, req, req.URL.Host); resp != nil {
+		return req, resp
+	}
+	if resp := checkQuota(state, req, req.URL.Host, policy); resp != nil {
+		return req, resp
+	}
+	applyBandwidthLimit(state, policy)
+	applyEgress(state, req.URL.Host)
+	applyWebSocketIdleTimeout(state, policy)
+	if resp := acquireConnection(state, req, req.URL.Host, policy); resp != nil {
+		return req, resp
+	}
+
+	// Killing the connection from the admin API aborts the upstream request
+	abort, cancel := context.WithCancel(req.Context())
+	*req = *req.WithContext(abort)
+	state.Conn.SetCloser(cancel)
+	state.OnFinish(cancel)
+	return req, nil
+}
+
+// forwardRequest sends requests through transport, answering those that
+// cannot reach their destination with an error page instead of goproxy's
+// bare error text.
+func forwardRequest(transport http.RoundTripper) goproxy.RoundTripper {
+	return goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			logger.Warn("Request to %s from %s failed: %v", req.URL.Host, req.RemoteAddr, err)
+			return proxy.UpstreamErrorResponse(req, req.URL.Host, err), nil
+		}
+		return resp, nil
+	})
+}
+
+// rewriteRequestHeaders applies the request header rules to a request
+// filterIP let through.
+func rewriteRequestHeaders(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	state := proxy.StateFrom(ctx)
+	if state == nil {
+		return req, nil
+	}
+	headerRewriter.RewriteRequest(req, state, policyEnforcer.For(state.User))
 	return req, nil
 }
 
+// rewriteResponseHeaders applies the response header rules before the
+// response reaches the client.
+func rewriteResponseHeaders(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	state := proxy.StateFrom(ctx)
+	if resp == nil || state == nil {
+		return resp
+	}
+	headerRewriter.RewriteResponse(resp, ctx.Req, state, policyEnforcer.For(state.User))
+	return resp
+}
+
+// checkPolicy applies the proxy user's access policy to a destination.
+func checkPolicy(state *proxy.RequestState, req *http.Request, host string, policy *models.Policy) *http.Response {
+	reason := proxy.CheckPolicy(policy, host)
+	if reason == "" {
+		return nil
+	}
+
+	logger.Info("Request to %s by %s denied by policy %d: %s", host, state.User.Username, policy.ID, reason)
+	state.DenyReason = reason
+	return proxy.PolicyDeniedResponse(req, host, policy, reason)
+}
+
+// checkConnectPort restricts tunnels to the allowed ports, which a policy may
+// override per user or role.
+func checkConnectPort(state *proxy.RequestState, req *http.Request, host string, policy *models.Policy) *http.Response {
+	ports := proxy.ConnectPorts(policy, cfg.Server.ConnectPorts)
+	reason := proxy.CheckConnectPort(ports, host)
+	if reason == "" {
+		return nil
+	}
+
+	logger.Info("CONNECT to %s from %s denied: %s", host, req.RemoteAddr, reason)
+	state.DenyReason = reason
+	return proxy.PortDeniedResponse(req, host, reason, ports)
+}
+
+// checkDestination refuses internal destinations. The dialer checks the
+// connected address again.
+func checkDestination(state *proxy.RequestState, req *http.Request, host string) *http.Response {
+	if destGuard == nil {
+		return nil
+	}
+	err := destGuard.Check(req.Context(), host)
+	if err == nil {
+		return nil
+	}
+
+	logger.Warn("Request to %s from %s refused: %v", host, req.RemoteAddr, err)
+	state.DenyReason = err.Error()
+	return proxy.DestinationDeniedResponse(req, host, err.Error())
+}
+
+// checkQuota refuses users who have used up their traffic quota.
+func checkQuota(state *proxy.RequestState, req *http.Request, host string, policy *models.Policy) *http.Response {
+	reason := usageTracker.Check(state.User, policy)
+	if reason == "" {
+		return nil
+	}
+
+	logger.Info("Request to %s by %s denied: %s", host, state.User.Username, reason)
+	state.DenyReason = reason
+	return proxy.QuotaExceededResponse(req, reason)
+}
+
+func applyBandwidthLimit(state *proxy.RequestState, policy *models.Policy) {
+	if policy != nil {
+		state.BandwidthLimit = policy.BandwidthLimit
+	}
+}
+
+// applyEgress picks the source address direct connections for the exchange
+// leave from.
+func applyEgress(state *proxy.RequestState, host string) {
+	state.Egress = egressSelector.Select(state, host)
+}
+
+// applyWebSocketIdleTimeout sets how long an upgraded session may go without
+// traffic: the policy's timeout when it sets one, the server default
+// otherwise.
+func applyWebSocketIdleTimeout(state *proxy.RequestState, policy *models.Policy) {
+	seconds := cfg.Server.WebSocketIdleTimeout
+	if policy != nil && policy.WebSocketIdleTimeout > 0 {
+		seconds = policy.WebSocketIdleTimeout
+	}
+	state.WebSocketIdleTimeout = time.Duration(seconds) * time.Second
+}
+
+// acquireConnection registers the exchange in the live connection table,
+// enforcing the proxy-wide and per-user caps, until it finishes.
+func acquireConnection(state *proxy.RequestState, req *http.Request, host string, policy *models.Policy) *http.Response {
+	limit := userConnectionLimit(policy)
+	err := connections.Register(state, req.Method, req.RemoteAddr, host, limit)
+	switch err {
+	case nil:
+		return nil
+	case proxy.ErrUserConnectionLimit:
+		logger.Info("Connection limit reached for %s", state.User.Username)
+		state.DenyReason = err.Error()
+		return proxy.ConnectionLimitResponse(req, limit)
+	default:
+		logger.Warn("Proxy connection limit of %d reached, refusing %s from %s", cfg.Server.MaxConnections, host, req.RemoteAddr)
+		state.DenyReason = err.Error()
+		return proxy.ServerBusyResponse(req)
+	}
+}
+
+// userConnectionLimit returns the user's concurrency cap: the policy's when
+// it sets one, the server default otherwise.
+func userConnectionLimit(policy *models.Policy) int {
+	if policy != nil && policy.MaxConnections > 0 {
+		return policy.MaxConnections
+	}
+	return cfg.Server.MaxConnectionsPerUser
+}
+
+// matchRule evaluates the destination rules and remembers the match for the
+// ProxyLog row.
+func matchRule(state *proxy.RequestState, host, rawURL string) *models.Rule {
+	rule := ruleEngine.Evaluate(host, rawURL)
+	if rule != nil {
+		state.RuleID = &rule.ID
+	}
+	return rule
+}
+
+// authorizeProxyRequest applies the same policy to plain requests and CONNECT:
+// clients in the allowlist pass, everyone else must authenticate. Credentials
+// are still checked for allowlisted clients so their traffic is attributed.
+func authorizeProxyRequest(req *http.Request) (*models.User, bool) {
+	user, authenticated := proxyAuth.AuthenticateRequest(req)
+	if authenticated {
+		return user, true
+	}
+	return nil, isIPAllowed(req.RemoteAddr)
+}
+
 func isIPAllowed(remoteAddr string) bool {
 	clientIP, _, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
@@ -178,21 +704,89 @@ func isIPAllowed(remoteAddr string) bool {
 	return false
 }
 
-func zulUserPass(user, passwd string) bool {
-	// TODO: Replace with database authentication
-	if user == "zulkan" && passwd == "zulkan" {
-		return true
-	}
-	return false
-}
-
-func getHandleConnect() goproxy.HttpsHandler {
+func getHandleConnect(interceptor *proxy.Interceptor) goproxy.HttpsHandler {
 	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
 		logger.Debug("CONNECT request to %s from %s", host, ctx.Req.RemoteAddr)
 
-		if !isIPAllowed(ctx.Req.RemoteAddr) {
-			return auth.BasicConnect("ZulgoProxy", zulUserPass).HandleConnect(host, ctx)
+		user, allowed := authorizeProxyRequest(ctx.Req)
+		state := proxy.NewRequestState(user)
+		ctx.UserData = state
+		// Error pages show the request ID
+		*ctx.Req = *ctx.Req.WithContext(proxy.WithState(ctx.Req.Context(), state))
+
+		if !allowed {
+			logger.Warn("Proxy authentication required for CONNECT %s from %s", host, ctx.Req.RemoteAddr)
+			ctx.Resp = proxy.AuthRequiredResponse(ctx.Req, proxyRealm)
+			rejectConnect(state, ctx, host)
+			return goproxy.RejectConnect, host
+		}
+
+		if rule := matchRule(state, host, host); rule != nil && rule.Action == models.RuleActionDeny {
+			logger.Info("CONNECT to %s from %s blocked by rule %d", host, ctx.Req.RemoteAddr, rule.ID)
+			ctx.Resp = proxy.BlockedResponse(ctx.Req, host, rule)
+			rejectConnect(state, ctx, host)
+			return goproxy.RejectConnect, host
 		}
-		return goproxy.OkConnect, host
+
+		policy := policyEnforcer.For(user)
+		if ctx.Resp = checkPolicy(state, ctx.Req, host, policy); ctx.Resp != nil {
+			rejectConnect(state, ctx, host)
+			return goproxy.RejectConnect, host
+		}
+		if ctx.Resp = checkConnectPort(state, ctx.Req, host, policy); ctx.Resp != nil {
+			rejectConnect(state, ctx, host)
+			return goproxy.RejectConnect, host
+		}
+		if ctx.Resp = checkDestination(state, ctx.Req, host); ctx.Resp != nil {
+			rejectConnect(state, ctx, host)
+			return goproxy.RejectConnect, host
+		}
+		if ctx.Resp = checkQuota(state, ctx.Req, host, policy); ctx.Resp != nil {
+			rejectConnect(state, ctx, host)
+			return goproxy.RejectConnect, host
+		}
+		applyBandwidthLimit(state, policy)
+		applyEgress(state, host)
+
+		// Requests inside an intercepted tunnel take their own connection slots
+		if shouldIntercept(host, user) {
+			logger.Debug("Intercepting TLS to %s", host)
+			state.Intercepted = true
+			return interceptor.Tunnel(host, mitmAuthority.TLSConfig(host)), host
+		}
+
+		if ctx.Resp = acquireConnection(state, ctx.Req, host, policy); ctx.Resp != nil {
+			rejectConnect(state, ctx, host)
+			return goproxy.RejectConnect, host
+		}
+		return proxy.ConnectTunnel(host, upstreamRouter.DialContext), host
 	})
 }
+
+// shouldIntercept reports whether a tunnel to host is opted in to TLS
+// interception, either by destination or by the proxy user.
+func shouldIntercept(host string, user *models.User) bool {
+	if mitmAuthority == nil {
+		return false
+	}
+	if proxy.MatchAnyHost(cfg.MITM.Hosts, host) {
+		return true
+	}
+	if user != nil {
+		for _, username := range cfg.MITM.Users {
+			if username == user.Username {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rejectConnect records a CONNECT answered with ctx.Resp instead of a tunnel.
+func rejectConnect(state *proxy.RequestState, ctx *goproxy.ProxyCtx, host string) {
+	entry := state.LogEntry(ctx.Req)
+	entry.Host = host
+	entry.StatusCode = ctx.Resp.StatusCode
+	proxy.Record(entry)
+	state.Finish()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+	"github.com/zulkan/zulgoproxy/proxy"
+	"github.com/zulkan/zulgoproxy/socks5"
+)
+
+func startSOCKSServer() {
+	server := &socks5.Server{
+		Authenticate:   proxyAuth.Authenticate,
+		AllowAnonymous: isIPAllowed,
+		Authorize:      authorizeSOCKS,
+		Acquire:        acquireTunnelConnection,
+		Dial:           upstreamRouter.DialContext,
+		Lookup:         dnsResolver.LookupIP,
+		CheckAddr:      checkSOCKSAddr,
+		EnableUDP:      cfg.Server.SOCKSUDP,
+	}
+
+	logger.Info("SOCKS5 server starting on port %d", cfg.Server.SOCKSPort)
+	logger.Fatal("SOCKS5 server error: %v", server.ListenAndServe(fmt.Sprintf(":%d", cfg.Server.SOCKSPort)))
+}
+
+// authorizeTunnel applies the destination rules, the user's access policy and
+// quotas to a SOCKS5 or transparent session, the checks a CONNECT goes through
+// other than its port allowlist.
+func authorizeTunnel(state *proxy.RequestState, host string) string {
+	if rule := matchRule(state, host, host); rule != nil && rule.Action == models.RuleActionDeny {
+		return fmt.Sprintf("blocked by rule %d (%s)", rule.ID, rule.Name)
+	}
+	policy := policyEnforcer.For(state.User)
+	if reason := proxy.CheckPolicy(policy, host); reason != "" {
+		return reason
+	}
+	if destGuard != nil {
+		if err := destGuard.Check(proxy.WithState(context.Background(), state), host); err != nil {
+			return err.Error()
+		}
+	}
+	if reason := usageTracker.Check(state.User, policy); reason != "" {
+		return reason
+	}
+	applyBandwidthLimit(state, policy)
+	applyEgress(state, host)
+	return ""
+}
+
+// authorizeSOCKS restricts SOCKS5 destinations to socks_ports, when set, and
+// to the ports of the user's policy, when it lists any, on top of the checks
+// of authorizeTunnel. server.connect_ports only applies to HTTP CONNECT.
+func authorizeSOCKS(state *proxy.RequestState, host string) string {
+	if reason := proxy.CheckConnectPort(cfg.Server.SOCKSPorts, host); reason != "" {
+		return reason
+	}
+	policy := policyEnforcer.For(state.User)
+	if reason := proxy.CheckConnectPort(proxy.ConnectPorts(policy, nil), host); reason != "" {
+		return reason
+	}
+	return authorizeTunnel(state, host)
+}
+
+// checkSOCKSAddr re-checks each resolved UDP destination.
+func checkSOCKSAddr(ip net.IP) error {
+	if destGuard == nil {
+		return nil
+	}
+	return destGuard.CheckIP(ip)
+}
+
+// acquireTunnelConnection registers a SOCKS5 or transparent session in the
+// live connection table.
+func acquireTunnelConnection(state *proxy.RequestState, entry *models.ProxyLog) string {
+	err := connections.Register(state, entry.Method, entry.RemoteAddr, entry.Host, userConnectionLimit(policyEnforcer.For(state.User)))
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
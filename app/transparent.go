@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/transparent"
+)
+
+// startTransparentServer accepts traffic redirected to the proxy. Plain HTTP
+// goes through handler like any proxied request; TLS is tunneled to its SNI
+// after the checks SOCKS5 sessions get. Transparent clients cannot
+// authenticate, so only allowed_ips may use it.
+func startTransparentServer(handler http.Handler) {
+	server := &transparent.Server{
+		HTTP:        handler,
+		AllowClient: isIPAllowed,
+		Authorize:   authorizeTunnel,
+		Acquire:     acquireTunnelConnection,
+		Dial:        upstreamRouter.DialContext,
+		TLSPort:     cfg.Server.TransparentTLSPort,
+	}
+
+	logger.Info("Transparent proxy starting on port %d", cfg.Server.TransparentPort)
+	logger.Fatal("Transparent proxy error: %v", server.ListenAndServe(fmt.Sprintf(":%d", cfg.Server.TransparentPort)))
+}
@@ -0,0 +1,213 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Heuristic freshness is a tenth of the time since Last-Modified, capped
+const maxHeuristicLifetime = 24 * time.Hour
+
+// Statuses whose responses may be cached without explicit freshness
+// (RFC 9110 section 15.1)
+var heuristicStatuses = map[int]bool{
+	200: true, 203: true, 204: true, 206: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// Headers that describe a single connection and are never stored
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "TE", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// cacheControl holds the parsed Cache-Control directives of a message.
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg, _ := strings.Cut(directive, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+	// Pragma: no-cache counts only when Cache-Control is absent
+	if len(cc) == 0 && strings.Contains(strings.ToLower(header.Get("Pragma")), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the delta-seconds argument of name.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	arg, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// storable reports whether a shared cache may store resp to req
+// (RFC 9111 section 3).
+func storable(req *http.Request, resp *http.Response) bool {
+	if req.Method != http.MethodGet || resp.StatusCode == http.StatusPartialContent {
+		return false
+	}
+	reqCC := parseCacheControl(req.Header)
+	respCC := parseCacheControl(resp.Header)
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+	if resp.Header.Get("Vary") == "*" {
+		return false
+	}
+	// A response to an authenticated request is for that user alone unless
+	// the origin says otherwise
+	if req.Header.Get("Authorization") != "" &&
+		!respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+		return false
+	}
+	// Cookies are per client; storing them would hand them to other users
+	if resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+
+	explicit := respCC.has("public") || respCC.has("s-maxage") || respCC.has("max-age") || resp.Header.Get("Expires") != ""
+	if !explicit && !heuristicStatuses[resp.StatusCode] {
+		return false
+	}
+	// Entries that are never fresh and cannot be revalidated are useless
+	return freshnessLifetime(resp.StatusCode, resp.Header) > 0 ||
+		resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// freshnessLifetime implements RFC 9111 section 4.2.1 for a shared cache.
+func freshnessLifetime(status int, header http.Header) time.Duration {
+	cc := parseCacheControl(header)
+	if cc.has("no-cache") {
+		return 0
+	}
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+
+	date := parseDate(header.Get("Date"), time.Now())
+	if expires := header.Get("Expires"); expires != "" {
+		// An invalid Expires, such as "0", means already expired
+		t, err := http.ParseTime(expires)
+		if err != nil || !t.After(date) {
+			return 0
+		}
+		return t.Sub(date)
+	}
+
+	if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil && heuristicStatuses[status] {
+		lifetime := date.Sub(lastModified) / 10
+		if lifetime > maxHeuristicLifetime {
+			lifetime = maxHeuristicLifetime
+		}
+		if lifetime > 0 {
+			return lifetime
+		}
+	}
+	return 0
+}
+
+// currentAge implements RFC 9111 section 4.2.3.
+func (e *Entry) currentAge(now time.Time) time.Duration {
+	date := parseDate(e.Header.Get("Date"), e.ResponseTime)
+	apparentAge := e.ResponseTime.Sub(date)
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	correctedAgeValue := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	initialAge := apparentAge
+	if correctedAgeValue > initialAge {
+		initialAge = correctedAgeValue
+	}
+	return initialAge + now.Sub(e.ResponseTime)
+}
+
+// fresh reports whether the entry may be served to a request with the given
+// directives without contacting the origin.
+func (e *Entry) fresh(now time.Time, reqCC cacheControl) bool {
+	if reqCC.has("no-cache") {
+		return false
+	}
+	respCC := parseCacheControl(e.Header)
+	if respCC.has("no-cache") {
+		return false
+	}
+
+	lifetime := freshnessLifetime(e.Status, e.Header)
+	age := e.currentAge(now)
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok {
+		age += minFresh
+	}
+	if age < lifetime {
+		return true
+	}
+
+	// Stale entries may be served to clients that accept staleness, unless
+	// the origin forbids it
+	if respCC.has("must-revalidate") || respCC.has("proxy-revalidate") || respCC.has("s-maxage") {
+		return false
+	}
+	if maxStale, ok := reqCC["max-stale"]; ok {
+		if maxStale == "" {
+			return true
+		}
+		if d, ok := reqCC.seconds("max-stale"); ok {
+			return age-lifetime <= d
+		}
+	}
+	return false
+}
+
+func parseDate(value string, fallback time.Time) time.Time {
+	if t, err := http.ParseTime(value); err == nil {
+		return t
+	}
+	return fallback
+}
+
+// storedHeader returns a copy of header without hop-by-hop fields, including
+// those named in Connection.
+func storedHeader(header http.Header) http.Header {
+	stored := header.Clone()
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			stored.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		stored.Del(name)
+	}
+	return stored
+}
@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func header(pairs ...string) http.Header {
+	h := make(http.Header)
+	for i := 0; i < len(pairs); i += 2 {
+		h.Add(pairs[i], pairs[i+1])
+	}
+	return h
+}
+
+func TestStorable(t *testing.T) {
+	date := time.Date(2026, time.January, 5, 12, 0, 0, 0, time.UTC)
+	lastModified := date.Add(-10 * 24 * time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		method string
+		req    http.Header
+		status int
+		resp   http.Header
+		want   bool
+	}{
+		{"max-age", "GET", nil, 200, header("Cache-Control", "max-age=60"), true},
+		{"s-maxage", "GET", nil, 200, header("Cache-Control", "s-maxage=60"), true},
+		{"public without a lifetime", "GET", nil, 200, header("Cache-Control", "public", "ETag", `"v1"`), true},
+		{"Expires", "GET", nil, 200, header("Date", date.Format(http.TimeFormat), "Expires", date.Add(time.Hour).Format(http.TimeFormat)), true},
+		{"heuristic from Last-Modified", "GET", nil, 200, header("Last-Modified", lastModified), true},
+		{"heuristic status not cacheable", "GET", nil, 302, header("Last-Modified", lastModified), false},
+		{"explicit lifetime on any status", "GET", nil, 302, header("Cache-Control", "max-age=60"), true},
+		{"nothing to go on", "GET", nil, 200, header(), false},
+		{"max-age=0 with a validator", "GET", nil, 200, header("Cache-Control", "max-age=0", "ETag", `"v1"`), true},
+		{"max-age=0 without a validator", "GET", nil, 200, header("Cache-Control", "max-age=0"), false},
+
+		{"POST", "POST", nil, 200, header("Cache-Control", "max-age=60"), false},
+		{"HEAD", "HEAD", nil, 200, header("Cache-Control", "max-age=60"), false},
+		{"partial content", "GET", nil, 206, header("Cache-Control", "max-age=60"), false},
+		{"response no-store", "GET", nil, 200, header("Cache-Control", "max-age=60, no-store"), false},
+		{"request no-store", "GET", header("Cache-Control", "no-store"), 200, header("Cache-Control", "max-age=60"), false},
+		{"private", "GET", nil, 200, header("Cache-Control", "private, max-age=60"), false},
+		{"private with an argument", "GET", nil, 200, header("Cache-Control", `private="Set-Cookie", max-age=60`), false},
+		{"Vary *", "GET", nil, 200, header("Cache-Control", "max-age=60", "Vary", "*"), false},
+		{"Set-Cookie", "GET", nil, 200, header("Cache-Control", "max-age=60", "Set-Cookie", "session=1"), false},
+		{"Set-Cookie even when public", "GET", nil, 200, header("Cache-Control", "public, max-age=60", "Set-Cookie", "session=1"), false},
+
+		{"Authorization", "GET", header("Authorization", "Basic YTpi"), 200, header("Cache-Control", "max-age=60"), false},
+		{"Authorization with public", "GET", header("Authorization", "Basic YTpi"), 200, header("Cache-Control", "public, max-age=60"), true},
+		{"Authorization with s-maxage", "GET", header("Authorization", "Basic YTpi"), 200, header("Cache-Control", "s-maxage=60"), true},
+		{"Authorization with must-revalidate", "GET", header("Authorization", "Basic YTpi"), 200, header("Cache-Control", "must-revalidate, max-age=60"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, "http://example.com/", nil)
+			for name, values := range tt.req {
+				req.Header[name] = values
+			}
+			resp := &http.Response{StatusCode: tt.status, Header: tt.resp}
+			if got := storable(req, resp); got != tt.want {
+				t.Errorf("storable = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	date := time.Date(2026, time.January, 5, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) string { return date.Add(d).Format(http.TimeFormat) }
+
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		want   time.Duration
+	}{
+		{"max-age", 200, header("Cache-Control", "max-age=60"), time.Minute},
+		{"s-maxage beats max-age", 200, header("Cache-Control", "max-age=60, s-maxage=600"), 10 * time.Minute},
+		{"s-maxage of zero", 200, header("Cache-Control", "s-maxage=0, max-age=600"), 0},
+		{"max-age beats Expires", 200, header("Cache-Control", "max-age=60", "Date", at(0), "Expires", at(time.Hour)), time.Minute},
+		{"invalid max-age falls through", 200, header("Cache-Control", "max-age=soon", "Date", at(0), "Expires", at(time.Hour)), time.Hour},
+		{"no-cache", 200, header("Cache-Control", "no-cache, max-age=60"), 0},
+		{"Pragma without Cache-Control", 200, header("Pragma", "no-cache", "Date", at(0), "Expires", at(time.Hour)), 0},
+		{"Expires relative to Date", 200, header("Date", at(0), "Expires", at(time.Hour)), time.Hour},
+		{"Expires in the past", 200, header("Date", at(0), "Expires", at(-time.Hour)), 0},
+		{"invalid Expires", 200, header("Date", at(0), "Expires", "0", "Last-Modified", at(-10*time.Hour)), 0},
+		{"heuristic", 200, header("Date", at(0), "Last-Modified", at(-10*time.Hour)), time.Hour},
+		{"heuristic is capped", 200, header("Date", at(0), "Last-Modified", at(-100*24*time.Hour)), 24 * time.Hour},
+		{"heuristic on a 404", 404, header("Date", at(0), "Last-Modified", at(-10*time.Hour)), time.Hour},
+		{"no heuristic on a 302", 302, header("Date", at(0), "Last-Modified", at(-10*time.Hour)), 0},
+		{"Last-Modified after Date", 200, header("Date", at(0), "Last-Modified", at(time.Hour)), 0},
+		{"nothing", 200, header(), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := freshnessLifetime(tt.status, tt.header); got != tt.want {
+				t.Errorf("freshnessLifetime = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEntryFresh(t *testing.T) {
+	stored := time.Date(2026, time.January, 5, 12, 0, 0, 0, time.UTC)
+	entry := func(pairs ...string) *Entry {
+		h := header(pairs...)
+		h.Set("Date", stored.Format(http.TimeFormat))
+		return &Entry{Status: 200, Header: h, RequestTime: stored, ResponseTime: stored}
+	}
+
+	tests := []struct {
+		name  string
+		entry *Entry
+		after time.Duration // since the response was stored
+		req   http.Header
+		want  bool
+	}{
+		{"within max-age", entry("Cache-Control", "max-age=60"), 59 * time.Second, nil, true},
+		{"at max-age", entry("Cache-Control", "max-age=60"), time.Minute, nil, false},
+		{"Age counts", entry("Cache-Control", "max-age=60", "Age", "30"), 40 * time.Second, nil, false},
+		{"s-maxage over max-age", entry("Cache-Control", "max-age=600, s-maxage=60"), 2 * time.Minute, nil, false},
+		{"heuristic", entry("Last-Modified", stored.Add(-10*time.Hour).Format(http.TimeFormat)), 59 * time.Minute, nil, true},
+		{"heuristic expired", entry("Last-Modified", stored.Add(-10*time.Hour).Format(http.TimeFormat)), 61 * time.Minute, nil, false},
+		{"response no-cache", entry("Cache-Control", "no-cache", "ETag", `"v1"`), 0, nil, false},
+
+		{"request no-cache", entry("Cache-Control", "max-age=60"), 0, header("Cache-Control", "no-cache"), false},
+		{"request Pragma no-cache", entry("Cache-Control", "max-age=60"), 0, header("Pragma", "no-cache"), false},
+		{"request max-age", entry("Cache-Control", "max-age=600"), 2 * time.Minute, header("Cache-Control", "max-age=60"), false},
+		{"request min-fresh", entry("Cache-Control", "max-age=600"), 2 * time.Minute, header("Cache-Control", "min-fresh=500"), false},
+		{"request max-stale", entry("Cache-Control", "max-age=60"), 2 * time.Minute, header("Cache-Control", "max-stale=120"), true},
+		{"request max-stale exceeded", entry("Cache-Control", "max-age=60"), 4 * time.Minute, header("Cache-Control", "max-stale=120"), false},
+		{"request any staleness", entry("Cache-Control", "max-age=60"), time.Hour, header("Cache-Control", "max-stale"), true},
+		{"must-revalidate forbids stale", entry("Cache-Control", "max-age=60, must-revalidate"), 2 * time.Minute, header("Cache-Control", "max-stale"), false},
+		{"s-maxage forbids stale", entry("Cache-Control", "s-maxage=60"), 2 * time.Minute, header("Cache-Control", "max-stale"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqCC := parseCacheControl(tt.req)
+			if got := tt.entry.fresh(stored.Add(tt.after), reqCC); got != tt.want {
+				t.Errorf("fresh after %v = %v, want %v", tt.after, got, tt.want)
+			}
+		})
+	}
+}
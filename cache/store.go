@@ -0,0 +1,388 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/logger"
+)
+
+// Entry is a stored response. Its metadata is kept next to the body as JSON
+// so the cache survives restarts.
+type Entry struct {
+	Key          string      `json:"key"`
+	URL          string      `json:"url"`
+	Vary         []string    `json:"vary,omitempty"` // request headers the response varies on
+	Status       int         `json:"status"`
+	Header       http.Header `json:"header"`
+	Size         int64       `json:"size"`
+	RequestTime  time.Time   `json:"request_time"`
+	ResponseTime time.Time   `json:"response_time"`
+
+	name string // file name without extension
+}
+
+// Stats summarizes the cache for the admin API.
+type Stats struct {
+	Entries       int     `json:"entries"`
+	Size          int64   `json:"size"`
+	MaxSize       int64   `json:"max_size"`
+	MaxObjectSize int64   `json:"max_object_size"`
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	Revalidated   int64   `json:"revalidated"`
+	Evictions     int64   `json:"evictions"`
+	HitRatio      float64 `json:"hit_ratio"`
+}
+
+// Store keeps response bodies on disk and their index in memory, evicting
+// the least recently used entries to stay under its size limit. Recency is
+// not persisted; after a restart entries are ordered by when they were stored.
+type Store struct {
+	dir           string
+	maxSize       int64
+	maxObjectSize int64
+	entries       map[string]*list.Element
+	lru           *list.List          // front is most recently used
+	vary          map[string][]string // URL -> headers its stored variants vary on
+	variants      map[string]int      // URL -> number of stored variants
+	size          int64
+	mutex         sync.Mutex
+
+	hits        int64
+	misses      int64
+	revalidated int64
+	evictions   int64
+}
+
+// NewStore opens the cache in dir, loading the entries already there.
+func NewStore(dir string, maxSize, maxObjectSize int64) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	s := &Store{
+		dir:           dir,
+		maxSize:       maxSize,
+		maxObjectSize: maxObjectSize,
+		entries:       make(map[string]*list.Element),
+		lru:           list.New(),
+		vary:          make(map[string][]string),
+		variants:      make(map[string]int),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) load() error {
+	metas, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	var entries []*Entry
+	for _, meta := range metas {
+		data, err := os.ReadFile(meta)
+		if err != nil {
+			continue
+		}
+		entry := &Entry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			logger.Warn("Removing unreadable cache entry %s: %v", meta, err)
+			os.Remove(meta)
+			continue
+		}
+		entry.name = strings.TrimSuffix(filepath.Base(meta), ".json")
+		if info, err := os.Stat(s.bodyPath(entry)); err != nil || info.Size() != entry.Size {
+			s.removeFiles(entry)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ResponseTime.Before(entries[j].ResponseTime) })
+	for _, entry := range entries {
+		s.add(entry)
+	}
+	s.evict()
+
+	// Bodies of responses that were still downloading at shutdown
+	temps, _ := filepath.Glob(filepath.Join(s.dir, "*.tmp"))
+	for _, temp := range temps {
+		os.Remove(temp)
+	}
+
+	logger.Info("Loaded %d cached responses (%d bytes)", len(s.entries), s.size)
+	return nil
+}
+
+// key identifies the variant of url selected by req's vary headers.
+func key(url string, vary []string, req *http.Request) string {
+	var b strings.Builder
+	b.WriteString(url)
+	for _, name := range vary {
+		b.WriteString("\n")
+		b.WriteString(strings.ToLower(name))
+		b.WriteString(":")
+		b.WriteString(strings.Join(req.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// varyHeaders returns the header names listed in resp's Vary.
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Store) bodyPath(entry *Entry) string {
+	return filepath.Join(s.dir, entry.name+".body")
+}
+
+func (s *Store) metaPath(entry *Entry) string {
+	return filepath.Join(s.dir, entry.name+".json")
+}
+
+func (s *Store) removeFiles(entry *Entry) {
+	os.Remove(s.bodyPath(entry))
+	os.Remove(s.metaPath(entry))
+}
+
+// Get returns the entry matching req with its body opened, or nil.
+func (s *Store) Get(req *http.Request) (*Entry, *os.File) {
+	url := req.URL.String()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	vary, ok := s.vary[url]
+	if !ok {
+		return nil, nil
+	}
+	elem, ok := s.entries[key(url, vary, req)]
+	if !ok {
+		return nil, nil
+	}
+	entry := elem.Value.(*Entry)
+	body, err := os.Open(s.bodyPath(entry))
+	if err != nil {
+		s.remove(elem)
+		return nil, nil
+	}
+	s.lru.MoveToFront(elem)
+	return entry, body
+}
+
+// Refresh replaces the stored headers of entry with those of a 304 answering
+// a revalidation (RFC 9111 section 4.3.4) and returns the updated entry.
+func (s *Store) Refresh(entry *Entry, resp *http.Response, requestTime time.Time) *Entry {
+	updated := *entry
+	updated.Header = entry.Header.Clone()
+	for name, values := range storedHeader(resp.Header) {
+		if name == "Content-Length" {
+			continue
+		}
+		updated.Header[name] = values
+	}
+	updated.RequestTime = requestTime
+	updated.ResponseTime = time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	elem, ok := s.entries[entry.Key]
+	if !ok || elem.Value.(*Entry) != entry {
+		return &updated
+	}
+	elem.Value = &updated
+	if err := s.writeMeta(&updated); err != nil {
+		logger.Warn("Failed to update cache entry for %s: %v", updated.URL, err)
+	}
+	return &updated
+}
+
+func (s *Store) writeMeta(entry *Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	temp := s.metaPath(entry) + ".tmp"
+	if err := os.WriteFile(temp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, s.metaPath(entry))
+}
+
+// Writer returns a file to write the body of resp into. Commit stores the
+// entry once the body is complete.
+func (s *Store) Writer(req *http.Request, resp *http.Response, requestTime time.Time) (*os.File, *Entry, error) {
+	vary := varyHeaders(resp.Header)
+	url := req.URL.String()
+	entry := &Entry{
+		Key:          key(url, vary, req),
+		URL:          url,
+		Vary:         vary,
+		Status:       resp.StatusCode,
+		Header:       storedHeader(resp.Header),
+		RequestTime:  requestTime,
+		ResponseTime: time.Now(),
+	}
+	sum := sha256.Sum256([]byte(entry.Key))
+	entry.name = hex.EncodeToString(sum[:16])
+
+	file, err := os.CreateTemp(s.dir, entry.name+"-*.tmp")
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, entry, nil
+}
+
+// Commit moves a completely written body into place and indexes entry.
+func (s *Store) Commit(entry *Entry, file *os.File, size int64) error {
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	entry.Size = size
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if elem, ok := s.entries[entry.Key]; ok {
+		s.remove(elem)
+	}
+	if err := os.Rename(file.Name(), s.bodyPath(entry)); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := s.writeMeta(entry); err != nil {
+		os.Remove(s.bodyPath(entry))
+		return err
+	}
+
+	// A new Vary set replaces the variants stored under the old one
+	if old, ok := s.vary[entry.URL]; ok && strings.Join(old, ",") != strings.Join(entry.Vary, ",") {
+		s.purgeURL(entry.URL)
+	}
+	s.add(entry)
+	s.evict()
+	return nil
+}
+
+// add indexes entry as the most recently used. The caller holds the mutex.
+func (s *Store) add(entry *Entry) {
+	s.entries[entry.Key] = s.lru.PushFront(entry)
+	s.vary[entry.URL] = entry.Vary
+	s.variants[entry.URL]++
+	s.size += entry.Size
+}
+
+// evict drops least recently used entries until the cache fits. The caller
+// holds the mutex.
+func (s *Store) evict() {
+	for s.size > s.maxSize && s.lru.Len() > 0 {
+		s.remove(s.lru.Back())
+		atomic.AddInt64(&s.evictions, 1)
+	}
+}
+
+// remove drops one entry. The caller holds the mutex.
+func (s *Store) remove(elem *list.Element) {
+	entry := elem.Value.(*Entry)
+	s.lru.Remove(elem)
+	delete(s.entries, entry.Key)
+	s.size -= entry.Size
+	s.removeFiles(entry)
+
+	if s.variants[entry.URL]--; s.variants[entry.URL] <= 0 {
+		delete(s.variants, entry.URL)
+		delete(s.vary, entry.URL)
+	}
+}
+
+// purgeURL drops every variant of url. The caller holds the mutex.
+func (s *Store) purgeURL(url string) int {
+	n := 0
+	for _, elem := range s.entries {
+		if elem.Value.(*Entry).URL == url {
+			s.remove(elem)
+			n++
+		}
+	}
+	return n
+}
+
+// Invalidate drops the stored variants of url, e.g. after a POST to it.
+func (s *Store) Invalidate(url string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.purgeURL(url)
+}
+
+// Purge drops every entry whose URL matches pattern, where "*" matches any
+// run of characters, and returns how many were removed.
+func (s *Store) Purge(pattern string) int {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	re := regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n := 0
+	for _, elem := range s.entries {
+		if re.MatchString(elem.Value.(*Entry).URL) {
+			s.remove(elem)
+			n++
+		}
+	}
+	return n
+}
+
+// MaxObjectSize is the largest body the cache stores.
+func (s *Store) MaxObjectSize() int64 {
+	return s.maxObjectSize
+}
+
+func (s *Store) Stats() Stats {
+	s.mutex.Lock()
+	stats := Stats{
+		Entries:       len(s.entries),
+		Size:          s.size,
+		MaxSize:       s.maxSize,
+		MaxObjectSize: s.maxObjectSize,
+	}
+	s.mutex.Unlock()
+
+	stats.Hits = atomic.LoadInt64(&s.hits)
+	stats.Misses = atomic.LoadInt64(&s.misses)
+	stats.Revalidated = atomic.LoadInt64(&s.revalidated)
+	stats.Evictions = atomic.LoadInt64(&s.evictions)
+	if total := stats.Hits + stats.Misses + stats.Revalidated; total > 0 {
+		stats.HitRatio = float64(stats.Hits+stats.Revalidated) / float64(total)
+	}
+	return stats
+}
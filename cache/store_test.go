@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func storeResponse(t *testing.T, s *Store, req *http.Request, resp *http.Response, body string) {
+	t.Helper()
+	file, entry, err := s.Writer(req, resp, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(file, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit(entry, file, int64(len(body))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreVary(t *testing.T) {
+	s, err := NewStore(t.TempDir(), 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(encoding string) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/app.js", nil)
+		if encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+		return req
+	}
+	resp := &http.Response{StatusCode: 200, Header: header("Cache-Control", "max-age=60", "Vary", "accept-encoding")}
+
+	storeResponse(t, s, request("gzip"), resp, "compressed")
+	storeResponse(t, s, request(""), resp, "plain")
+
+	tests := []struct {
+		encoding string
+		want     string // body served, "" for a miss
+	}{
+		{"gzip", "compressed"},
+		{"", "plain"},
+		{"br", ""},
+		{"gzip, br", ""},
+	}
+	for _, tt := range tests {
+		entry, body := s.Get(request(tt.encoding))
+		var got string
+		if entry != nil {
+			data, _ := io.ReadAll(body)
+			body.Close()
+			got = string(data)
+		}
+		if got != tt.want {
+			t.Errorf("Accept-Encoding %q served %q, want %q", tt.encoding, got, tt.want)
+		}
+	}
+
+	// A response varying on something else replaces the stored variants
+	storeResponse(t, s, request("gzip"), &http.Response{StatusCode: 200, Header: header("Cache-Control", "max-age=60", "Vary", "Accept-Language")}, "by language")
+	entry, body := s.Get(request(""))
+	if entry == nil || len(entry.Vary) != 1 || entry.Vary[0] != "Accept-Language" {
+		t.Fatalf("after the Vary change, got %+v", entry)
+	}
+	body.Close()
+	if stats := s.Stats(); stats.Entries != 1 {
+		t.Errorf("%d entries, want the old variants purged", stats.Entries)
+	}
+}
@@ -0,0 +1,251 @@
+// Package cache is a shared HTTP cache (RFC 9111) for plain and intercepted
+// proxied requests, stored on disk.
+package cache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/proxy"
+)
+
+// Outcomes stored in ProxyLog.CacheStatus
+const (
+	StatusHit         = "HIT"
+	StatusMiss        = "MISS"
+	StatusRevalidated = "REVALIDATED"
+)
+
+// Transport answers GET requests from the Store when it can and stores
+// cacheable responses fetched through next.
+type Transport struct {
+	store *Store
+	next  http.RoundTripper
+}
+
+func NewTransport(store *Store, next http.RoundTripper) *Transport {
+	return &Transport{store: store, next: next}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		resp, err := t.next.RoundTrip(req)
+		// A successful unsafe request makes stored responses stale
+		// (RFC 9111 section 4.4)
+		if err == nil && unsafeMethod(req.Method) && resp.StatusCode < 400 {
+			t.store.Invalidate(req.URL.String())
+		}
+		return resp, err
+	}
+	if req.Header.Get("Range") != "" {
+		return t.next.RoundTrip(req)
+	}
+
+	state := proxy.StateFromContext(req.Context())
+	reqCC := parseCacheControl(req.Header)
+	entry, body := t.store.Get(req)
+	if entry != nil && entry.fresh(time.Now(), reqCC) {
+		atomic.AddInt64(&t.store.hits, 1)
+		setStatus(state, StatusHit)
+		return entry.response(req, body), nil
+	}
+	if entry == nil && reqCC.has("only-if-cached") {
+		return gatewayTimeout(req), nil
+	}
+
+	// A stale entry is revalidated unless the client sent conditions of its
+	// own, which are passed through untouched
+	outReq := req
+	if entry != nil && !conditional(req) {
+		etag := entry.Header.Get("ETag")
+		lastModified := entry.Header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			outReq = req.Clone(req.Context())
+			if etag != "" {
+				outReq.Header.Set("If-None-Match", etag)
+			}
+			if lastModified != "" {
+				outReq.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+	}
+
+	requestTime := time.Now()
+	resp, err := t.next.RoundTrip(outReq)
+	if err != nil {
+		if body != nil {
+			body.Close()
+		}
+		return nil, err
+	}
+	if outReq != req && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		entry = t.store.Refresh(entry, resp, requestTime)
+		atomic.AddInt64(&t.store.revalidated, 1)
+		setStatus(state, StatusRevalidated)
+		return entry.response(req, body), nil
+	}
+	if body != nil {
+		body.Close()
+	}
+
+	atomic.AddInt64(&t.store.misses, 1)
+	setStatus(state, StatusMiss)
+	if storable(req, resp) && resp.ContentLength <= t.store.MaxObjectSize() {
+		t.storeBody(req, resp, requestTime)
+	}
+	return resp, nil
+}
+
+// storeBody copies resp's body to the store as the client reads it.
+func (t *Transport) storeBody(req *http.Request, resp *http.Response, requestTime time.Time) {
+	file, entry, err := t.store.Writer(req, resp, requestTime)
+	if err != nil {
+		logger.Warn("Failed to cache %s: %v", req.URL, err)
+		return
+	}
+	resp.Body = &cachingBody{
+		ReadCloser: resp.Body,
+		store:      t.store,
+		entry:      entry,
+		file:       file,
+		expected:   resp.ContentLength,
+	}
+}
+
+func setStatus(state *proxy.RequestState, status string) {
+	if state != nil {
+		state.CacheStatus = status
+	}
+}
+
+func unsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
+
+func conditional(req *http.Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
+
+// response builds the reply to req from the entry, answering a matching
+// If-None-Match with 304.
+func (e *Entry) response(req *http.Request, body *os.File) *http.Response {
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.Header.Clone(),
+		Body:          body,
+		ContentLength: e.Size,
+		Request:       req,
+	}
+	resp.Header.Set("Age", strconv.FormatInt(int64(e.currentAge(time.Now())/time.Second), 10))
+
+	if etag := e.Header.Get("ETag"); etag != "" && matchETag(req.Header.Get("If-None-Match"), etag) {
+		body.Close()
+		resp.Status = "304 Not Modified"
+		resp.StatusCode = http.StatusNotModified
+		resp.Body = http.NoBody
+		resp.ContentLength = 0
+		resp.Header.Del("Content-Length")
+	}
+	return resp
+}
+
+// matchETag applies the weak comparison If-None-Match uses.
+func matchETag(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func gatewayTimeout(req *http.Request) *http.Response {
+	body := "Not in cache\n"
+	return &http.Response{
+		Status:        "504 Gateway Timeout",
+		StatusCode:    http.StatusGatewayTimeout,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// cachingBody writes the body to the store while the client reads it. The
+// entry is committed only when the whole body arrived.
+type cachingBody struct {
+	io.ReadCloser
+	store    *Store
+	entry    *Entry
+	file     *os.File
+	expected int64
+	n        int64
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.file == nil {
+		return n, err
+	}
+
+	if n > 0 {
+		if b.n+int64(n) > b.store.MaxObjectSize() {
+			b.abort()
+			return n, err
+		}
+		if _, werr := b.file.Write(p[:n]); werr != nil {
+			logger.Warn("Failed to cache %s: %v", b.entry.URL, werr)
+			b.abort()
+			return n, err
+		}
+		b.n += int64(n)
+	}
+	if err == io.EOF {
+		if b.expected >= 0 && b.n != b.expected {
+			b.abort()
+			return n, err
+		}
+		if cerr := b.store.Commit(b.entry, b.file, b.n); cerr != nil {
+			logger.Warn("Failed to cache %s: %v", b.entry.URL, cerr)
+		}
+		b.file = nil
+	}
+	return n, err
+}
+
+func (b *cachingBody) Close() error {
+	if b.file != nil {
+		b.abort()
+	}
+	return b.ReadCloser.Close()
+}
+
+func (b *cachingBody) abort() {
+	b.file.Close()
+	os.Remove(b.file.Name())
+	b.file = nil
+}
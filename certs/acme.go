@@ -0,0 +1,146 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/config"
+	"github.com/zulkan/zulgoproxy/logger"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEManager obtains and renews the listener certificate from an ACME
+// directory. Certificates and the account key are kept in a cache directory.
+type ACMEManager struct {
+	manager *autocert.Manager
+	domains []string
+}
+
+func NewACMEManager(cfg config.ACMEConfig) (*ACMEManager, error) {
+	if len(cfg.Domains) == 0 {
+		return nil, errors.New("ACME needs at least one domain")
+	}
+
+	httpClient := http.DefaultClient
+	if cfg.DirectoryCAFile != "" {
+		roots, err := loadRoots(cfg.DirectoryCAFile)
+		if err != nil {
+			return nil, err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		httpClient = &http.Client{Transport: transport}
+	}
+
+	return &ACMEManager{
+		manager: &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cfg.CacheDir),
+			HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+			Email:      cfg.Email,
+			Client: &acme.Client{
+				DirectoryURL: cfg.DirectoryURL,
+				HTTPClient:   httpClient,
+			},
+		},
+		domains: cfg.Domains,
+	}, nil
+}
+
+func loadRoots(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ACME directory CA: %w", err)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return roots, nil
+}
+
+// Obtain requests certificates for every domain that has none yet, so the
+// first client does not wait for issuance. autocert renews them afterwards.
+func (m *ACMEManager) Obtain() {
+	for _, domain := range m.domains {
+		hello := &tls.ClientHelloInfo{
+			ServerName:   domain,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		}
+		if _, err := m.manager.GetCertificate(hello); err != nil {
+			logger.Error("Failed to obtain ACME certificate for %s: %v", domain, err)
+			continue
+		}
+		logger.Info("ACME certificate for %s is ready", domain)
+	}
+}
+
+// HTTPHandler answers http-01 challenges and redirects everything else to
+// HTTPS.
+func (m *ACMEManager) HTTPHandler() http.Handler {
+	return m.manager.HTTPHandler(nil)
+}
+
+// TLSConfig returns a server config that also answers tls-alpn-01 challenges.
+func (m *ACMEManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.manager.GetCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+	}
+}
+
+// Status reports the cached certificate of each domain.
+func (m *ACMEManager) Status() []CertificateStatus {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	statuses := make([]CertificateStatus, 0, len(m.domains))
+	for _, domain := range m.domains {
+		status := CertificateStatus{Name: domain}
+		// autocert caches ECDSA certificates under the domain and RSA ones
+		// under domain+"+rsa"
+		for _, key := range []string{domain, domain + "+rsa"} {
+			data, err := m.manager.Cache.Get(ctx, key)
+			if err != nil {
+				continue
+			}
+			if leaf := parseCachedLeaf(data); leaf != nil {
+				status.set(leaf)
+				break
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// parseCachedLeaf returns the first certificate of an autocert cache entry,
+// which holds the private key followed by the chain.
+func parseCachedLeaf(data []byte) *x509.Certificate {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		if block.Type == "CERTIFICATE" {
+			leaf, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil
+			}
+			return leaf
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zulkan/zulgoproxy/certs/acmetest"
+	"github.com/zulkan/zulgoproxy/config"
+)
+
+const acmeDomain = "proxy.example.test"
+
+func newACMEConfig(t *testing.T, directory *acmetest.Directory) config.ACMEConfig {
+	t.Helper()
+	caFile := filepath.Join(t.TempDir(), "directory-ca.pem")
+	if err := os.WriteFile(caFile, directory.ServerCertPEM(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return config.ACMEConfig{
+		Enabled:         true,
+		DirectoryURL:    directory.DirectoryURL(),
+		DirectoryCAFile: caFile,
+		Email:           "admin@example.test",
+		Domains:         []string{acmeDomain},
+		CacheDir:        t.TempDir(),
+	}
+}
+
+func servedLeaf(t *testing.T, m *ACMEManager) *x509.Certificate {
+	t.Helper()
+	cert, err := m.TLSConfig().GetCertificate(&tls.ClientHelloInfo{
+		ServerName:   acmeDomain,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+func TestACMEIssuesAndPersists(t *testing.T) {
+	directory := acmetest.NewDirectory()
+	defer directory.Close()
+	cfg := newACMEConfig(t, directory)
+
+	m, err := NewACMEManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := m.Status(); len(status) != 1 || status[0].Issued {
+		t.Fatalf("status before issuance = %+v, want one domain not issued", status)
+	}
+
+	m.Obtain()
+	if directory.Orders() != 1 {
+		t.Fatalf("placed %d orders, want 1", directory.Orders())
+	}
+
+	data, err := os.ReadFile(filepath.Join(cfg.CacheDir, acmeDomain))
+	if err != nil {
+		t.Fatalf("certificate not persisted: %v", err)
+	}
+	stored := parseCachedLeaf(data)
+	if stored == nil || stored.VerifyHostname(acmeDomain) != nil || stored.Issuer.CommonName != acmetest.IssuerName {
+		t.Fatalf("cached certificate = %v, want one for %s from the directory", stored, acmeDomain)
+	}
+	if leaf := servedLeaf(t, m); leaf.SerialNumber.Cmp(stored.SerialNumber) != 0 {
+		t.Errorf("served serial %v, cached %v", leaf.SerialNumber, stored.SerialNumber)
+	}
+
+	status := m.Status()[0]
+	if !status.Issued || status.Issuer != acmetest.IssuerName || status.Expired {
+		t.Errorf("status = %+v, want issued by %s and not expired", status, acmetest.IssuerName)
+	}
+	if status.NotAfter == nil || !status.NotAfter.Equal(stored.NotAfter) || status.DaysLeft != 89 {
+		t.Errorf("status expiry = %v (%d days left), want %v (89)", status.NotAfter, status.DaysLeft, stored.NotAfter)
+	}
+}
+
+func TestACMEReloadsFromCache(t *testing.T) {
+	directory := acmetest.NewDirectory()
+	defer directory.Close()
+	cfg := newACMEConfig(t, directory)
+
+	first, err := NewACMEManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Obtain()
+	issued := servedLeaf(t, first)
+
+	// A restart reads the certificate and account key from the cache dir
+	restarted, err := NewACMEManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := restarted.Status()[0]; !status.Issued || !status.NotAfter.Equal(issued.NotAfter) {
+		t.Errorf("status after restart = %+v, want the cached certificate", status)
+	}
+	restarted.Obtain()
+	if leaf := servedLeaf(t, restarted); leaf.SerialNumber.Cmp(issued.SerialNumber) != 0 {
+		t.Errorf("served serial %v after restart, want the cached %v", leaf.SerialNumber, issued.SerialNumber)
+	}
+	if directory.Orders() != 1 {
+		t.Errorf("placed %d orders, want the cached certificate reused", directory.Orders())
+	}
+}
@@ -0,0 +1,354 @@
+// Package acmetest provides an RFC 8555 ACME directory for tests. It marks an
+// authorization valid as soon as any of its challenges is accepted, without
+// validating it, and signs certificates with its own CA.
+package acmetest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IssuerName is the common name of the CA signing the issued certificates.
+const IssuerName = "acmetest CA"
+
+// Directory is an ACME server listening on a local TLS port.
+type Directory struct {
+	*httptest.Server
+	// Validity of the certificates issued, 90 days unless changed before
+	// the first order.
+	Validity time.Duration
+
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+
+	mutex  sync.Mutex
+	nonce  int
+	orders []*order
+	authzs []*authz
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	identifiers []identifier
+	authzs      []*authz
+	cert        []byte // PEM chain, once finalized
+}
+
+type authz struct {
+	identifier identifier
+	status     string
+}
+
+// NewDirectory starts a directory. Its URL is d.URL + "/directory" and its TLS
+// certificate is returned by ServerCertPEM.
+func NewDirectory() *Directory {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: IssuerName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		panic(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+
+	d := &Directory{
+		Validity: 90 * 24 * time.Hour,
+		caCert:   caCert,
+		caKey:    caKey,
+	}
+	d.Server = httptest.NewTLSServer(http.HandlerFunc(d.serveHTTP))
+	return d
+}
+
+// DirectoryURL returns the URL ACME clients are configured with.
+func (d *Directory) DirectoryURL() string {
+	return d.URL + "/directory"
+}
+
+// ServerCertPEM returns the certificate clients must trust to reach the
+// directory.
+func (d *Directory) ServerCertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: d.Certificate().Raw})
+}
+
+// Orders returns the number of orders placed so far.
+func (d *Directory) Orders() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.orders)
+}
+
+func (d *Directory) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.nonce++
+	w.Header().Set("Replay-Nonce", strconv.Itoa(d.nonce))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if req.URL.Path == "/directory" {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   d.URL + "/nonce",
+			"newAccount": d.URL + "/account",
+			"newOrder":   d.URL + "/order",
+			"revokeCert": d.URL + "/revoke",
+			"keyChange":  d.URL + "/key-change",
+		})
+		return
+	}
+	if req.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if req.Method != http.MethodPost {
+		problem(w, http.StatusMethodNotAllowed, "malformed", "ACME resources only accept POST")
+		return
+	}
+
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&jws); err != nil {
+		problem(w, http.StatusBadRequest, "malformed", "request is not a JWS")
+		return
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		problem(w, http.StatusBadRequest, "malformed", "payload is not base64url")
+		return
+	}
+
+	resource, index := splitPath(req.URL.Path)
+	switch {
+	case resource == "account":
+		w.Header().Set("Location", d.URL+"/account/1")
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case resource == "order" && index < 0:
+		d.newOrder(w, payload)
+	case resource == "order" && index < len(d.orders):
+		d.writeOrder(w, http.StatusOK, index)
+	case resource == "authz" && index < len(d.authzs):
+		// autocert deactivates the authorizations it did not need
+		var update struct {
+			Status string `json:"status"`
+		}
+		if json.Unmarshal(payload, &update) == nil && update.Status == "deactivated" {
+			d.authzs[index].status = update.Status
+		}
+		d.writeAuthz(w, index)
+	case resource == "challenge" && index < len(d.authzs):
+		d.authzs[index].status = "valid"
+		writeJSON(w, http.StatusOK, d.challenges(index)[0])
+	case resource == "finalize" && index < len(d.orders):
+		d.finalize(w, index, payload)
+	case resource == "cert" && index < len(d.orders) && d.orders[index].cert != nil:
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(d.orders[index].cert)
+	default:
+		problem(w, http.StatusNotFound, "malformed", "no such resource")
+	}
+}
+
+// splitPath splits /resource/index, returning -1 without an index.
+func splitPath(path string) (string, int) {
+	resource, rest, found := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !found {
+		return resource, -1
+	}
+	index, err := strconv.Atoi(rest)
+	if err != nil || index < 0 {
+		return "", -1
+	}
+	return resource, index
+}
+
+func (d *Directory) newOrder(w http.ResponseWriter, payload []byte) {
+	var req struct {
+		Identifiers []identifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil || len(req.Identifiers) == 0 {
+		problem(w, http.StatusBadRequest, "malformed", "order has no identifiers")
+		return
+	}
+
+	o := &order{identifiers: req.Identifiers}
+	for _, id := range req.Identifiers {
+		z := &authz{identifier: id, status: "pending"}
+		o.authzs = append(o.authzs, z)
+		d.authzs = append(d.authzs, z)
+	}
+	d.orders = append(d.orders, o)
+	d.writeOrder(w, http.StatusCreated, len(d.orders)-1)
+}
+
+func (d *Directory) writeOrder(w http.ResponseWriter, code, index int) {
+	o := d.orders[index]
+	status := "ready"
+	var authzURLs []string
+	for _, z := range o.authzs {
+		authzURLs = append(authzURLs, fmt.Sprintf("%s/authz/%d", d.URL, d.authzIndex(z)))
+		if z.status != "valid" {
+			status = "pending"
+		}
+	}
+	body := map[string]interface{}{
+		"identifiers":    o.identifiers,
+		"authorizations": authzURLs,
+		"finalize":       fmt.Sprintf("%s/finalize/%d", d.URL, index),
+	}
+	if o.cert != nil {
+		status = "valid"
+		body["certificate"] = fmt.Sprintf("%s/cert/%d", d.URL, index)
+	}
+	body["status"] = status
+
+	w.Header().Set("Location", fmt.Sprintf("%s/order/%d", d.URL, index))
+	writeJSON(w, code, body)
+}
+
+func (d *Directory) authzIndex(z *authz) int {
+	for i, candidate := range d.authzs {
+		if candidate == z {
+			return i
+		}
+	}
+	return -1
+}
+
+func (d *Directory) writeAuthz(w http.ResponseWriter, index int) {
+	z := d.authzs[index]
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"identifier": z.identifier,
+		"status":     z.status,
+		"challenges": d.challenges(index),
+	})
+}
+
+func (d *Directory) challenges(index int) []map[string]string {
+	status := d.authzs[index].status
+	var challenges []map[string]string
+	for _, typ := range []string{"tls-alpn-01", "http-01"} {
+		challenges = append(challenges, map[string]string{
+			"type":   typ,
+			"url":    fmt.Sprintf("%s/challenge/%d", d.URL, index),
+			"token":  fmt.Sprintf("token-%d", index),
+			"status": status,
+		})
+	}
+	return challenges
+}
+
+func (d *Directory) finalize(w http.ResponseWriter, index int, payload []byte) {
+	o := d.orders[index]
+	for _, z := range o.authzs {
+		if z.status != "valid" {
+			problem(w, http.StatusForbidden, "orderNotReady", "order is not authorized")
+			return
+		}
+	}
+
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		problem(w, http.StatusBadRequest, "malformed", "finalize needs a CSR")
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		problem(w, http.StatusBadRequest, "badCSR", "CSR is not base64url")
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		problem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+	if !sameNames(csr.DNSNames, o.identifiers) {
+		problem(w, http.StatusBadRequest, "badCSR", "CSR names do not match the order")
+		return
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(index) + 2),
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(d.Validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, d.caCert, csr.PublicKey, d.caKey)
+	if err != nil {
+		problem(w, http.StatusInternalServerError, "serverInternal", err.Error())
+		return
+	}
+	o.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: d.caCert.Raw})...)
+	d.writeOrder(w, http.StatusOK, index)
+}
+
+func sameNames(names []string, identifiers []identifier) bool {
+	if len(names) != len(identifiers) {
+		return false
+	}
+	for _, id := range identifiers {
+		found := false
+		for _, name := range names {
+			found = found || strings.EqualFold(name, id.Value)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func problem(w http.ResponseWriter, code int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{
+		"type":   "urn:ietf:params:acme:error:" + typ,
+		"detail": detail,
+	})
+}
@@ -0,0 +1,278 @@
+package certs
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/logger"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 397 * 24 * time.Hour // browsers reject longer-lived leaves
+	leafRenewal  = 24 * time.Hour
+	// Leaves kept in memory; the least recently used is dropped beyond it
+	maxLeaves = 4096
+)
+
+// Authority is the root CA used for TLS interception. It signs leaf
+// certificates on demand and caches them per hostname.
+type Authority struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	leaves  map[string]*list.Element // of *cachedLeaf
+	lru     *list.List               // most recently used first
+	mutex   sync.Mutex
+}
+
+type cachedLeaf struct {
+	host string
+	cert *tls.Certificate
+}
+
+// LoadOrCreateAuthority loads the CA from certFile and keyFile, generating and
+// persisting a new one the first time.
+func LoadOrCreateAuthority(certFile, keyFile string) (*Authority, error) {
+	certPEM, certErr := os.ReadFile(certFile)
+	keyPEM, keyErr := os.ReadFile(keyFile)
+
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		logger.Info("No interception CA found, generating %s", certFile)
+		var err error
+		if certPEM, keyPEM, err = generateCA(); err != nil {
+			return nil, fmt.Errorf("failed to generate CA: %w", err)
+		}
+		if err := writeFile(certFile, certPEM, 0644); err != nil {
+			return nil, err
+		}
+		if err := writeFile(keyFile, keyPEM, 0600); err != nil {
+			return nil, err
+		}
+	} else if certErr != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", certErr)
+	} else if keyErr != nil {
+		return nil, fmt.Errorf("failed to read CA key: %w", keyErr)
+	}
+
+	return parseAuthority(certPEM, keyPEM)
+}
+
+func parseAuthority(certPEM, keyPEM []byte) (*Authority, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, errors.New("invalid CA certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, errors.New("invalid CA key PEM")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA key: %w", err)
+	}
+
+	return &Authority{
+		cert:    cert,
+		key:     key,
+		certPEM: certPEM,
+		leaves:  make(map[string]*list.Element),
+		lru:     list.New(),
+	}, nil
+}
+
+func generateCA() (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject: pkix.Name{
+			CommonName:   "ZulgoProxy Interception CA",
+			Organization: []string{"ZulgoProxy"},
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// CertificatePEM returns the CA certificate for installation on clients.
+func (a *Authority) CertificatePEM() []byte {
+	return a.certPEM
+}
+
+// Certificate returns the parsed CA certificate.
+func (a *Authority) Certificate() *x509.Certificate {
+	return a.cert
+}
+
+// Leaf returns a certificate for host signed by the CA, reusing a cached one
+// until it is close to expiry.
+func (a *Authority) Leaf(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if elem, exists := a.leaves[host]; exists {
+		cached := elem.Value.(*cachedLeaf)
+		if !expiring(cached.cert) {
+			a.lru.MoveToFront(elem)
+			return cached.cert, nil
+		}
+		a.removeLeaf(elem)
+	}
+
+	leaf, err := a.sign(host)
+	if err != nil {
+		return nil, err
+	}
+	if a.lru.Len() >= maxLeaves {
+		a.evictLeaves()
+	}
+	a.leaves[host] = a.lru.PushFront(&cachedLeaf{host: host, cert: leaf})
+	return leaf, nil
+}
+
+// evictLeaves drops the leaves close to expiry, then the least recently used
+// ones until there is room for another.
+func (a *Authority) evictLeaves() {
+	for elem := a.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if expiring(elem.Value.(*cachedLeaf).cert) {
+			a.removeLeaf(elem)
+		}
+		elem = next
+	}
+	for a.lru.Len() >= maxLeaves {
+		a.removeLeaf(a.lru.Back())
+	}
+}
+
+func (a *Authority) removeLeaf(elem *list.Element) {
+	delete(a.leaves, elem.Value.(*cachedLeaf).host)
+	a.lru.Remove(elem)
+}
+
+func expiring(leaf *tls.Certificate) bool {
+	return time.Until(leaf.Leaf.NotAfter) <= leafRenewal
+}
+
+func (a *Authority) sign(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject: pkix.Name{
+			CommonName:   host,
+			Organization: []string{"ZulgoProxy"},
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(leafValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate for %s: %w", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, a.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// TLSConfig returns the client-facing config for an intercepted tunnel to
+// host. Certificates are only ever signed for host, the CONNECT target the
+// proxy authorized; a handshake naming another server in its SNI fails, as
+// the client could otherwise obtain a trusted certificate for any name.
+func (a *Authority) TLSConfig(host string) *tls.Config {
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" && !strings.EqualFold(strings.TrimSuffix(hello.ServerName, "."), name) {
+				return nil, fmt.Errorf("SNI %q does not match the tunnel to %s", hello.ServerName, name)
+			}
+			return a.Leaf(name)
+		},
+	}
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
+
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, data, perm); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
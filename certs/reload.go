@@ -0,0 +1,140 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/logger"
+)
+
+const reloadInterval = 30 * time.Second
+
+// KeyPair serves a certificate and key from disk, reloading them when either
+// file changes so renewed certificates are picked up without a restart.
+type KeyPair struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+	mutex    sync.RWMutex
+}
+
+// LoadKeyPair loads certFile and keyFile and watches them for changes.
+func LoadKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	kp := &KeyPair{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := kp.load(); err != nil {
+		return nil, err
+	}
+
+	go kp.watch()
+
+	return kp, nil
+}
+
+func (kp *KeyPair) load() error {
+	modTime, err := kp.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(kp.certFile, kp.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("failed to parse TLS certificate: %w", err)
+		}
+	}
+
+	kp.mutex.Lock()
+	kp.cert = &cert
+	kp.modTime = modTime
+	kp.mutex.Unlock()
+	return nil
+}
+
+func (kp *KeyPair) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{kp.certFile, kp.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat %s: %w", file, err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (kp *KeyPair) watch() {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		modTime, err := kp.latestModTime()
+		if err != nil {
+			logger.Warn("TLS certificate check failed: %v", err)
+			continue
+		}
+
+		kp.mutex.RLock()
+		changed := modTime.After(kp.modTime)
+		kp.mutex.RUnlock()
+		if !changed {
+			continue
+		}
+
+		// A half-written pair fails to load; the old one stays in use and
+		// the next tick tries again
+		if err := kp.load(); err != nil {
+			logger.Error("TLS certificate reload failed, keeping the current one: %v", err)
+			continue
+		}
+		logger.Info("Reloaded TLS certificate %s (expires %s)", kp.certFile, kp.NotAfter().Format(time.RFC3339))
+	}
+}
+
+// GetCertificate is used as tls.Config.GetCertificate.
+func (kp *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	kp.mutex.RLock()
+	defer kp.mutex.RUnlock()
+	return kp.cert, nil
+}
+
+// NotAfter returns the expiry of the current certificate.
+func (kp *KeyPair) NotAfter() time.Time {
+	kp.mutex.RLock()
+	defer kp.mutex.RUnlock()
+	return kp.cert.Leaf.NotAfter
+}
+
+// Status reports the current certificate.
+func (kp *KeyPair) Status() []CertificateStatus {
+	kp.mutex.RLock()
+	leaf := kp.cert.Leaf
+	kp.mutex.RUnlock()
+
+	status := CertificateStatus{Name: leaf.Subject.CommonName}
+	if status.Name == "" {
+		status.Name = kp.certFile
+	}
+	status.set(leaf)
+	return []CertificateStatus{status}
+}
+
+// TLSConfig returns a server config serving the current certificate.
+func (kp *KeyPair) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: kp.GetCertificate,
+	}
+}
@@ -0,0 +1,33 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+)
+
+// ServerCertificates supplies the certificate of the proxy and API listeners,
+// either from files on disk or from an ACME directory.
+type ServerCertificates interface {
+	TLSConfig() *tls.Config
+	Status() []CertificateStatus
+}
+
+// CertificateStatus describes a listener certificate for the admin API.
+type CertificateStatus struct {
+	Name     string     `json:"name"`
+	Issued   bool       `json:"issued"`
+	Issuer   string     `json:"issuer,omitempty"`
+	NotAfter *time.Time `json:"not_after,omitempty"`
+	DaysLeft int        `json:"days_left"`
+	Expired  bool       `json:"expired"`
+}
+
+func (s *CertificateStatus) set(leaf *x509.Certificate) {
+	notAfter := leaf.NotAfter
+	s.Issued = true
+	s.Issuer = leaf.Issuer.CommonName
+	s.NotAfter = &notAfter
+	s.DaysLeft = int(time.Until(notAfter).Hours() / 24)
+	s.Expired = time.Now().After(notAfter)
+}
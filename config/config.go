@@ -11,6 +11,14 @@ type Config struct {
 	Database DatabaseConfig `yaml:"database"`
 	Server   ServerConfig   `yaml:"server"`
 	Auth     AuthConfig     `yaml:"auth"`
+	MITM     MITMConfig     `yaml:"mitm"`
+	Upstream UpstreamConfig `yaml:"upstream"`
+	ACME     ACMEConfig     `yaml:"acme"`
+	SSRF     SSRFConfig     `yaml:"ssrf"`
+	PAC      PACConfig      `yaml:"pac"`
+	Cache    CacheConfig    `yaml:"cache"`
+	DNS      DNSConfig      `yaml:"dns"`
+	Egress   EgressConfig   `yaml:"egress"`
 }
 
 type DatabaseConfig struct {
@@ -29,12 +37,157 @@ type ServerConfig struct {
 	EnableHTTPS  bool     `yaml:"enable_https"`
 	CertFile     string   `yaml:"cert_file"`
 	KeyFile      string   `yaml:"key_file"`
+	SOCKSPort    int      `yaml:"socks_port"` // 0 disables the SOCKS5 listener
+	SOCKSUDP     bool     `yaml:"socks_udp"`  // allow UDP ASSOCIATE
+	ConnectPorts []int    `yaml:"connect_ports"` // ports HTTP CONNECT may reach; empty allows any
+	SOCKSPorts   []int    `yaml:"socks_ports"`   // ports SOCKS5 may reach; empty allows any
+	// Listener for redirected traffic; 0 disables it
+	TransparentPort int `yaml:"transparent_port"`
+	// Port of redirected TLS whose original destination port is unknown
+	TransparentTLSPort int `yaml:"transparent_tls_port"`
+	// Concurrent connection caps; 0 means unlimited. A policy's
+	// max_connections overrides the per-user default.
+	MaxConnections        int `yaml:"max_connections"`
+	MaxConnectionsPerUser int `yaml:"max_connections_per_user"`
+	// Seconds without a frame in either direction before a WebSocket session
+	// is closed; 0 disables it. A policy's websocket_idle_timeout overrides it.
+	WebSocketIdleTimeout int `yaml:"websocket_idle_timeout"`
 }
 
 type AuthConfig struct {
 	JWTSecret     string `yaml:"jwt_secret"`
 	TokenExpiry   int    `yaml:"token_expiry"` // in hours
 	RefreshExpiry int    `yaml:"refresh_expiry"` // in hours
+	ProxyCacheTTL int    `yaml:"proxy_cache_ttl"` // in seconds
+}
+
+// MITMConfig controls opt-in TLS interception. Tunnels to a matching host, or
+// opened by one of the listed users, are decrypted with the managed root CA.
+type MITMConfig struct {
+	Enabled    bool     `yaml:"enabled"`
+	CACertFile string   `yaml:"ca_cert_file"`
+	CAKeyFile  string   `yaml:"ca_key_file"`
+	Hosts      []string `yaml:"hosts"` // exact or "*.example.com"
+	Users      []string `yaml:"users"` // usernames
+}
+
+// ACMEConfig obtains the listener certificate from an ACME directory instead
+// of CertFile/KeyFile when HTTPS is enabled.
+type ACMEConfig struct {
+	Enabled         bool     `yaml:"enabled"`
+	DirectoryURL    string   `yaml:"directory_url"`
+	DirectoryCAFile string   `yaml:"directory_ca_file"` // extra root, e.g. for a local test CA
+	Email           string   `yaml:"email"`
+	Domains         []string `yaml:"domains"`
+	CacheDir        string   `yaml:"cache_dir"` // certificates and account key
+	HTTPPort        int      `yaml:"http_port"` // serves http-01 challenges; 0 relies on tls-alpn-01
+}
+
+// SSRFConfig guards against proxying to internal destinations. Loopback,
+// link-local, private and the proxy's own addresses are always refused unless
+// listed in AllowedCIDRs.
+type SSRFConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	BlockedCIDRs []string `yaml:"blocked_cidrs"` // refused in addition to the internal ranges
+	AllowedCIDRs []string `yaml:"allowed_cidrs"` // exceptions, e.g. an internal service users may reach
+}
+
+// CacheConfig enables the shared response cache for plain HTTP and
+// intercepted requests.
+type CacheConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	Dir             string `yaml:"dir"`
+	MaxSizeMB       int64  `yaml:"max_size_mb"`        // least recently used entries are evicted beyond this
+	MaxObjectSizeMB int64  `yaml:"max_object_size_mb"` // larger responses are not stored
+}
+
+// DNSConfig controls how the proxy resolves the destinations it connects to
+// directly. DoH endpoints replace the plaintext servers, which are then only
+// asked after every endpoint failed, and only with PlaintextFallback. Without
+// either the system resolver is used; it does not report TTLs, so its answers
+// are cached for DefaultTTL.
+type DNSConfig struct {
+	Servers           []string    `yaml:"servers"`            // host or host:port, tried in order
+	DoH               []DoHServer `yaml:"doh"`                // DNS-over-HTTPS (RFC 8484) endpoints, tried in order
+	DoHCAFile         string      `yaml:"doh_ca_file"`        // extra roots trusted for the endpoints
+	PlaintextFallback bool        `yaml:"plaintext_fallback"` // ask Servers when no endpoint answers
+	Timeout           int         `yaml:"timeout"`            // per query, in seconds
+	CacheSize         int         `yaml:"cache_size"`         // cached names; 0 disables the cache
+	MinTTL            int         `yaml:"min_ttl"`            // in seconds
+	MaxTTL            int         `yaml:"max_ttl"`            // in seconds
+	NegativeTTL       int         `yaml:"negative_ttl"`       // names that do not exist, when the server gives no TTL
+	DefaultTTL        int         `yaml:"default_ttl"`        // system resolver answers
+}
+
+// DoHServer is a DNS-over-HTTPS endpoint. Unless its URL names an IP address,
+// Bootstrap gives the address of the URL's host, so that reaching the
+// endpoint does not take a plaintext lookup.
+type DoHServer struct {
+	URL       string `yaml:"url"`
+	Bootstrap string `yaml:"bootstrap"` // IP address; the certificate is still checked against the URL's host
+}
+
+// EgressConfig is the source address direct connections leave from when no
+// egress rule matches. Empty addresses leave the choice to the system.
+type EgressConfig struct {
+	SourceIPv4 string `yaml:"source_ipv4"`
+	SourceIPv6 string `yaml:"source_ipv6"`
+	Family     string `yaml:"family"` // prefer_ipv4 (default), prefer_ipv6, ipv4_only or ipv6_only
+}
+
+// PACConfig describes the proxy auto-config file served at /proxy.pac and
+// /wpad.dat. Destinations matching a bypass entry are reached directly.
+type PACConfig struct {
+	ProxyAddress  string     `yaml:"proxy_address"`  // host:port clients use; defaults to the API host and proxy port
+	BypassDomains []string   `yaml:"bypass_domains"` // exact or "*.example.com"
+	BypassCIDRs   []string   `yaml:"bypass_cidrs"`   // IPv4 networks
+	Groups        []PACGroup `yaml:"groups"`
+}
+
+// PACGroup is a variant of the PAC file with extra bypass entries, selected
+// with ?group=<name> or ?token=<token>.
+type PACGroup struct {
+	Name          string   `yaml:"name"`
+	Token         string   `yaml:"token"` // optional; when set, ?group= alone does not select the group
+	BypassDomains []string `yaml:"bypass_domains"`
+	BypassCIDRs   []string `yaml:"bypass_cidrs"`
+}
+
+// UpstreamConfig chains outbound traffic through other proxies. Routes are
+// checked in order; destinations matching none use Default.
+type UpstreamConfig struct {
+	Proxies []UpstreamProxy `yaml:"proxies"`
+	Pools   []UpstreamPool  `yaml:"pools"`
+	Routes  []UpstreamRoute `yaml:"routes"`
+	Default string          `yaml:"default"` // upstream or pool name, or "direct"
+}
+
+type UpstreamProxy struct {
+	Name     string `yaml:"name"`
+	URL      string `yaml:"url"` // http://, https:// or socks5://
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// UpstreamPool balances traffic across several upstream proxies.
+type UpstreamPool struct {
+	Name        string            `yaml:"name"`
+	Strategy    string            `yaml:"strategy"` // round_robin, least_connections or consistent_hash
+	Members     []string          `yaml:"members"`  // upstream proxy names
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
+}
+
+// HealthCheckConfig tunes the active TCP probes of a pool's members.
+type HealthCheckConfig struct {
+	Interval  int `yaml:"interval"`  // in seconds
+	Timeout   int `yaml:"timeout"`   // in seconds
+	Failures  int `yaml:"failures"`  // consecutive failures before ejecting
+	Successes int `yaml:"successes"` // consecutive successes before restoring
+}
+
+type UpstreamRoute struct {
+	Hosts    []string `yaml:"hosts"`    // exact or "*.example.com"
+	Upstream string   `yaml:"upstream"` // upstream or pool name, or "direct"
 }
 
 func LoadConfig(configPath string) (*Config, error) {
@@ -43,9 +196,27 @@ func LoadConfig(configPath string) (*Config, error) {
 	// Set defaults
 	config.Server.Port = 8181
 	config.Server.LogLevel = "info"
+	config.Server.ConnectPorts = []int{443}
+	config.Server.WebSocketIdleTimeout = 300
+	config.Server.TransparentTLSPort = 443
 	config.Auth.TokenExpiry = 24
 	config.Auth.RefreshExpiry = 168 // 7 days
+	config.Auth.ProxyCacheTTL = 60
 	config.Database.SSLMode = "disable"
+	config.MITM.CACertFile = "data/mitm-ca.pem"
+	config.MITM.CAKeyFile = "data/mitm-ca-key.pem"
+	config.Upstream.Default = "direct"
+	config.ACME.DirectoryURL = "https://acme-v02.api.letsencrypt.org/directory"
+	config.ACME.CacheDir = "data/acme"
+	config.SSRF.Enabled = true
+	config.Cache.Dir = "data/cache"
+	config.Cache.MaxSizeMB = 1024
+	config.Cache.MaxObjectSizeMB = 100
+	config.DNS.Timeout = 5
+	config.DNS.CacheSize = 10000
+	config.DNS.MaxTTL = 3600
+	config.DNS.NegativeTTL = 30
+	config.DNS.DefaultTTL = 60
 	
 	if configPath == "" {
 		configPath = "config.yaml"
@@ -45,7 +45,7 @@ func InitDatabase(cfg *config.Config) error {
 	sqlDB.SetConnMaxLifetime(5 * time.Minute)
 	
 	// Auto-migrate the schema
-	err = DB.AutoMigrate(&models.User{}, &models.Session{}, &models.ProxyLog{})
+	err = DB.AutoMigrate(&models.User{}, &models.Session{}, &models.ProxyLog{}, &models.Rule{}, &models.Policy{}, &models.Usage{}, &models.HeaderRule{}, &models.ErrorPage{}, &models.HostOverride{}, &models.EgressRule{})
 	if err != nil {
 		return fmt.Errorf("failed to migrate database: %w", err)
 	}
@@ -4,14 +4,17 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/zulkan/zulgoproxy/certs"
 	"github.com/zulkan/zulgoproxy/database"
 	"github.com/zulkan/zulgoproxy/models"
 )
 
-type AdminHandler struct{}
+type AdminHandler struct {
+	serverCerts certs.ServerCertificates
+}
 
-func NewAdminHandler() *AdminHandler {
-	return &AdminHandler{}
+func NewAdminHandler(serverCerts certs.ServerCertificates) *AdminHandler {
+	return &AdminHandler{serverCerts: serverCerts}
 }
 
 type DashboardStats struct {
@@ -65,12 +68,19 @@ func (h *AdminHandler) GetSystemInfo(c *gin.Context) {
 		ORDER BY pg_total_relation_size(schemaname||'.'||tablename) DESC
 	`).Scan(&tableSizes)
 	
+	// Listener certificates and their expiry
+	tlsInfo := gin.H{"enabled": h.serverCerts != nil}
+	if h.serverCerts != nil {
+		tlsInfo["certificates"] = h.serverCerts.Status()
+	}
+	
 	c.JSON(http.StatusOK, gin.H{
 		"database": gin.H{
 			"version":     dbVersion,
 			"size":        dbSize,
 			"table_sizes": tableSizes,
 		},
+		"tls": tlsInfo,
 	})
 }
 
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zulkan/zulgoproxy/certs"
+	"github.com/zulkan/zulgoproxy/certs/acmetest"
+	"github.com/zulkan/zulgoproxy/config"
+	"github.com/zulkan/zulgoproxy/database"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// useDryRunDB points the handlers at a database that runs no queries.
+func useDryRunDB(t *testing.T) {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=127.0.0.1 port=1"}), &gorm.Config{
+		DryRun:               true,
+		DisableAutomaticPing: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = previous })
+}
+
+func TestSystemInfoReportsACMEExpiry(t *testing.T) {
+	useDryRunDB(t)
+	directory := acmetest.NewDirectory()
+	defer directory.Close()
+
+	caFile := filepath.Join(t.TempDir(), "directory-ca.pem")
+	if err := os.WriteFile(caFile, directory.ServerCertPEM(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	acmeCerts, err := certs.NewACMEManager(config.ACMEConfig{
+		Enabled:         true,
+		DirectoryURL:    directory.DirectoryURL(),
+		DirectoryCAFile: caFile,
+		Domains:         []string{"proxy.example.test"},
+		CacheDir:        t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acmeCerts.Obtain()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/admin/system", NewAdminHandler(acmeCerts).GetSystemInfo)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/admin/system", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", recorder.Code, recorder.Body)
+	}
+
+	var body struct {
+		TLS struct {
+			Enabled      bool                      `json:"enabled"`
+			Certificates []certs.CertificateStatus `json:"certificates"`
+		} `json:"tls"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if !body.TLS.Enabled || len(body.TLS.Certificates) != 1 {
+		t.Fatalf("tls = %+v, want one certificate", body.TLS)
+	}
+	status := body.TLS.Certificates[0]
+	if status.Name != "proxy.example.test" || !status.Issued || status.Issuer != acmetest.IssuerName || status.Expired {
+		t.Errorf("certificate = %+v, want proxy.example.test issued by %s", status, acmetest.IssuerName)
+	}
+	if status.NotAfter == nil || time.Until(*status.NotAfter) < 89*24*time.Hour || status.DaysLeft != 89 {
+		t.Errorf("certificate expiry = %v (%d days left), want 90 days out", status.NotAfter, status.DaysLeft)
+	}
+}
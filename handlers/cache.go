@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zulkan/zulgoproxy/cache"
+	"github.com/zulkan/zulgoproxy/logger"
+)
+
+type CacheHandler struct {
+	store *cache.Store
+}
+
+func NewCacheHandler(store *cache.Store) *CacheHandler {
+	return &CacheHandler{store: store}
+}
+
+func (h *CacheHandler) GetStats(c *gin.Context) {
+	if h.store == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Response cache is not enabled"})
+		return
+	}
+	c.JSON(http.StatusOK, h.store.Stats())
+}
+
+// Purge removes entries whose URL matches the pattern query parameter, where
+// "*" matches anything.
+func (h *CacheHandler) Purge(c *gin.Context) {
+	if h.store == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Response cache is not enabled"})
+		return
+	}
+	pattern := c.Query("pattern")
+	if pattern == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pattern is required, e.g. http://example.com/* or *"})
+		return
+	}
+
+	purged := h.store.Purge(pattern)
+	logger.Info("Purged %d cached responses matching %s", purged, pattern)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Cache purged",
+		"purged":  purged,
+	})
+}
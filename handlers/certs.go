@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zulkan/zulgoproxy/certs"
+)
+
+type CertificateHandler struct {
+	authority *certs.Authority
+}
+
+func NewCertificateHandler(authority *certs.Authority) *CertificateHandler {
+	return &CertificateHandler{authority: authority}
+}
+
+func (h *CertificateHandler) DownloadCA(c *gin.Context) {
+	if h.authority == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "TLS interception is not enabled"})
+		return
+	}
+	
+	c.Header("Content-Disposition", `attachment; filename="zulgoproxy-ca.pem"`)
+	c.Data(http.StatusOK, "application/x-pem-file", h.authority.CertificatePEM())
+}
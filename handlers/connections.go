@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/proxy"
+)
+
+type ConnectionHandler struct {
+	registry *proxy.ConnectionRegistry
+}
+
+func NewConnectionHandler(registry *proxy.ConnectionRegistry) *ConnectionHandler {
+	return &ConnectionHandler{registry: registry}
+}
+
+func (h *ConnectionHandler) GetConnections(c *gin.Context) {
+	connections := h.registry.List()
+	c.JSON(http.StatusOK, gin.H{
+		"connections": connections,
+		"total":       len(connections),
+	})
+}
+
+func (h *ConnectionHandler) CloseConnection(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid connection ID"})
+		return
+	}
+
+	if !h.registry.Kill(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Connection not found"})
+		return
+	}
+
+	logger.Info("Connection %d closed by admin", id)
+	c.JSON(http.StatusOK, gin.H{"message": "Connection closed"})
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/resolver"
+)
+
+type DNSHandler struct {
+	resolver *resolver.Resolver
+}
+
+func NewDNSHandler(res *resolver.Resolver) *DNSHandler {
+	return &DNSHandler{resolver: res}
+}
+
+func (h *DNSHandler) GetStats(c *gin.Context) {
+	c.JSON(http.StatusOK, h.resolver.Stats())
+}
+
+// Lookup resolves the host query parameter the way the proxy would and
+// reports how long it took.
+func (h *DNSHandler) Lookup(c *gin.Context) {
+	host := c.Query("host")
+	if host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "host is required"})
+		return
+	}
+
+	start := time.Now()
+	ips, err := h.resolver.LookupIP(c.Request.Context(), host)
+	elapsed := time.Since(start)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"host":        host,
+			"error":       err.Error(),
+			"duration_ms": elapsed.Milliseconds(),
+		})
+		return
+	}
+
+	addresses := make([]string, len(ips))
+	for i, ip := range ips {
+		addresses[i] = ip.String()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"host":        host,
+		"addresses":   addresses,
+		"duration_ms": elapsed.Milliseconds(),
+	})
+}
+
+func (h *DNSHandler) FlushCache(c *gin.Context) {
+	flushed := h.resolver.Flush()
+	logger.Info("Flushed %d cached DNS answers", flushed)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "DNS cache flushed",
+		"flushed": flushed,
+	})
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zulkan/zulgoproxy/database"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+	"github.com/zulkan/zulgoproxy/proxy"
+)
+
+type EgressRuleHandler struct {
+	selector *proxy.EgressSelector
+}
+
+func NewEgressRuleHandler(selector *proxy.EgressSelector) *EgressRuleHandler {
+	return &EgressRuleHandler{selector: selector}
+}
+
+type EgressRuleRequest struct {
+	Name       string `json:"name" binding:"required"`
+	UserID     *uint  `json:"user_id"`
+	Role       string `json:"role"`
+	RuleID     *uint  `json:"rule_id"`
+	Host       string `json:"host"`
+	SourceIPv4 string `json:"source_ipv4"`
+	SourceIPv6 string `json:"source_ipv6"`
+	Family     string `json:"family" binding:"omitempty,oneof=prefer_ipv4 prefer_ipv6 ipv4_only ipv6_only"`
+	Priority   *int   `json:"priority"`
+	IsActive   *bool  `json:"is_active"`
+}
+
+func (h *EgressRuleHandler) GetEgressRules(c *gin.Context) {
+	var rules []models.EgressRule
+	if err := database.GetDB().Order("priority ASC, id ASC").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch egress rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"egress_rules": rules})
+}
+
+func (h *EgressRuleHandler) GetEgressRule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid egress rule ID"})
+		return
+	}
+
+	var rule models.EgressRule
+	if err := database.GetDB().First(&rule, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Egress rule not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"egress_rule": rule})
+}
+
+func (h *EgressRuleHandler) CreateEgressRule(c *gin.Context) {
+	var req EgressRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule := models.EgressRule{
+		Priority: 100,
+		IsActive: true,
+	}
+	req.apply(&rule)
+
+	if err := proxy.ValidateEgressRule(rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := database.GetDB().Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create egress rule"})
+		return
+	}
+
+	h.reload()
+	c.JSON(http.StatusCreated, gin.H{"egress_rule": rule})
+}
+
+func (h *EgressRuleHandler) UpdateEgressRule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid egress rule ID"})
+		return
+	}
+
+	var req EgressRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var rule models.EgressRule
+	if err := database.GetDB().First(&rule, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Egress rule not found"})
+		return
+	}
+
+	req.apply(&rule)
+
+	if err := proxy.ValidateEgressRule(rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := database.GetDB().Save(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update egress rule"})
+		return
+	}
+
+	h.reload()
+	c.JSON(http.StatusOK, gin.H{"egress_rule": rule})
+}
+
+func (h *EgressRuleHandler) DeleteEgressRule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid egress rule ID"})
+		return
+	}
+
+	result := database.GetDB().Delete(&models.EgressRule{}, id)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete egress rule"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Egress rule not found"})
+		return
+	}
+
+	h.reload()
+	c.JSON(http.StatusOK, gin.H{"message": "Egress rule deleted successfully"})
+}
+
+func (req *EgressRuleRequest) apply(rule *models.EgressRule) {
+	rule.Name = req.Name
+	rule.UserID = req.UserID
+	rule.Role = req.Role
+	rule.RuleID = req.RuleID
+	rule.Host = strings.ToLower(req.Host)
+	rule.SourceIPv4 = req.SourceIPv4
+	rule.SourceIPv6 = req.SourceIPv6
+	rule.Family = req.Family
+	if req.Priority != nil {
+		rule.Priority = *req.Priority
+	}
+	if req.IsActive != nil {
+		rule.IsActive = *req.IsActive
+	}
+}
+
+func (h *EgressRuleHandler) reload() {
+	if err := h.selector.Reload(); err != nil {
+		logger.Error("Failed to reload egress rules: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zulkan/zulgoproxy/database"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+	"github.com/zulkan/zulgoproxy/proxy"
+	"gorm.io/gorm"
+)
+
+type ErrorPageHandler struct {
+	pages *proxy.ErrorPages
+}
+
+func NewErrorPageHandler(pages *proxy.ErrorPages) *ErrorPageHandler {
+	return &ErrorPageHandler{pages: pages}
+}
+
+type ErrorPageRequest struct {
+	HTML string `json:"html"`
+	Text string `json:"text"`
+}
+
+// GetErrorPages lists every outcome with its customized templates, if any,
+// and the built-in templates they replace.
+func (h *ErrorPageHandler) GetErrorPages(c *gin.Context) {
+	var rows []models.ErrorPage
+	if err := database.GetDB().Find(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch error pages"})
+		return
+	}
+
+	custom := make(map[string]models.ErrorPage, len(rows))
+	for _, row := range rows {
+		custom[row.Outcome] = row
+	}
+	pages := make([]models.ErrorPage, 0, len(models.ErrorOutcomes))
+	for _, outcome := range models.ErrorOutcomes {
+		page, ok := custom[outcome]
+		if !ok {
+			page = models.ErrorPage{Outcome: outcome}
+		}
+		pages = append(pages, page)
+	}
+
+	html, text := proxy.DefaultErrorTemplates()
+	c.JSON(http.StatusOK, gin.H{
+		"error_pages": pages,
+		"defaults":    gin.H{"html": html, "text": text},
+	})
+}
+
+// PreviewErrorPage renders an outcome's page with sample data, as HTML or
+// with format=text.
+func (h *ErrorPageHandler) PreviewErrorPage(c *gin.Context) {
+	outcome := c.Param("outcome")
+	if !knownOutcome(outcome) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown outcome"})
+		return
+	}
+
+	format := c.DefaultQuery("format", "html")
+	contentType := "text/html; charset=utf-8"
+	if format == "text" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	c.Data(http.StatusOK, contentType, h.pages.Render(format, proxy.SampleErrorPageData(outcome)))
+}
+
+// UpdateErrorPage stores the customized templates of an outcome.
+func (h *ErrorPageHandler) UpdateErrorPage(c *gin.Context) {
+	outcome := c.Param("outcome")
+	if !knownOutcome(outcome) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown outcome"})
+		return
+	}
+
+	var req ErrorPageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var page models.ErrorPage
+	err := database.GetDB().Where("outcome = ?", outcome).First(&page).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch error page"})
+		return
+	}
+	page.Outcome = outcome
+	page.HTML = req.HTML
+	page.Text = req.Text
+
+	if err := proxy.ValidateErrorPage(page); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := database.GetDB().Save(&page).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save error page"})
+		return
+	}
+
+	h.reload()
+	c.JSON(http.StatusOK, gin.H{"error_page": page})
+}
+
+// DeleteErrorPage restores the built-in page of an outcome.
+func (h *ErrorPageHandler) DeleteErrorPage(c *gin.Context) {
+	outcome := c.Param("outcome")
+	if !knownOutcome(outcome) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown outcome"})
+		return
+	}
+
+	if err := database.GetDB().Where("outcome = ?", outcome).Delete(&models.ErrorPage{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete error page"})
+		return
+	}
+
+	h.reload()
+	c.JSON(http.StatusOK, gin.H{"message": "Error page reset to default"})
+}
+
+func knownOutcome(outcome string) bool {
+	for _, known := range models.ErrorOutcomes {
+		if outcome == known {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *ErrorPageHandler) reload() {
+	if err := h.pages.Reload(); err != nil {
+		logger.Error("Failed to reload error pages: %v", err)
+	}
+}
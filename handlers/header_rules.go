@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zulkan/zulgoproxy/database"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+	"github.com/zulkan/zulgoproxy/proxy"
+)
+
+type HeaderRuleHandler struct {
+	rewriter *proxy.HeaderRewriter
+}
+
+func NewHeaderRuleHandler(rewriter *proxy.HeaderRewriter) *HeaderRuleHandler {
+	return &HeaderRuleHandler{rewriter: rewriter}
+}
+
+type HeaderRuleRequest struct {
+	Name       string `json:"name" binding:"required"`
+	Host       string `json:"host"`
+	PathPrefix string `json:"path_prefix"`
+	PolicyID   *uint  `json:"policy_id"`
+	Direction  string `json:"direction" binding:"required,oneof=request response"`
+	Action     string `json:"action" binding:"required,oneof=set append remove"`
+	Header     string `json:"header" binding:"required"`
+	Value      string `json:"value"`
+	Priority   *int   `json:"priority"`
+	IsActive   *bool  `json:"is_active"`
+}
+
+func (h *HeaderRuleHandler) GetHeaderRules(c *gin.Context) {
+	var rules []models.HeaderRule
+	if err := database.GetDB().Order("priority ASC, id ASC").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch header rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"header_rules": rules})
+}
+
+func (h *HeaderRuleHandler) GetHeaderRule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid header rule ID"})
+		return
+	}
+
+	var rule models.HeaderRule
+	if err := database.GetDB().First(&rule, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Header rule not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"header_rule": rule})
+}
+
+func (h *HeaderRuleHandler) CreateHeaderRule(c *gin.Context) {
+	var req HeaderRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule := models.HeaderRule{
+		Priority: 100,
+		IsActive: true,
+	}
+	req.apply(&rule)
+
+	if err := proxy.ValidateHeaderRule(rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := database.GetDB().Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create header rule"})
+		return
+	}
+
+	h.reload()
+	c.JSON(http.StatusCreated, gin.H{"header_rule": rule})
+}
+
+func (h *HeaderRuleHandler) UpdateHeaderRule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid header rule ID"})
+		return
+	}
+
+	var req HeaderRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var rule models.HeaderRule
+	if err := database.GetDB().First(&rule, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Header rule not found"})
+		return
+	}
+
+	req.apply(&rule)
+
+	if err := proxy.ValidateHeaderRule(rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := database.GetDB().Save(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update header rule"})
+		return
+	}
+
+	h.reload()
+	c.JSON(http.StatusOK, gin.H{"header_rule": rule})
+}
+
+func (h *HeaderRuleHandler) DeleteHeaderRule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid header rule ID"})
+		return
+	}
+
+	result := database.GetDB().Delete(&models.HeaderRule{}, id)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete header rule"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Header rule not found"})
+		return
+	}
+
+	h.reload()
+	c.JSON(http.StatusOK, gin.H{"message": "Header rule deleted successfully"})
+}
+
+func (req *HeaderRuleRequest) apply(rule *models.HeaderRule) {
+	rule.Name = req.Name
+	rule.Host = req.Host
+	rule.PathPrefix = req.PathPrefix
+	rule.PolicyID = req.PolicyID
+	rule.Direction = req.Direction
+	rule.Action = req.Action
+	rule.Header = req.Header
+	rule.Value = req.Value
+	if req.Priority != nil {
+		rule.Priority = *req.Priority
+	}
+	if req.IsActive != nil {
+		rule.IsActive = *req.IsActive
+	}
+}
+
+func (h *HeaderRuleHandler) reload() {
+	if err := h.rewriter.Reload(); err != nil {
+		logger.Error("Failed to reload header rules: %v", err)
+	}
+}
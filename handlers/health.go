@@ -1,18 +1,22 @@
 package handlers
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/zulkan/zulgoproxy/database"
 	"github.com/zulkan/zulgoproxy/models"
+	"github.com/zulkan/zulgoproxy/resolver"
 )
 
-type HealthHandler struct{}
+type HealthHandler struct {
+	resolver *resolver.Resolver
+}
 
-func NewHealthHandler() *HealthHandler {
-	return &HealthHandler{}
+func NewHealthHandler(res *resolver.Resolver) *HealthHandler {
+	return &HealthHandler{resolver: res}
 }
 
 type HealthResponse struct {
@@ -27,6 +31,7 @@ type Check struct {
 	Status  string        `json:"status"`
 	Message string        `json:"message,omitempty"`
 	Latency time.Duration `json:"latency,omitempty"`
+	Details interface{}   `json:"details,omitempty"`
 }
 
 var startTime = time.Now()
@@ -52,6 +57,15 @@ func (h *HealthHandler) Health(c *gin.Context) {
 		}
 	}
 	
+	// DNS check: degraded while some servers fail, unhealthy once all do
+	dnsCheck := h.dnsCheck()
+	checks["dns"] = dnsCheck
+	if dnsCheck.Status == "unhealthy" {
+		overallStatus = "unhealthy"
+	} else if dnsCheck.Status == "degraded" && overallStatus == "healthy" {
+		overallStatus = "degraded"
+	}
+	
 	// Memory check (basic)
 	checks["memory"] = Check{
 		Status: "healthy",
@@ -73,6 +87,30 @@ func (h *HealthHandler) Health(c *gin.Context) {
 	c.JSON(statusCode, response)
 }
 
+func (h *HealthHandler) dnsCheck() Check {
+	servers := h.resolver.Health()
+	if len(servers) == 0 {
+		return Check{Status: "healthy", Message: "using the system resolver"}
+	}
+
+	failing := 0
+	for _, server := range servers {
+		if !server.Healthy {
+			failing++
+		}
+	}
+	check := Check{Status: "healthy", Details: servers}
+	switch {
+	case failing == len(servers):
+		check.Status = "unhealthy"
+		check.Message = "no DNS server is answering"
+	case failing > 0:
+		check.Status = "degraded"
+		check.Message = fmt.Sprintf("%d of %d DNS servers failing", failing, len(servers))
+	}
+	return check
+}
+
 func (h *HealthHandler) Readiness(c *gin.Context) {
 	// Check if database is ready
 	if err := database.GetDB().Raw("SELECT 1").Error; err != nil {
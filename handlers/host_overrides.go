@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zulkan/zulgoproxy/database"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+	"github.com/zulkan/zulgoproxy/resolver"
+)
+
+type HostOverrideHandler struct {
+	resolver *resolver.Resolver
+}
+
+func NewHostOverrideHandler(res *resolver.Resolver) *HostOverrideHandler {
+	return &HostOverrideHandler{resolver: res}
+}
+
+type HostOverrideRequest struct {
+	Hostname  string   `json:"hostname" binding:"required"`
+	Addresses []string `json:"addresses" binding:"required"`
+	Comment   string   `json:"comment"`
+	IsActive  *bool    `json:"is_active"`
+}
+
+func (h *HostOverrideHandler) GetHostOverrides(c *gin.Context) {
+	var overrides []models.HostOverride
+	if err := database.GetDB().Order("hostname ASC").Find(&overrides).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch host overrides"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"host_overrides": overrides})
+}
+
+func (h *HostOverrideHandler) GetHostOverride(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid host override ID"})
+		return
+	}
+
+	var override models.HostOverride
+	if err := database.GetDB().First(&override, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Host override not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"host_override": override})
+}
+
+func (h *HostOverrideHandler) CreateHostOverride(c *gin.Context) {
+	var req HostOverrideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	override := models.HostOverride{IsActive: true}
+	req.apply(&override)
+
+	if err := resolver.ValidateHostOverride(override); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := database.GetDB().Create(&override).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create host override"})
+		return
+	}
+
+	h.reload()
+	c.JSON(http.StatusCreated, gin.H{"host_override": override})
+}
+
+func (h *HostOverrideHandler) UpdateHostOverride(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid host override ID"})
+		return
+	}
+
+	var req HostOverrideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var override models.HostOverride
+	if err := database.GetDB().First(&override, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Host override not found"})
+		return
+	}
+
+	req.apply(&override)
+
+	if err := resolver.ValidateHostOverride(override); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := database.GetDB().Save(&override).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update host override"})
+		return
+	}
+
+	h.reload()
+	c.JSON(http.StatusOK, gin.H{"host_override": override})
+}
+
+func (h *HostOverrideHandler) DeleteHostOverride(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid host override ID"})
+		return
+	}
+
+	result := database.GetDB().Delete(&models.HostOverride{}, id)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete host override"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Host override not found"})
+		return
+	}
+
+	h.reload()
+	c.JSON(http.StatusOK, gin.H{"message": "Host override deleted successfully"})
+}
+
+func (req *HostOverrideRequest) apply(override *models.HostOverride) {
+	override.Hostname = strings.ToLower(req.Hostname)
+	override.Addresses = req.Addresses
+	override.Comment = req.Comment
+	if req.IsActive != nil {
+		override.IsActive = *req.IsActive
+	}
+}
+
+func (h *HostOverrideHandler) reload() {
+	if err := h.resolver.Reload(); err != nil {
+		logger.Error("Failed to reload host overrides: %v", err)
+	}
+}
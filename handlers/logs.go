@@ -25,6 +25,9 @@ func (h *LogHandler) GetLogs(c *gin.Context) {
 	userID := c.Query("user_id")
 	method := c.Query("method")
 	host := c.Query("host")
+	cacheStatus := c.Query("cache_status")
+	requestID := c.Query("request_id")
+	egressAddr := c.Query("egress_addr")
 	fromDate := c.Query("from_date")
 	toDate := c.Query("to_date")
 	
@@ -39,6 +42,15 @@ func (h *LogHandler) GetLogs(c *gin.Context) {
 	if host != "" {
 		query = query.Where("host ILIKE ?", "%"+host+"%")
 	}
+	if cacheStatus != "" {
+		query = query.Where("cache_status = ?", cacheStatus)
+	}
+	if requestID != "" {
+		query = query.Where("request_id = ?", requestID)
+	}
+	if egressAddr != "" {
+		query = query.Where("egress_addr = ?", egressAddr)
+	}
 	if fromDate != "" {
 		if from, err := time.Parse("2006-01-02", fromDate); err == nil {
 			query = query.Where("timestamp >= ?", from)
@@ -121,12 +133,37 @@ func (h *LogHandler) GetLogStats(c *gin.Context) {
 		Where("timestamp BETWEEN ? AND ?", from, to).
 		Scan(&avgResponseTime)
 	
+	// Tunnel traffic (CONNECT and SOCKS5)
+	var tunnelStats struct {
+		Tunnels       int64   `json:"tunnels"`
+		BytesSent     int64   `json:"bytes_sent"`
+		BytesReceived int64   `json:"bytes_received"`
+		AvgDuration   float64 `json:"avg_duration"`
+	}
+	database.GetDB().Model(&models.ProxyLog{}).
+		Select("COUNT(*) as tunnels, COALESCE(SUM(bytes_sent), 0) as bytes_sent, COALESCE(SUM(bytes_received), 0) as bytes_received, COALESCE(AVG(duration), 0) as avg_duration").
+		Where("close_reason <> '' AND timestamp BETWEEN ? AND ?", from, to).
+		Scan(&tunnelStats)
+	
+	// Tunnels by close reason
+	var closeReasonStats []struct {
+		CloseReason string `json:"close_reason"`
+		Count       int64  `json:"count"`
+	}
+	database.GetDB().Model(&models.ProxyLog{}).
+		Select("close_reason, COUNT(*) as count").
+		Where("close_reason <> '' AND timestamp BETWEEN ? AND ?", from, to).
+		Group("close_reason").
+		Find(&closeReasonStats)
+	
 	c.JSON(http.StatusOK, gin.H{
 		"total_requests":      totalRequests,
 		"method_stats":        methodStats,
 		"status_stats":        statusStats,
 		"host_stats":          hostStats,
 		"avg_response_time":   avgResponseTime,
+		"tunnel_stats":        tunnelStats,
+		"close_reason_stats":  closeReasonStats,
 		"from_date":           fromDate,
 		"to_date":             toDate,
 	})
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zulkan/zulgoproxy/proxy"
+)
+
+type PACHandler struct {
+	generator *proxy.PACGenerator
+	proxyPort int
+	secure    bool
+}
+
+// NewPACHandler serves PAC files pointing at the proxy on proxyPort; secure
+// selects the HTTPS directive for a TLS proxy listener.
+func NewPACHandler(generator *proxy.PACGenerator, proxyPort int, secure bool) *PACHandler {
+	return &PACHandler{
+		generator: generator,
+		proxyPort: proxyPort,
+		secure:    secure,
+	}
+}
+
+func (h *PACHandler) GetPAC(c *gin.Context) {
+	group, ok := h.generator.Group(c.Query("group"), c.Query("token"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "PAC group not found"})
+		return
+	}
+
+	address := h.generator.ProxyAddress()
+	if address == "" {
+		host, _, err := net.SplitHostPort(c.Request.Host)
+		if err != nil {
+			host = c.Request.Host
+		}
+		address = net.JoinHostPort(host, strconv.Itoa(h.proxyPort))
+	}
+	directive := "PROXY " + address
+	if h.secure {
+		directive = "HTTPS " + address
+	}
+
+	// Clients should pick up rule changes on their next fetch
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "application/x-ns-proxy-autoconfig", h.generator.File(group, directive))
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zulkan/zulgoproxy/database"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+	"github.com/zulkan/zulgoproxy/proxy"
+)
+
+type PolicyHandler struct {
+	enforcer *proxy.PolicyEnforcer
+}
+
+func NewPolicyHandler(enforcer *proxy.PolicyEnforcer) *PolicyHandler {
+	return &PolicyHandler{enforcer: enforcer}
+}
+
+type PolicyRequest struct {
+	Name                 string              `json:"name" binding:"required"`
+	UserID               *uint               `json:"user_id"`
+	Role                 string              `json:"role" binding:"omitempty,oneof=admin user"`
+	Destinations         []string            `json:"destinations"`
+	ConnectPorts         []int               `json:"connect_ports"`
+	TimeWindows          []models.TimeWindow `json:"time_windows"`
+	MaxConnections       int                 `json:"max_connections" binding:"min=0"`
+	DailyQuota           int64               `json:"daily_quota" binding:"min=0"`
+	MonthlyQuota         int64               `json:"monthly_quota" binding:"min=0"`
+	BandwidthLimit       int64               `json:"bandwidth_limit" binding:"min=0"`
+	WebSocketIdleTimeout int                 `json:"websocket_idle_timeout" binding:"min=0"`
+	IsActive             *bool               `json:"is_active"`
+}
+
+func (h *PolicyHandler) GetPolicies(c *gin.Context) {
+	var policies []models.Policy
+	if err := database.GetDB().Preload("User").Order("id ASC").Find(&policies).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch policies"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"policies": policies})
+}
+
+func (h *PolicyHandler) GetPolicy(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid policy ID"})
+		return
+	}
+
+	var policy models.Policy
+	if err := database.GetDB().Preload("User").First(&policy, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Policy not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"policy": policy})
+}
+
+func (h *PolicyHandler) CreatePolicy(c *gin.Context) {
+	var req PolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	policy := models.Policy{IsActive: true}
+	req.apply(&policy)
+
+	if err := proxy.ValidatePolicy(policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := database.GetDB().Create(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create policy"})
+		return
+	}
+
+	h.reload()
+	c.JSON(http.StatusCreated, gin.H{"policy": policy})
+}
+
+func (h *PolicyHandler) UpdatePolicy(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid policy ID"})
+		return
+	}
+
+	var req PolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var policy models.Policy
+	if err := database.GetDB().First(&policy, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Policy not found"})
+		return
+	}
+
+	req.apply(&policy)
+
+	if err := proxy.ValidatePolicy(policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := database.GetDB().Save(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update policy"})
+		return
+	}
+
+	h.reload()
+	c.JSON(http.StatusOK, gin.H{"policy": policy})
+}
+
+func (h *PolicyHandler) DeletePolicy(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid policy ID"})
+		return
+	}
+
+	result := database.GetDB().Delete(&models.Policy{}, id)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete policy"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Policy not found"})
+		return
+	}
+
+	h.reload()
+	c.JSON(http.StatusOK, gin.H{"message": "Policy deleted successfully"})
+}
+
+func (req *PolicyRequest) apply(policy *models.Policy) {
+	policy.Name = req.Name
+	policy.UserID = req.UserID
+	policy.Role = req.Role
+	policy.Destinations = req.Destinations
+	policy.ConnectPorts = req.ConnectPorts
+	policy.TimeWindows = req.TimeWindows
+	policy.MaxConnections = req.MaxConnections
+	policy.DailyQuota = req.DailyQuota
+	policy.MonthlyQuota = req.MonthlyQuota
+	policy.BandwidthLimit = req.BandwidthLimit
+	policy.WebSocketIdleTimeout = req.WebSocketIdleTimeout
+	if req.IsActive != nil {
+		policy.IsActive = *req.IsActive
+	}
+}
+
+func (h *PolicyHandler) reload() {
+	if err := h.enforcer.Reload(); err != nil {
+		logger.Error("Failed to reload policies: %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zulkan/zulgoproxy/upstream"
+)
+
+type UpstreamHandler struct {
+	router *upstream.Router
+}
+
+func NewUpstreamHandler(router *upstream.Router) *UpstreamHandler {
+	return &UpstreamHandler{router: router}
+}
+
+func (h *UpstreamHandler) GetPools(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"pools": h.router.Pools()})
+}
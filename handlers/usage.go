@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zulkan/zulgoproxy/database"
+	"github.com/zulkan/zulgoproxy/models"
+	"github.com/zulkan/zulgoproxy/proxy"
+)
+
+type UsageHandler struct {
+	tracker  *proxy.UsageTracker
+	enforcer *proxy.PolicyEnforcer
+}
+
+func NewUsageHandler(tracker *proxy.UsageTracker, enforcer *proxy.PolicyEnforcer) *UsageHandler {
+	return &UsageHandler{tracker: tracker, enforcer: enforcer}
+}
+
+// QuotaUsage is the usage of one quota period. A zero limit means unlimited.
+type QuotaUsage struct {
+	Used      int64  `json:"used"`
+	Limit     int64  `json:"limit"`
+	Remaining *int64 `json:"remaining"`
+	Exhausted bool   `json:"exhausted"`
+}
+
+func newQuotaUsage(used, limit int64) QuotaUsage {
+	usage := QuotaUsage{Used: used, Limit: limit}
+	if limit > 0 {
+		remaining := limit - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		usage.Remaining = &remaining
+		usage.Exhausted = remaining == 0
+	}
+	return usage
+}
+
+func (h *UsageHandler) GetUsage(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var user models.User
+	if err := database.GetDB().First(&user, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	daily, monthly := h.tracker.Usage(user.ID)
+	var dailyQuota, monthlyQuota, bandwidthLimit int64
+	var policyID *uint
+	if policy := h.enforcer.For(&user); policy != nil {
+		dailyQuota, monthlyQuota, bandwidthLimit = policy.DailyQuota, policy.MonthlyQuota, policy.BandwidthLimit
+		policyID = &policy.ID
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":         user.ID,
+		"policy_id":       policyID,
+		"daily":           newQuotaUsage(daily, dailyQuota),
+		"monthly":         newQuotaUsage(monthly, monthlyQuota),
+		"bandwidth_limit": bandwidthLimit,
+	})
+}
@@ -8,12 +8,15 @@ import (
 	"github.com/zulkan/zulgoproxy/auth"
 	"github.com/zulkan/zulgoproxy/database"
 	"github.com/zulkan/zulgoproxy/models"
+	"github.com/zulkan/zulgoproxy/proxy"
 )
 
-type UserHandler struct{}
+type UserHandler struct {
+	proxyAuth *proxy.Authenticator
+}
 
-func NewUserHandler() *UserHandler {
-	return &UserHandler{}
+func NewUserHandler(proxyAuth *proxy.Authenticator) *UserHandler {
+	return &UserHandler{proxyAuth: proxyAuth}
 }
 
 type CreateUserRequest struct {
@@ -155,6 +158,7 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 		c.JSON(http.StatusConflict, gin.H{"error": "Username or email already exists"})
 		return
 	}
+	h.proxyAuth.InvalidateUser(user.ID)
 	
 	user.Password = ""
 	c.JSON(http.StatusOK, gin.H{"user": user})
@@ -188,6 +192,7 @@ func (h *UserHandler) DeleteUser(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
 		return
 	}
+	h.proxyAuth.InvalidateUser(user.ID)
 	
 	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
 }
@@ -229,6 +234,7 @@ func (h *UserHandler) ChangePassword(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
 		return
 	}
+	h.proxyAuth.InvalidateUser(user.ID)
 	
 	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully"})
 }
\ No newline at end of file
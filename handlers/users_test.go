@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zulkan/zulgoproxy/auth"
+	"github.com/zulkan/zulgoproxy/database"
+	"github.com/zulkan/zulgoproxy/models"
+	"github.com/zulkan/zulgoproxy/proxy"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	gormLogger "gorm.io/gorm/logger"
+)
+
+// fakeUsers serves the users table from memory for the queries the user
+// handlers and the proxy authenticator run.
+type fakeUsers struct {
+	users   map[uint]models.User
+	lookups int // by username, as proxy authentication does
+	mutex   sync.Mutex
+}
+
+func useFakeUsers(t *testing.T, users ...models.User) *fakeUsers {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=127.0.0.1 port=1"}), &gorm.Config{
+		DisableAutomaticPing:   true,
+		SkipDefaultTransaction: true,
+		Logger:                 gormLogger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeUsers{users: make(map[uint]models.User)}
+	for _, user := range users {
+		store.users[user.ID] = user
+	}
+	db.Callback().Query().Replace("gorm:query", store.query)
+	db.Callback().Update().Replace("gorm:update", store.update)
+	db.Callback().Delete().Replace("gorm:delete", store.delete)
+
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = previous })
+	return store
+}
+
+func (s *fakeUsers) query(db *gorm.DB) {
+	callbacks.BuildQuerySQL(db)
+	sql, vars := db.Statement.SQL.String(), db.Statement.Vars
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch dest := db.Statement.Dest.(type) {
+	case *int64: // counting the other admins
+		*dest = 0
+		for _, user := range s.users {
+			if user.Role == models.RoleAdmin {
+				*dest++
+			}
+		}
+		db.RowsAffected = 1
+	case *models.User:
+		byUsername := strings.Contains(sql, "username =")
+		if byUsername {
+			s.lookups++
+		}
+		for _, user := range s.users {
+			var match bool
+			if byUsername {
+				match = user.Username == vars[0] && user.IsActive == vars[1]
+			} else {
+				match = fmt.Sprint(user.ID) == fmt.Sprint(vars[0])
+			}
+			if match {
+				*dest = user
+				db.RowsAffected = 1
+				return
+			}
+		}
+		db.AddError(gorm.ErrRecordNotFound)
+	default:
+		db.AddError(fmt.Errorf("unexpected query %s", sql))
+	}
+}
+
+func (s *fakeUsers) update(db *gorm.DB) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch dest := db.Statement.Dest.(type) {
+	case *models.User: // Save
+		s.users[dest.ID] = *dest
+	case map[string]interface{}: // Model(&user).Update(column, value)
+		user := s.users[db.Statement.Model.(*models.User).ID]
+		if password, ok := dest["password"].(string); ok {
+			user.Password = password
+		}
+		s.users[user.ID] = user
+	}
+	db.RowsAffected = 1
+}
+
+func (s *fakeUsers) delete(db *gorm.DB) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.users, db.Statement.Dest.(*models.User).ID)
+	db.RowsAffected = 1
+}
+
+func (s *fakeUsers) usernameLookups() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lookups
+}
+
+func newTestUser(t *testing.T, id uint, username, password string) models.User {
+	t.Helper()
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return models.User{ID: id, Username: username, Password: hash, Role: models.RoleUser, IsActive: true}
+}
+
+func newUserRouter(proxyAuth *proxy.Authenticator, currentUser uint) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("user_id", currentUser) })
+	handler := NewUserHandler(proxyAuth)
+	router.PUT("/api/users/:id", handler.UpdateUser)
+	router.DELETE("/api/users/:id", handler.DeleteUser)
+	router.POST("/api/change-password", handler.ChangePassword)
+	return router
+}
+
+func serve(t *testing.T, router *gin.Engine, method, path string, body interface{}) {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(method, path, bytes.NewReader(data)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("%s %s: status %d: %s", method, path, recorder.Code, recorder.Body)
+	}
+}
+
+func TestProxyCredentialsRevoked(t *testing.T) {
+	tests := []struct {
+		name     string
+		revoke   func(t *testing.T, router *gin.Engine)
+		password string // that must work afterwards, "" for none
+	}{
+		{
+			name: "password change",
+			revoke: func(t *testing.T, router *gin.Engine) {
+				serve(t, router, http.MethodPost, "/api/change-password",
+					gin.H{"current_password": "old-secret", "new_password": "new-secret"})
+			},
+			password: "new-secret",
+		},
+		{
+			name: "deactivation",
+			revoke: func(t *testing.T, router *gin.Engine) {
+				serve(t, router, http.MethodPut, "/api/users/7", gin.H{"is_active": false})
+			},
+		},
+		{
+			name: "deletion",
+			revoke: func(t *testing.T, router *gin.Engine) {
+				serve(t, router, http.MethodDelete, "/api/users/7", nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := useFakeUsers(t, newTestUser(t, 7, "alice", "old-secret"), newTestUser(t, 8, "bob", "bob-secret"))
+			proxyAuth := proxy.NewAuthenticator(time.Hour)
+			router := newUserRouter(proxyAuth, 7)
+
+			for _, login := range [][2]string{{"alice", "old-secret"}, {"bob", "bob-secret"}, {"alice", "old-secret"}} {
+				if _, ok := proxyAuth.Authenticate(login[0], login[1]); !ok {
+					t.Fatalf("%s could not authenticate", login[0])
+				}
+			}
+			if lookups := store.usernameLookups(); lookups != 2 {
+				t.Fatalf("%d user lookups, want the repeated login served from the cache", lookups)
+			}
+
+			tt.revoke(t, router)
+
+			if _, ok := proxyAuth.Authenticate("alice", "old-secret"); ok {
+				t.Error("the cached credentials still authenticate")
+			}
+			if tt.password != "" {
+				if user, ok := proxyAuth.Authenticate("alice", tt.password); !ok || user.ID != 7 {
+					t.Errorf("the new password does not authenticate")
+				}
+			}
+
+			// Other users keep their cache entries
+			lookups := store.usernameLookups()
+			if _, ok := proxyAuth.Authenticate("bob", "bob-secret"); !ok {
+				t.Error("another user lost access")
+			}
+			if store.usernameLookups() != lookups {
+				t.Error("another user's cache entry was dropped")
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+)
+
+// EgressRule picks the local source address the proxy connects to
+// destinations from. Rules are checked in ascending priority order and the
+// first whose conditions all match decides; empty conditions match anything.
+type EgressRule struct {
+	ID     uint   `json:"id" gorm:"primarykey"`
+	Name   string `json:"name" gorm:"not null"`
+	UserID *uint  `json:"user_id,omitempty" gorm:"index"`
+	Role   string `json:"role"`              // every user with this role
+	RuleID *uint  `json:"rule_id,omitempty"` // destination rule that matched
+	Host   string `json:"host"`              // exact or "*.example.com"
+	// Addresses to bind; destinations of a family without one use the
+	// system's choice
+	SourceIPv4 string    `json:"source_ipv4"`
+	SourceIPv6 string    `json:"source_ipv6"`
+	Family     string    `json:"family"` // one of the EgressFamily values; empty prefers IPv4
+	Priority   int       `json:"priority" gorm:"index"`
+	IsActive   bool      `json:"is_active"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+const (
+	EgressFamilyPreferIPv4 = "prefer_ipv4"
+	EgressFamilyPreferIPv6 = "prefer_ipv6"
+	EgressFamilyIPv4Only   = "ipv4_only"
+	EgressFamilyIPv6Only   = "ipv6_only"
+)
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+)
+
+// ErrorPage replaces the built-in page the proxy answers with for one
+// outcome. Either template may be left empty to keep the built-in one for
+// that format.
+type ErrorPage struct {
+	ID      uint   `json:"id" gorm:"primarykey"`
+	Outcome string `json:"outcome" gorm:"uniqueIndex;size:32;not null"`
+	// Go templates; html is escaped as html/template does
+	HTML      string    `json:"html"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const (
+	OutcomeBlocked             = "blocked" // by rule, policy, port or destination guard
+	OutcomeAuthRequired        = "auth_required"
+	OutcomeQuotaExceeded       = "quota_exceeded"
+	OutcomeConnectionLimit     = "connection_limit" // per-user or proxy-wide cap
+	OutcomeUpstreamUnreachable = "upstream_unreachable"
+	OutcomeDNSFailure          = "dns_failure"
+)
+
+// ErrorOutcomes lists every outcome that has a page.
+var ErrorOutcomes = []string{
+	OutcomeBlocked,
+	OutcomeAuthRequired,
+	OutcomeQuotaExceeded,
+	OutcomeConnectionLimit,
+	OutcomeUpstreamUnreachable,
+	OutcomeDNSFailure,
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+)
+
+// HeaderRule sets, appends or removes a header on proxied requests or
+// responses. Rules are applied in ascending priority order; every matching
+// rule applies.
+type HeaderRule struct {
+	ID         uint   `json:"id" gorm:"primarykey"`
+	Name       string `json:"name" gorm:"not null"`
+	Host       string `json:"host"`                // exact or "*.example.com"; empty matches any
+	PathPrefix string `json:"path_prefix"`         // empty matches any
+	PolicyID   *uint  `json:"policy_id,omitempty"` // only users governed by this policy
+	Direction  string `json:"direction" gorm:"not null"`
+	Action     string `json:"action" gorm:"not null"`
+	Header     string `json:"header" gorm:"not null"`
+	// Value may use {client_ip}, {username} and {host}
+	Value     string    `json:"value"`
+	Priority  int       `json:"priority" gorm:"index"`
+	IsActive  bool      `json:"is_active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const (
+	HeaderDirectionRequest  = "request"
+	HeaderDirectionResponse = "response"
+
+	HeaderActionSet    = "set"    // replace any existing values
+	HeaderActionAppend = "append" // add to the comma-separated list
+	HeaderActionRemove = "remove"
+)
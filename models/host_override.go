@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+// HostOverride answers lookups of a host name with fixed addresses instead of
+// asking DNS, like an /etc/hosts entry. An exact name takes precedence over a
+// wildcard.
+type HostOverride struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	Hostname  string    `json:"hostname" gorm:"uniqueIndex;not null"` // exact, or "*.example.com" for the domain and its subdomains
+	Addresses []string  `json:"addresses" gorm:"serializer:json"`     // IPv4 or IPv6
+	Comment   string    `json:"comment"`
+	IsActive  bool      `json:"is_active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
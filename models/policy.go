@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+)
+
+// Policy restricts what an authenticated proxy user may do. A policy is
+// attached either to a single user or to every user with a role; a user's
+// own policy takes precedence over the role policy.
+type Policy struct {
+	ID       uint   `json:"id" gorm:"primarykey"`
+	Name     string `json:"name" gorm:"not null"`
+	UserID   *uint  `json:"user_id" gorm:"index"`
+	User     *User  `json:"user,omitempty" gorm:"foreignKey:UserID"`
+	Role     string `json:"role" gorm:"index"`
+	IsActive bool   `json:"is_active"`
+	// Empty lists and zero limits mean unrestricted
+	Destinations   []string     `json:"destinations" gorm:"serializer:json"`  // exact or "*.example.com"
+	ConnectPorts   []int        `json:"connect_ports" gorm:"serializer:json"` // overrides server.connect_ports when set; also limits SOCKS5 within socks_ports
+	TimeWindows    []TimeWindow `json:"time_windows" gorm:"serializer:json"`
+	MaxConnections int          `json:"max_connections"` // overrides server.max_connections_per_user when set
+	DailyQuota     int64        `json:"daily_quota"`     // bytes per day
+	MonthlyQuota   int64        `json:"monthly_quota"`   // bytes per calendar month
+	BandwidthLimit int64        `json:"bandwidth_limit"` // bytes per second per connection and direction
+	// Seconds; overrides server.websocket_idle_timeout when set
+	WebSocketIdleTimeout int       `json:"websocket_idle_timeout"`
+	CreatedAt            time.Time `json:"created_at"`
+	UpdatedAt            time.Time `json:"updated_at"`
+}
+
+// TimeWindow is a daily period, in server local time, during which the proxy
+// may be used. Start after End spans midnight.
+type TimeWindow struct {
+	Days  []string `json:"days"`  // "mon".."sun", empty for every day
+	Start string   `json:"start"` // "08:00"
+	End   string   `json:"end"`   // "18:00"
+}
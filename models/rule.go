@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+)
+
+// Rule is a destination allow/deny rule evaluated by the proxy. Rules are
+// checked in ascending priority order and the first match decides.
+type Rule struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	Name      string    `json:"name" gorm:"not null"`
+	Type      string    `json:"type" gorm:"not null"`
+	Pattern   string    `json:"pattern" gorm:"not null"`
+	Action    string    `json:"action" gorm:"not null"`
+	Priority  int       `json:"priority" gorm:"index"`
+	IsActive  bool      `json:"is_active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const (
+	RuleTypeExact    = "exact"    // host equals pattern
+	RuleTypeWildcard = "wildcard" // "*.example.com" matches the domain and its subdomains
+	RuleTypeRegex    = "regex"    // regular expression against the full URL
+	RuleTypeCIDR     = "cidr"     // IP-literal targets inside the network
+
+	RuleActionAllow = "allow"
+	RuleActionDeny  = "deny"
+)
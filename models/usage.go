@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// Usage is the traffic of a proxy user on one day, in server local time.
+// Monthly totals are the sum of the month's days.
+type Usage struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	UserID    uint      `json:"user_id" gorm:"not null;uniqueIndex:idx_usage_user_date"`
+	Date      string    `json:"date" gorm:"size:10;not null;uniqueIndex:idx_usage_user_date"` // "2006-01-02"
+	Bytes     int64     `json:"bytes"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
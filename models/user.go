@@ -38,8 +38,24 @@ type ProxyLog struct {
 	Host       string    `json:"host"`
 	UserAgent  string    `json:"user_agent"`
 	StatusCode int       `json:"status_code"`
+	RequestSize  int64   `json:"request_size"`
 	ResponseSize int64   `json:"response_size"`
 	Duration   int64     `json:"duration"` // in milliseconds
+	// Tunnel accounting, measured on the upstream side of a CONNECT
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+	CloseReason   string `json:"close_reason,omitempty"`
+	RuleID        *uint  `json:"rule_id,omitempty"` // destination rule that matched
+	DenyReason    string `json:"deny_reason,omitempty"`
+	CacheStatus   string `json:"cache_status,omitempty" gorm:"size:16"` // HIT, MISS or REVALIDATED
+	RequestID     string `json:"request_id" gorm:"size:32;index"`       // shown on error pages
+	DNSDuration   int64  `json:"dns_duration"`                          // in milliseconds, resolving the destination
+	EgressAddr    string `json:"egress_addr,omitempty" gorm:"size:45"`  // local address the outbound connection left from
+	// WebSocket sessions: complete messages each way and the status of the
+	// first Close frame
+	WebSocketMessagesSent     int64 `json:"websocket_messages_sent,omitempty"`
+	WebSocketMessagesReceived int64 `json:"websocket_messages_received,omitempty"`
+	WebSocketCloseCode        int   `json:"websocket_close_code,omitempty"`
 	Timestamp  time.Time `json:"timestamp"`
 }
 
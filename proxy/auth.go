@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/auth"
+	"github.com/zulkan/zulgoproxy/database"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+)
+
+// Authenticator verifies proxy credentials against the user store. Successful
+// verifications are cached for a short time so bcrypt does not run on every
+// CONNECT from the same client.
+type Authenticator struct {
+	entries map[string]authEntry
+	mutex   sync.RWMutex
+	ttl     time.Duration
+}
+
+type authEntry struct {
+	user      models.User
+	expiresAt time.Time
+}
+
+func NewAuthenticator(ttl time.Duration) *Authenticator {
+	a := &Authenticator{
+		entries: make(map[string]authEntry),
+		ttl:     ttl,
+	}
+
+	// Cleanup expired entries every minute
+	go a.cleanup()
+
+	return a
+}
+
+func (a *Authenticator) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		a.mutex.Lock()
+		now := time.Now()
+		for key, entry := range a.entries {
+			if now.After(entry.expiresAt) {
+				delete(a.entries, key)
+			}
+		}
+		a.mutex.Unlock()
+	}
+}
+
+// Authenticate returns the active user matching the given credentials.
+func (a *Authenticator) Authenticate(username, password string) (*models.User, bool) {
+	key := cacheKey(username, password)
+
+	a.mutex.RLock()
+	entry, exists := a.entries[key]
+	a.mutex.RUnlock()
+
+	if exists && time.Now().Before(entry.expiresAt) {
+		user := entry.user
+		return &user, true
+	}
+
+	// Soft-deleted users are excluded by GORM automatically
+	var user models.User
+	if err := database.GetDB().Where("username = ? AND is_active = ?", username, true).First(&user).Error; err != nil {
+		logger.Debug("Proxy auth: user not found or inactive: %s", username)
+		return nil, false
+	}
+
+	if !auth.CheckPassword(password, user.Password) {
+		logger.Warn("Proxy auth: password check failed for user: %s", username)
+		return nil, false
+	}
+
+	if a.ttl > 0 {
+		a.mutex.Lock()
+		a.entries[key] = authEntry{user: user, expiresAt: time.Now().Add(a.ttl)}
+		a.mutex.Unlock()
+	}
+
+	return &user, true
+}
+
+// InvalidateUser drops the cached verifications of a user, so a changed
+// password, deactivation or deletion takes effect immediately.
+func (a *Authenticator) InvalidateUser(userID uint) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for key, entry := range a.entries {
+		if entry.user.ID == userID {
+			delete(a.entries, key)
+		}
+	}
+}
+
+// cacheKey never keeps the plain password in memory.
+func cacheKey(username, password string) string {
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuthenticateRequest checks the Basic credentials carried in the
+// Proxy-Authorization header of req.
+func (a *Authenticator) AuthenticateRequest(req *http.Request) (*models.User, bool) {
+	username, password, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization"))
+	if !ok {
+		return nil, false
+	}
+	return a.Authenticate(username, password)
+}
+
+func parseProxyAuth(header string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	username, password, ok = strings.Cut(string(decoded), ":")
+	return username, password, ok
+}
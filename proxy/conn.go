@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// CountingConn counts the bytes read from and written to a connection and
+// remembers the first read error so a tunnel can tell which side failed.
+type CountingConn struct {
+	net.Conn
+	read    int64
+	written int64
+
+	mutex   sync.Mutex
+	readErr error
+}
+
+func NewCountingConn(conn net.Conn) *CountingConn {
+	return &CountingConn{Conn: conn}
+}
+
+func (c *CountingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	if err != nil && err != io.EOF {
+		c.mutex.Lock()
+		if c.readErr == nil {
+			c.readErr = err
+		}
+		c.mutex.Unlock()
+	}
+	return n, err
+}
+
+// ReadErr returns the first read error other than io.EOF, if any.
+func (c *CountingConn) ReadErr() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.readErr
+}
+
+func (c *CountingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// CloseWrite half-closes the underlying connection when it supports it.
+func (c *CountingConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// BytesRead returns the number of bytes read from the connection so far.
+func (c *CountingConn) BytesRead() int64 {
+	return atomic.LoadInt64(&c.read)
+}
+
+// BytesWritten returns the number of bytes written to the connection so far.
+func (c *CountingConn) BytesWritten() int64 {
+	return atomic.LoadInt64(&c.written)
+}
+
+// CloseWrite half-closes conn when it supports it, and closes it otherwise.
+func CloseWrite(conn net.Conn) error {
+	if hc, ok := conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return conn.Close()
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"context"
+	"net"
+)
+
+// DialFunc opens an outbound connection. ctx carries the RequestState of the
+// exchange so dialers can see who the connection is for.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// LookupFunc resolves a host name. ctx carries the RequestState like
+// DialFunc's.
+type LookupFunc func(ctx context.Context, host string) ([]net.IP, error)
+
+type stateKey struct{}
+
+// WithState returns a copy of ctx carrying state.
+func WithState(ctx context.Context, state *RequestState) context.Context {
+	return context.WithValue(ctx, stateKey{}, state)
+}
+
+// StateFromContext returns the state stored by WithState, if any.
+func StateFromContext(ctx context.Context) *RequestState {
+	state, _ := ctx.Value(stateKey{}).(*RequestState)
+	return state
+}
@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+
+	"github.com/zulkan/zulgoproxy/config"
+	"github.com/zulkan/zulgoproxy/database"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+)
+
+// Egress is how the direct connections of an exchange are made: which local
+// address they leave from and which address family they use.
+type Egress struct {
+	SourceIPv4 net.IP
+	SourceIPv6 net.IP
+	Family     string
+}
+
+func newEgress(sourceIPv4, sourceIPv6, family string) *Egress {
+	return &Egress{
+		SourceIPv4: net.ParseIP(sourceIPv4),
+		SourceIPv6: net.ParseIP(sourceIPv6),
+		Family:     family,
+	}
+}
+
+// LocalAddr returns the address to bind when connecting to ip, or nil to
+// leave it to the system.
+func (e *Egress) LocalAddr(ip net.IP) net.IP {
+	if e == nil {
+		return nil
+	}
+	if ip.To4() != nil {
+		return e.SourceIPv4
+	}
+	return e.SourceIPv6
+}
+
+// Order returns the addresses of a destination in the order they should be
+// tried, without those of an excluded family.
+func (e *Egress) Order(ips []net.IP) []net.IP {
+	if e == nil {
+		return ips
+	}
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch e.Family {
+	case models.EgressFamilyIPv4Only:
+		return v4
+	case models.EgressFamilyIPv6Only:
+		return v6
+	case models.EgressFamilyPreferIPv6:
+		return append(v6, v4...)
+	default:
+		return append(v4, v6...)
+	}
+}
+
+// key identifies the connections an Egress makes, for pooling them.
+func (e *Egress) key() string {
+	return fmt.Sprintf("%s|%s|%s", e.SourceIPv4, e.SourceIPv6, e.Family)
+}
+
+// EgressSelector picks the Egress of each exchange from the egress rules,
+// falling back to the configured default. Rules are kept in memory and
+// reloaded whenever they change through the API.
+type EgressSelector struct {
+	rules    []models.EgressRule
+	fallback *Egress // nil when nothing is configured
+	mutex    sync.RWMutex
+}
+
+func NewEgressSelector(cfg config.EgressConfig) (*EgressSelector, error) {
+	s := &EgressSelector{}
+	if cfg.SourceIPv4 == "" && cfg.SourceIPv6 == "" && cfg.Family == "" {
+		return s, nil
+	}
+	if err := validateEgress(cfg.SourceIPv4, cfg.SourceIPv6, cfg.Family); err != nil {
+		return nil, fmt.Errorf("egress: %w", err)
+	}
+	s.fallback = newEgress(cfg.SourceIPv4, cfg.SourceIPv6, cfg.Family)
+	return s, nil
+}
+
+// Reload replaces the in-memory rules with the active rules in the database.
+func (s *EgressSelector) Reload() error {
+	var rules []models.EgressRule
+	if err := database.GetDB().Where("is_active = ?", true).Order("priority ASC, id ASC").Find(&rules).Error; err != nil {
+		return fmt.Errorf("failed to load egress rules: %w", err)
+	}
+
+	valid := rules[:0]
+	for _, rule := range rules {
+		if err := ValidateEgressRule(rule); err != nil {
+			logger.Warn("Skipping invalid egress rule %d (%s): %v", rule.ID, rule.Name, err)
+			continue
+		}
+		valid = append(valid, rule)
+	}
+
+	s.mutex.Lock()
+	s.rules = valid
+	s.mutex.Unlock()
+
+	logger.Info("Loaded %d egress rules", len(valid))
+	return nil
+}
+
+// ValidateEgressRule checks that a rule's addresses can be bound on this host
+// and that its family is known.
+func ValidateEgressRule(rule models.EgressRule) error {
+	if rule.SourceIPv4 == "" && rule.SourceIPv6 == "" && rule.Family == "" {
+		return fmt.Errorf("a source address or family is required")
+	}
+	return validateEgress(rule.SourceIPv4, rule.SourceIPv6, rule.Family)
+}
+
+func validateEgress(sourceIPv4, sourceIPv6, family string) error {
+	switch family {
+	case "", models.EgressFamilyPreferIPv4, models.EgressFamilyPreferIPv6, models.EgressFamilyIPv4Only, models.EgressFamilyIPv6Only:
+	default:
+		return fmt.Errorf("unknown family %q", family)
+	}
+	if sourceIPv4 != "" {
+		ip := net.ParseIP(sourceIPv4)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid IPv4 source address %q", sourceIPv4)
+		}
+		if err := checkLocalAddress(ip); err != nil {
+			return err
+		}
+	}
+	if sourceIPv6 != "" {
+		ip := net.ParseIP(sourceIPv6)
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid IPv6 source address %q", sourceIPv6)
+		}
+		if err := checkLocalAddress(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLocalAddress fails unless this host can bind ip, as every connection
+// from it would fail otherwise.
+func checkLocalAddress(ip net.IP) error {
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return fmt.Errorf("source address %s is not usable on this host: %w", ip, err)
+	}
+	conn.Close()
+	return nil
+}
+
+// Select returns the Egress for state's exchange with host, or nil to leave
+// the connection to the system.
+func (s *EgressSelector) Select(state *RequestState, host string) *Egress {
+	host = Hostname(host)
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for i := range s.rules {
+		rule := &s.rules[i]
+		if egressRuleApplies(rule, state, host) {
+			return newEgress(rule.SourceIPv4, rule.SourceIPv6, rule.Family)
+		}
+	}
+	return s.fallback
+}
+
+func egressRuleApplies(rule *models.EgressRule, state *RequestState, host string) bool {
+	if rule.UserID != nil && (state.User == nil || state.User.ID != *rule.UserID) {
+		return false
+	}
+	if rule.Role != "" && (state.User == nil || state.User.Role != rule.Role) {
+		return false
+	}
+	if rule.RuleID != nil && (state.RuleID == nil || *state.RuleID != *rule.RuleID) {
+		return false
+	}
+	if rule.Host != "" && !MatchHost(rule.Host, host) {
+		return false
+	}
+	return true
+}
+
+// EgressTransport sends requests through a separate copy of a transport per
+// Egress, so a kept-alive connection bound to one source address is never
+// reused for a request meant to leave from another. The local address each
+// request's connection left from is recorded in its RequestState.
+type EgressTransport struct {
+	base       *http.Transport
+	transports map[string]*http.Transport
+	mutex      sync.Mutex
+}
+
+func NewEgressTransport(base *http.Transport) *EgressTransport {
+	return &EgressTransport{base: base, transports: make(map[string]*http.Transport)}
+}
+
+func (t *EgressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	state := StateFromContext(req.Context())
+	if state == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			state.EgressAddr = LocalIP(info.Conn)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return t.transportFor(state.Egress).RoundTrip(req)
+}
+
+func (t *EgressTransport) transportFor(egress *Egress) *http.Transport {
+	if egress == nil {
+		return t.base
+	}
+	key := egress.key()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	transport, exists := t.transports[key]
+	if !exists {
+		transport = t.base.Clone()
+		t.transports[key] = transport
+	}
+	return transport
+}
+
+// LocalIP returns the local address conn left from.
+func LocalIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/zulkan/zulgoproxy/database"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+)
+
+const maxErrorTemplateSize = 64 << 10
+
+// ErrorPageData is what error page templates are executed with.
+type ErrorPageData struct {
+	RequestID  string
+	Outcome    string
+	Title      string // built-in headline of the outcome
+	Message    string // built-in explanation of the outcome
+	Reason     string // why this request failed
+	Status     int
+	StatusText string
+	Host       string
+	URL        string // empty for CONNECT
+	ClientIP   string
+	Username   string
+	Time       time.Time
+}
+
+var errorPageTexts = map[string]struct{ title, message string }{
+	models.OutcomeBlocked:             {"Access blocked", "The proxy does not allow access to this site."},
+	models.OutcomeAuthRequired:        {"Proxy authentication required", "Sign in with your proxy username and password to continue."},
+	models.OutcomeQuotaExceeded:       {"Traffic quota exceeded", "You have used up your traffic allowance for now."},
+	models.OutcomeConnectionLimit:     {"Too many connections", "The connection limit has been reached. Try again in a moment."},
+	models.OutcomeUpstreamUnreachable: {"Site unreachable", "The proxy could not reach this site."},
+	models.OutcomeDNSFailure:          {"Site not found", "The proxy could not resolve the name of this site."},
+}
+
+const defaultErrorHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 4em auto; padding: 0 1em; color: #222; }
+.meta { color: #666; font-size: 0.9em; border-top: 1px solid #ddd; padding-top: 1em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+<p><strong>Reason:</strong> {{.Reason}}</p>
+<p class="meta">
+{{if .URL}}URL: {{.URL}}<br>{{else if .Host}}Host: {{.Host}}<br>{{end}}
+Request ID: {{.RequestID}}<br>
+{{.Status}} {{.StatusText}} &middot; {{.Time.Format "2006-01-02 15:04:05 MST"}}
+</p>
+</body>
+</html>
+`
+
+const defaultErrorText = `{{.Title}}
+
+{{.Message}}
+Reason: {{.Reason}}
+
+{{if .URL}}URL: {{.URL}}
+{{else if .Host}}Host: {{.Host}}
+{{end}}Request ID: {{.RequestID}}
+`
+
+var (
+	defaultHTMLTemplate = htmltemplate.Must(htmltemplate.New("default").Parse(defaultErrorHTML))
+	defaultTextTemplate = texttemplate.Must(texttemplate.New("default").Parse(defaultErrorText))
+)
+
+// DefaultErrorTemplates returns the built-in HTML and text templates, a
+// starting point for customized pages.
+func DefaultErrorTemplates() (html, text string) {
+	return defaultErrorHTML, defaultErrorText
+}
+
+// pageTemplate is satisfied by both html/template and text/template.
+type pageTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// errorPage holds the customized templates of an outcome; nil ones use the
+// built-in page.
+type errorPage struct {
+	html pageTemplate
+	text pageTemplate
+}
+
+// ErrorPages renders the pages the proxy answers refused and failed requests
+// with, as HTML for browsers and plain text otherwise. Pages customized
+// through the API are kept in memory and reloaded whenever they change.
+type ErrorPages struct {
+	pages map[string]errorPage
+	mutex sync.RWMutex
+}
+
+func NewErrorPages() *ErrorPages {
+	return &ErrorPages{pages: make(map[string]errorPage)}
+}
+
+// The pages used by the response builders; built-in until UseErrorPages
+var errorPages = NewErrorPages()
+
+// UseErrorPages makes the response builders render with p.
+func UseErrorPages(p *ErrorPages) {
+	errorPages = p
+}
+
+// Reload replaces the in-memory pages with the customized pages in the
+// database.
+func (p *ErrorPages) Reload() error {
+	var rows []models.ErrorPage
+	if err := database.GetDB().Find(&rows).Error; err != nil {
+		return fmt.Errorf("failed to load error pages: %w", err)
+	}
+
+	pages := make(map[string]errorPage, len(rows))
+	for _, row := range rows {
+		page, err := compileErrorPage(row)
+		if err != nil {
+			logger.Warn("Skipping invalid error page %s: %v", row.Outcome, err)
+			continue
+		}
+		pages[row.Outcome] = page
+	}
+
+	p.mutex.Lock()
+	p.pages = pages
+	p.mutex.Unlock()
+
+	logger.Info("Loaded %d custom error pages", len(pages))
+	return nil
+}
+
+// ValidateErrorPage checks that a page's outcome is known and that its
+// templates parse and render.
+func ValidateErrorPage(row models.ErrorPage) error {
+	if _, ok := errorPageTexts[row.Outcome]; !ok {
+		return fmt.Errorf("unknown outcome %q", row.Outcome)
+	}
+	page, err := compileErrorPage(row)
+	if err != nil {
+		return err
+	}
+
+	data := SampleErrorPageData(row.Outcome)
+	if page.html != nil {
+		if err := page.html.Execute(io.Discard, data); err != nil {
+			return fmt.Errorf("html template: %w", err)
+		}
+	}
+	if page.text != nil {
+		if err := page.text.Execute(io.Discard, data); err != nil {
+			return fmt.Errorf("text template: %w", err)
+		}
+	}
+	return nil
+}
+
+func compileErrorPage(row models.ErrorPage) (errorPage, error) {
+	var page errorPage
+	if len(row.HTML) > maxErrorTemplateSize || len(row.Text) > maxErrorTemplateSize {
+		return page, fmt.Errorf("templates are limited to %d bytes", maxErrorTemplateSize)
+	}
+
+	var err error
+	if row.HTML != "" {
+		if page.html, err = htmltemplate.New(row.Outcome).Parse(row.HTML); err != nil {
+			return page, fmt.Errorf("html template: %w", err)
+		}
+	}
+	if row.Text != "" {
+		if page.text, err = texttemplate.New(row.Outcome).Parse(row.Text); err != nil {
+			return page, fmt.Errorf("text template: %w", err)
+		}
+	}
+	return page, nil
+}
+
+// SampleErrorPageData returns made-up data for previewing an outcome's page.
+func SampleErrorPageData(outcome string) ErrorPageData {
+	texts := errorPageTexts[outcome]
+	return ErrorPageData{
+		RequestID:  "0123456789abcdef",
+		Outcome:    outcome,
+		Title:      texts.title,
+		Message:    texts.message,
+		Reason:     "example reason",
+		Status:     http.StatusForbidden,
+		StatusText: http.StatusText(http.StatusForbidden),
+		Host:       "example.com",
+		URL:        "http://example.com/",
+		ClientIP:   "192.0.2.10",
+		Username:   "alice",
+		Time:       time.Now(),
+	}
+}
+
+// Render executes the outcome's page in the given format, "html" or "text",
+// falling back to the built-in page if the custom one fails.
+func (p *ErrorPages) Render(format string, data ErrorPageData) []byte {
+	p.mutex.RLock()
+	page := p.pages[data.Outcome]
+	p.mutex.RUnlock()
+
+	custom, builtin := page.text, pageTemplate(defaultTextTemplate)
+	if format == "html" {
+		custom, builtin = page.html, defaultHTMLTemplate
+	}
+
+	var buf bytes.Buffer
+	if custom != nil {
+		err := custom.Execute(&buf, data)
+		if err == nil {
+			return buf.Bytes()
+		}
+		logger.Warn("Error page %s failed to render: %v", data.Outcome, err)
+		buf.Reset()
+	}
+	builtin.Execute(&buf, data)
+	return buf.Bytes()
+}
+
+// Response builds the answer to req for outcome. The page is HTML when the
+// client accepts it. The response can also be written straight to a hijacked
+// CONNECT client, which needs a valid protocol version.
+func (p *ErrorPages) Response(req *http.Request, outcome string, status int, reason string) *http.Response {
+	data := errorPageData(req, outcome, status, reason)
+
+	format, contentType := "text", goproxy.ContentTypeText
+	if strings.Contains(req.Header.Get("Accept"), "text/html") {
+		format, contentType = "html", goproxy.ContentTypeHtml
+	}
+
+	resp := goproxy.NewResponse(req, contentType+"; charset=utf-8", status, string(p.Render(format, data)))
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	resp.Header.Set("Cache-Control", "no-store")
+	resp.Header.Set("X-Request-Id", data.RequestID)
+	return resp
+}
+
+func errorPageData(req *http.Request, outcome string, status int, reason string) ErrorPageData {
+	texts := errorPageTexts[outcome]
+	data := ErrorPageData{
+		Outcome:    outcome,
+		Title:      texts.title,
+		Message:    texts.message,
+		Reason:     reason,
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Host:       Hostname(req.URL.Host),
+		Time:       time.Now(),
+	}
+	if data.Host == "" {
+		data.Host = Hostname(req.Host)
+	}
+	if req.Method != http.MethodConnect {
+		data.URL = req.URL.String()
+	}
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		data.ClientIP = clientIP
+	}
+
+	if state := StateFromContext(req.Context()); state != nil {
+		data.RequestID = state.ID
+		if state.User != nil {
+			data.Username = state.User.Username
+		}
+	} else {
+		data.RequestID = newRequestID()
+	}
+	return data
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/config"
+	"github.com/zulkan/zulgoproxy/logger"
+)
+
+const guardLookupTimeout = 5 * time.Second
+
+// Ranges that are internal without being covered by the net.IP predicates
+var internalCIDRs = []string{
+	"0.0.0.0/8",      // "this" network
+	"100.64.0.0/10",  // carrier-grade NAT
+	"192.0.0.0/24",   // IETF protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"64:ff9b:1::/48", // local-use NAT64
+}
+
+// DestinationGuard refuses destinations in internal address ranges so proxy
+// users cannot reach the proxy's own services or the private network behind
+// it. Hosts are checked when the request arrives and the dialed IP again at
+// connect time, so a name that re-resolves to an internal address is caught.
+type DestinationGuard struct {
+	blocked []*net.IPNet
+	allowed []*net.IPNet
+	local   map[string]bool
+	lookup  LookupFunc
+}
+
+// NewDestinationGuard builds the guard for cfg. Hosts are resolved with
+// lookup, or the system resolver when it is nil.
+func NewDestinationGuard(cfg config.SSRFConfig, lookup LookupFunc) (*DestinationGuard, error) {
+	g := &DestinationGuard{local: make(map[string]bool), lookup: lookup}
+
+	var err error
+	if g.blocked, err = parseCIDRs(append(internalCIDRs, cfg.BlockedCIDRs...)); err != nil {
+		return nil, err
+	}
+	if g.allowed, err = parseCIDRs(cfg.AllowedCIDRs); err != nil {
+		return nil, err
+	}
+
+	// The proxy's own addresses reach the admin API even when public
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logger.Warn("Failed to list local addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			g.local[ipNet.IP.String()] = true
+		}
+	}
+
+	return g, nil
+}
+
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", value, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// CheckIP returns an error when ip must not be reached.
+func (g *DestinationGuard) CheckIP(ip net.IP) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, ipNet := range g.allowed {
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+
+	switch {
+	case ip.IsLoopback():
+		return fmt.Errorf("destination %s is a loopback address", ip)
+	case ip.IsPrivate():
+		return fmt.Errorf("destination %s is a private address", ip)
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast(), ip.IsInterfaceLocalMulticast():
+		return fmt.Errorf("destination %s is a link-local address", ip)
+	case ip.IsUnspecified():
+		return fmt.Errorf("destination %s is unspecified", ip)
+	case g.local[ip.String()]:
+		return fmt.Errorf("destination %s is an address of this proxy", ip)
+	}
+	for _, ipNet := range g.blocked {
+		if ipNet.Contains(ip) {
+			return fmt.Errorf("destination %s is in blocked range %s", ip, ipNet)
+		}
+	}
+	return nil
+}
+
+// Check resolves host and returns an error when any of its addresses must not
+// be reached. Names that fail to resolve pass; the dial fails on its own. ctx
+// is passed to the lookup.
+func (g *DestinationGuard) Check(ctx context.Context, host string) error {
+	hostname := Hostname(host)
+	if ip := net.ParseIP(hostname); ip != nil {
+		return g.CheckIP(ip)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, guardLookupTimeout)
+	defer cancel()
+
+	ips, err := g.resolve(ctx, hostname)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if err := g.CheckIP(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *DestinationGuard) resolve(ctx context.Context, hostname string) ([]net.IP, error) {
+	if g.lookup != nil {
+		return g.lookup(ctx, hostname)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// Control is used as net.Dialer.Control to check the address actually being
+// connected to.
+func (g *DestinationGuard) Control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("unexpected dial address %q", address)
+	}
+	return g.CheckIP(ip)
+}
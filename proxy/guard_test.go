@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/config"
+)
+
+func newTestGuard(t *testing.T, cfg config.SSRFConfig, lookup LookupFunc) *DestinationGuard {
+	t.Helper()
+	guard, err := NewDestinationGuard(cfg, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return guard
+}
+
+func TestDestinationGuardCheckIP(t *testing.T) {
+	guard := newTestGuard(t, config.SSRFConfig{
+		BlockedCIDRs: []string{"203.0.113.0/24"},
+		AllowedCIDRs: []string{"10.20.0.0/16", "fd00:1::/64"},
+	}, nil)
+
+	tests := []struct {
+		ip   string
+		want string // substring of the error, "" when allowed
+	}{
+		{"127.0.0.1", "loopback"},
+		{"127.45.6.7", "loopback"},
+		{"::1", "loopback"},
+		{"10.0.0.1", "private"},
+		{"172.16.0.1", "private"},
+		{"172.31.255.254", "private"},
+		{"192.168.1.1", "private"},
+		{"fd12:3456::1", "private"},
+		{"169.254.169.254", "link-local"},
+		{"169.254.0.1", "link-local"},
+		{"fe80::1", "link-local"},
+		{"0.0.0.0", "unspecified"},
+		{"::", "unspecified"},
+		{"100.64.0.1", "blocked range"},
+		{"::ffff:127.0.0.1", "loopback"},
+		{"::ffff:10.0.0.1", "private"},
+		{"::ffff:169.254.169.254", "link-local"},
+		{"203.0.113.7", "blocked range"},
+		{"10.20.1.2", ""},
+		{"::ffff:10.20.1.2", ""},
+		{"fd00:1::5", ""},
+		{"172.32.0.1", ""},
+		{"8.8.8.8", ""},
+		{"2001:4860:4860::8888", ""},
+	}
+	for _, tt := range tests {
+		err := guard.CheckIP(net.ParseIP(tt.ip))
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("CheckIP(%s) = %v, want allowed", tt.ip, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("CheckIP(%s) = %v, want an error about %q", tt.ip, err, tt.want)
+		}
+	}
+}
+
+func TestDestinationGuardCheckResolvesNames(t *testing.T) {
+	lookup := func(ctx context.Context, host string) ([]net.IP, error) {
+		switch host {
+		case "intranet.example.test":
+			return []net.IP{net.ParseIP("10.1.2.3")}, nil
+		case "mixed.example.test":
+			return []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("192.168.0.10")}, nil
+		case "public.example.test":
+			return []net.IP{net.ParseIP("8.8.8.8")}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	guard := newTestGuard(t, config.SSRFConfig{}, lookup)
+
+	tests := []struct {
+		host    string
+		refused bool
+	}{
+		{"intranet.example.test:443", true},
+		{"mixed.example.test", true},
+		{"public.example.test:80", false},
+		{"missing.example.test", false},
+		{"[::1]", true},
+		{"[::1]:8080", true},
+		{"127.0.0.1:22", true},
+	}
+	for _, tt := range tests {
+		if err := guard.Check(context.Background(), tt.host); (err != nil) != tt.refused {
+			t.Errorf("Check(%s) = %v, want refused %v", tt.host, err, tt.refused)
+		}
+	}
+}
+
+func TestDestinationGuardRefusesPrivateIPAtDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// localhost is a name, so only the check of the dialed IP catches it
+	guard := newTestGuard(t, config.SSRFConfig{}, nil)
+	dialer := net.Dialer{Timeout: 5 * time.Second, Control: guard.Control}
+
+	_, err = dialer.Dial("tcp", net.JoinHostPort("localhost", port))
+	if err == nil || !strings.Contains(err.Error(), "loopback") {
+		t.Fatalf("dialing localhost = %v, want refused as loopback", err)
+	}
+
+	allowing := newTestGuard(t, config.SSRFConfig{AllowedCIDRs: []string{"127.0.0.0/8", "::1/128"}}, nil)
+	dialer.Control = allowing.Control
+	conn, err := dialer.Dial("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatalf("dialing an allowed loopback address: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/zulkan/zulgoproxy/database"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+	"golang.org/x/net/http/httpguts"
+)
+
+// Headers that framing or routing depend on; rewriting them would corrupt
+// the exchange
+var protectedHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Host":              true,
+	"Connection":        true,
+}
+
+// HeaderRewriter applies header rules to proxied requests and responses.
+// Rules are kept in memory and reloaded whenever they change through the API.
+type HeaderRewriter struct {
+	rules []models.HeaderRule
+	mutex sync.RWMutex
+}
+
+func NewHeaderRewriter() *HeaderRewriter {
+	return &HeaderRewriter{}
+}
+
+// Reload replaces the in-memory rules with the active rules in the database.
+func (h *HeaderRewriter) Reload() error {
+	var rules []models.HeaderRule
+	if err := database.GetDB().Where("is_active = ?", true).Order("priority ASC, id ASC").Find(&rules).Error; err != nil {
+		return fmt.Errorf("failed to load header rules: %w", err)
+	}
+
+	valid := rules[:0]
+	for _, rule := range rules {
+		if err := ValidateHeaderRule(rule); err != nil {
+			logger.Warn("Skipping invalid header rule %d (%s): %v", rule.ID, rule.Name, err)
+			continue
+		}
+		valid = append(valid, rule)
+	}
+
+	h.mutex.Lock()
+	h.rules = valid
+	h.mutex.Unlock()
+
+	logger.Info("Loaded %d header rules", len(valid))
+	return nil
+}
+
+// ValidateHeaderRule checks that a rule's direction, action and header are
+// usable.
+func ValidateHeaderRule(rule models.HeaderRule) error {
+	if rule.Direction != models.HeaderDirectionRequest && rule.Direction != models.HeaderDirectionResponse {
+		return fmt.Errorf("unknown direction %q", rule.Direction)
+	}
+	switch rule.Action {
+	case models.HeaderActionSet, models.HeaderActionAppend, models.HeaderActionRemove:
+	default:
+		return fmt.Errorf("unknown action %q", rule.Action)
+	}
+	if !httpguts.ValidHeaderFieldName(rule.Header) {
+		return fmt.Errorf("invalid header name %q", rule.Header)
+	}
+	if protectedHeaders[http.CanonicalHeaderKey(rule.Header)] {
+		return fmt.Errorf("header %s cannot be rewritten", http.CanonicalHeaderKey(rule.Header))
+	}
+	if !httpguts.ValidHeaderFieldValue(rule.Value) {
+		return fmt.Errorf("invalid header value")
+	}
+	return nil
+}
+
+// RewriteRequest applies the request rules to req before it is forwarded.
+// Proxy credentials never leave the proxy.
+func (h *HeaderRewriter) RewriteRequest(req *http.Request, state *RequestState, policy *models.Policy) {
+	req.Header.Del("Proxy-Authorization")
+	h.apply(models.HeaderDirectionRequest, req.Header, req, state, policy)
+}
+
+// RewriteResponse applies the response rules to resp, the answer to req.
+func (h *HeaderRewriter) RewriteResponse(resp *http.Response, req *http.Request, state *RequestState, policy *models.Policy) {
+	h.apply(models.HeaderDirectionResponse, resp.Header, req, state, policy)
+}
+
+func (h *HeaderRewriter) apply(direction string, header http.Header, req *http.Request, state *RequestState, policy *models.Policy) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	host := Hostname(req.URL.Host)
+	for i := range h.rules {
+		rule := &h.rules[i]
+		if rule.Direction != direction || !ruleApplies(rule, host, req.URL.Path, policy) {
+			continue
+		}
+
+		if rule.Action == models.HeaderActionRemove {
+			header.Del(rule.Header)
+			continue
+		}
+		value := expandHeaderValue(rule.Value, req, state)
+		if !httpguts.ValidHeaderFieldValue(value) {
+			logger.Debug("Header rule %d skipped: expanded value is not valid", rule.ID)
+			continue
+		}
+		switch rule.Action {
+		case models.HeaderActionSet:
+			header.Set(rule.Header, value)
+		case models.HeaderActionAppend:
+			if existing := header.Values(rule.Header); len(existing) > 0 {
+				value = strings.Join(existing, ", ") + ", " + value
+			}
+			header.Set(rule.Header, value)
+		}
+	}
+}
+
+func ruleApplies(rule *models.HeaderRule, host, path string, policy *models.Policy) bool {
+	if rule.Host != "" && !MatchHost(rule.Host, host) {
+		return false
+	}
+	if rule.PathPrefix != "" && !strings.HasPrefix(path, rule.PathPrefix) {
+		return false
+	}
+	if rule.PolicyID != nil && (policy == nil || policy.ID != *rule.PolicyID) {
+		return false
+	}
+	return true
+}
+
+func expandHeaderValue(value string, req *http.Request, state *RequestState) string {
+	if !strings.Contains(value, "{") {
+		return value
+	}
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+	username := ""
+	if state != nil && state.User != nil {
+		username = state.User.Username
+	}
+	return strings.NewReplacer(
+		"{client_ip}", clientIP,
+		"{username}", username,
+		"{host}", Hostname(req.URL.Host),
+	).Replace(value)
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+)
+
+// Hostname strips the port from a host[:port] target and lowercases it.
+func Hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		// A bracketed IPv6 literal without a port
+		host = host[1 : len(host)-1]
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// MatchHost reports whether host matches pattern. A pattern is either an exact
+// hostname or "*.example.com", which matches example.com and every subdomain.
+func MatchHost(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	host = Hostname(host)
+
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		domain := pattern[2:]
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	}
+	return host == pattern
+}
+
+// MatchAnyHost reports whether host matches one of patterns.
+func MatchAnyHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if MatchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
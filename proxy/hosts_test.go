@@ -0,0 +1,47 @@
+package proxy
+
+import "testing"
+
+func TestHostname(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"Example.COM", "example.com"},
+		{"example.com:8080", "example.com"},
+		{"example.com.", "example.com"},
+		{"192.0.2.1:443", "192.0.2.1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"[::1]", "::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[", "["},
+	}
+	for _, tt := range tests {
+		if got := Hostname(tt.host); got != tt.want {
+			t.Errorf("Hostname(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com:443", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "badexample.com", false},
+		{"*", "anything.test", true},
+		{"::1", "[::1]", true},
+		{"::1", "[::1]:8080", true},
+	}
+	for _, tt := range tests {
+		if got := MatchHost(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("MatchHost(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
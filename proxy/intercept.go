@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/zulkan/zulgoproxy/logger"
+)
+
+const handshakeTimeout = 30 * time.Second
+
+// Interceptor terminates the TLS of intercepted CONNECT tunnels and serves
+// the decrypted requests with the proxy handler, so they pass the same
+// checks, transport and WebSocket handling as plain HTTP. goproxy's own MITM
+// mode dials WebSocket upgrades directly, bypassing all of them.
+type Interceptor struct {
+	handler http.Handler
+	conns   *ConnListener
+}
+
+// interceptedConn is the decrypted client side of a tunnel to host. onClose
+// runs once, when the server or a WebSocket session closes it.
+type interceptedConn struct {
+	net.Conn
+	host    string
+	state   *RequestState // of the CONNECT
+	once    sync.Once
+	onClose func()
+}
+
+func (c *interceptedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.onClose)
+	return err
+}
+
+type interceptedKey struct{}
+
+func NewInterceptor(handler http.Handler) *Interceptor {
+	i := &Interceptor{handler: handler, conns: NewConnListener(nil)}
+	server := &http.Server{
+		Handler: http.HandlerFunc(i.serveHTTP),
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, interceptedKey{}, conn)
+		},
+		// Clients are only offered HTTP/1.1
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	}
+	go server.Serve(i.conns)
+	return i
+}
+
+// Tunnel returns the action for a CONNECT to host that is intercepted,
+// presenting the certificates of tlsConfig to the client. Like a tunnel
+// passed through, its ProxyLog row is written when it closes, with the bytes
+// exchanged with the client.
+func (i *Interceptor) Tunnel(host string, tlsConfig *tls.Config) *goproxy.ConnectAction {
+	return &goproxy.ConnectAction{
+		Action: goproxy.ConnectHijack,
+		Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+			state := StateFrom(ctx)
+			if state == nil {
+				state = NewRequestState(nil)
+			}
+			entry := state.LogEntry(req)
+			entry.Host = host
+			counted := NewCountingConn(client)
+			finish := func(reason string) {
+				entry.CloseReason = reason
+				entry.RequestSize = counted.BytesRead()
+				entry.ResponseSize = counted.BytesWritten()
+				Record(entry)
+				state.Finish()
+			}
+
+			if _, err := io.WriteString(counted, "HTTP/1.0 200 OK\r\n\r\n"); err != nil {
+				client.Close()
+				entry.StatusCode = http.StatusBadGateway
+				finish(CloseClientError)
+				return
+			}
+			entry.StatusCode = http.StatusOK
+
+			conn := tls.Server(counted, tlsConfig)
+			conn.SetDeadline(time.Now().Add(handshakeTimeout))
+			if err := conn.Handshake(); err != nil {
+				logger.Debug("TLS handshake with %s for %s failed: %v", req.RemoteAddr, host, err)
+				conn.Close()
+				finish(CloseClientError)
+				return
+			}
+			conn.SetDeadline(time.Time{})
+
+			intercepted := &interceptedConn{Conn: conn, host: host, state: state}
+			intercepted.onClose = func() { finish(CloseClientClosed) }
+			if !i.conns.Push(intercepted) {
+				intercepted.Close()
+			}
+		},
+	}
+}
+
+// serveHTTP makes a decrypted request look like one sent to the proxy for an
+// https URL. The CONNECT's state is attached to it, marking it intercepted.
+func (i *Interceptor) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	conn := req.Context().Value(interceptedKey{}).(*interceptedConn)
+	req.URL.Scheme = "https"
+	req.URL.Host = conn.host
+	req = req.WithContext(WithState(req.Context(), conn.state))
+	i.handler.ServeHTTP(w, req)
+}
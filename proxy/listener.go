@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+)
+
+// ConnListener hands connections accepted elsewhere, such as sniffed or
+// decrypted ones, to an http.Server.
+type ConnListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func NewConnListener(addr net.Addr) *ConnListener {
+	return &ConnListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Push hands conn to Accept and reports whether the listener took it.
+func (l *ConnListener) Push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *ConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *ConnListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *ConnListener) Addr() net.Addr {
+	return l.addr
+}
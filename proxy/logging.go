@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/zulkan/zulgoproxy/database"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+)
+
+// RequestState travels in ProxyCtx.UserData from the request hooks to the
+// response hooks and tunnel handlers of a single proxied exchange.
+type RequestState struct {
+	// ID identifies the exchange on error pages and in its ProxyLog row
+	ID          string
+	User        *models.User
+	Start       time.Time
+	RequestBody *CountingReadCloser
+	// Intercepted marks a CONNECT whose TLS is terminated by the proxy
+	Intercepted bool
+	// RuleID is the destination rule that matched, if any
+	RuleID *uint
+	// DenyReason explains why the proxy refused the request
+	DenyReason string
+	// BandwidthLimit throttles each direction, in bytes per second
+	BandwidthLimit int64
+	// Conn is the entry in the live connection table, if registered
+	Conn *Connection
+	// CacheStatus is set when the response cache handled the request
+	CacheStatus string
+	// Egress is how direct connections are made, if an egress rule or the
+	// configured default applies
+	Egress *Egress
+	// EgressAddr is the local address the outbound connection left from
+	EgressAddr string
+	// WebSocketIdleTimeout closes an upgraded session after this long
+	// without traffic; 0 never does
+	WebSocketIdleTimeout time.Duration
+
+	closers []func()
+	once    sync.Once
+	dnsTime int64 // nanoseconds
+}
+
+func NewRequestState(user *models.User) *RequestState {
+	return &RequestState{
+		ID:    newRequestID(),
+		User:  user,
+		Start: time.Now(),
+	}
+}
+
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// StateFrom returns the state attached to ctx, if any.
+func StateFrom(ctx *goproxy.ProxyCtx) *RequestState {
+	if ctx == nil {
+		return nil
+	}
+	state, _ := ctx.UserData.(*RequestState)
+	return state
+}
+
+// OnFinish registers f to run when the exchange ends, e.g. to release a
+// connection slot.
+func (s *RequestState) OnFinish(f func()) {
+	s.closers = append(s.closers, f)
+}
+
+// Finish runs the registered OnFinish funcs once.
+func (s *RequestState) Finish() {
+	s.once.Do(func() {
+		for _, f := range s.closers {
+			f()
+		}
+	})
+}
+
+// AddDNSTime adds time spent resolving destination names for the exchange.
+func (s *RequestState) AddDNSTime(d time.Duration) {
+	atomic.AddInt64(&s.dnsTime, int64(d))
+}
+
+// DNSTime returns the time spent resolving destination names so far.
+func (s *RequestState) DNSTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.dnsTime))
+}
+
+// requestCount returns the bytes of request body read so far.
+func (s *RequestState) requestCount() int64 {
+	if s.RequestBody == nil {
+		return 0
+	}
+	return s.RequestBody.Count()
+}
+
+// LogEntry starts a ProxyLog row for req; callers fill in the outcome.
+func (s *RequestState) LogEntry(req *http.Request) *models.ProxyLog {
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+
+	entry := s.StreamEntry(req.RemoteAddr, req.Method, host)
+	entry.UserAgent = req.UserAgent()
+	if req.Method != http.MethodConnect {
+		entry.URL = req.URL.String()
+	}
+	return entry
+}
+
+// StreamEntry starts a ProxyLog row for a connection that is not an HTTP
+// request, such as a SOCKS5 session.
+func (s *RequestState) StreamEntry(remoteAddr, method, host string) *models.ProxyLog {
+	entry := &models.ProxyLog{
+		RemoteAddr: remoteAddr,
+		Method:     method,
+		URL:        host,
+		Host:       host,
+		Timestamp:  s.Start,
+	}
+	if s.User != nil {
+		userID := s.User.ID
+		entry.UserID = &userID
+	}
+	if s.RequestBody != nil {
+		entry.RequestSize = s.RequestBody.Count()
+	}
+	entry.RuleID = s.RuleID
+	entry.DenyReason = s.DenyReason
+	entry.CacheStatus = s.CacheStatus
+	entry.RequestID = s.ID
+	entry.DNSDuration = s.DNSTime().Milliseconds()
+	entry.EgressAddr = s.EgressAddr
+	return entry
+}
+
+// Record saves entry asynchronously so logging never blocks proxied traffic.
+func Record(entry *models.ProxyLog) {
+	entry.Duration = time.Since(entry.Timestamp).Milliseconds()
+
+	go func() {
+		if err := database.GetDB().Create(entry).Error; err != nil {
+			logger.Error("Failed to record proxy log for %s: %v", entry.Host, err)
+		}
+	}()
+}
+
+// LogResponse is a goproxy response hook. The row for a plain HTTP exchange
+// is written once the response body has been copied to the client.
+func LogResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	state := StateFrom(ctx)
+	if state == nil {
+		return resp
+	}
+
+	entry := state.LogEntry(ctx.Req)
+	if resp == nil {
+		// Upstream failed; goproxy answers the client with its own error
+		entry.StatusCode = http.StatusBadGateway
+		Record(entry)
+		state.Finish()
+		return resp
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// The WebSocket session writes the row when it closes
+		return resp
+	}
+
+	entry.StatusCode = resp.StatusCode
+	body := &loggedBody{
+		CountingReadCloser: CountingReadCloser{ReadCloser: ThrottleReader(resp.Body, state.BandwidthLimit)},
+		onClose: func(n int64) {
+			if state.RequestBody != nil {
+				entry.RequestSize = state.RequestBody.Count()
+			}
+			entry.ResponseSize = n
+			Record(entry)
+			state.Finish()
+		},
+	}
+	state.Conn.SetCounters(state.requestCount, body.Count)
+	resp.Body = body
+	return resp
+}
+
+// CountingReadCloser counts the bytes read through it.
+type CountingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func NewCountingReadCloser(rc io.ReadCloser) *CountingReadCloser {
+	return &CountingReadCloser{ReadCloser: rc}
+}
+
+func (c *CountingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// Count returns the number of bytes read so far.
+func (c *CountingReadCloser) Count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// loggedBody calls onClose exactly once; goproxy may close a body twice.
+type loggedBody struct {
+	CountingReadCloser
+	once    sync.Once
+	onClose func(n int64)
+}
+
+func (b *loggedBody) Close() error {
+	err := b.CountingReadCloser.Close()
+	b.once.Do(func() {
+		b.onClose(b.Count())
+	})
+	return err
+}
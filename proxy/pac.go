@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/zulkan/zulgoproxy/config"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+)
+
+// Generated files are cached per group and proxy directive; the directive
+// may come from the request host, so the cache is bounded.
+const maxCachedPACFiles = 64
+
+var pacDomainPattern = regexp.MustCompile(`^(\*\.)?[a-z0-9_-]+(\.[a-z0-9_-]+)*$`)
+
+// PACGenerator builds proxy auto-config files from the configured bypass
+// lists. A bypass entry that a deny rule matches is left out so clients still
+// send those destinations to the proxy to be refused; files are rebuilt when
+// the rules change.
+type PACGenerator struct {
+	cfg   config.PACConfig
+	rules *RuleEngine
+	cache map[string][]byte
+	mutex sync.Mutex
+}
+
+func NewPACGenerator(cfg config.PACConfig, rules *RuleEngine) (*PACGenerator, error) {
+	if err := validatePACBypass(cfg.BypassDomains, cfg.BypassCIDRs); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, group := range cfg.Groups {
+		if group.Name == "" || seen[group.Name] {
+			return nil, fmt.Errorf("PAC group names must be unique and non-empty (%q)", group.Name)
+		}
+		seen[group.Name] = true
+		if err := validatePACBypass(group.BypassDomains, group.BypassCIDRs); err != nil {
+			return nil, fmt.Errorf("PAC group %s: %w", group.Name, err)
+		}
+	}
+
+	g := &PACGenerator{
+		cfg:   cfg,
+		rules: rules,
+		cache: make(map[string][]byte),
+	}
+	rules.OnReload(g.Invalidate)
+	return g, nil
+}
+
+func validatePACBypass(domains, cidrs []string) error {
+	for _, domain := range domains {
+		if !pacDomainPattern.MatchString(strings.ToLower(domain)) {
+			return fmt.Errorf("invalid PAC bypass domain %q", domain)
+		}
+	}
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid PAC bypass CIDR %q: %w", cidr, err)
+		}
+		if ipNet.IP.To4() == nil {
+			return fmt.Errorf("PAC bypass CIDR %q is not IPv4; isInNet cannot match it", cidr)
+		}
+	}
+	return nil
+}
+
+// ProxyAddress returns the configured address clients should use, if any.
+func (g *PACGenerator) ProxyAddress() string {
+	return g.cfg.ProxyAddress
+}
+
+// Group returns the variant selected by name or token. An empty name and
+// token select the base file, returned as nil.
+func (g *PACGenerator) Group(name, token string) (*config.PACGroup, bool) {
+	if name == "" && token == "" {
+		return nil, true
+	}
+	for i := range g.cfg.Groups {
+		group := &g.cfg.Groups[i]
+		if token != "" {
+			if group.Token == token {
+				return group, true
+			}
+			continue
+		}
+		if group.Name == name && group.Token == "" {
+			return group, true
+		}
+	}
+	return nil, false
+}
+
+// Invalidate drops the cached files so the next request rebuilds them.
+func (g *PACGenerator) Invalidate() {
+	g.mutex.Lock()
+	g.cache = make(map[string][]byte)
+	g.mutex.Unlock()
+}
+
+// File returns the PAC file of group (nil for the base file) sending proxied
+// traffic to proxies, e.g. "PROXY proxy.example.com:8181".
+func (g *PACGenerator) File(group *config.PACGroup, proxies string) []byte {
+	key := proxies
+	if group != nil {
+		key = group.Name + "\n" + proxies
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if file, ok := g.cache[key]; ok {
+		return file
+	}
+	if len(g.cache) >= maxCachedPACFiles {
+		g.cache = make(map[string][]byte)
+	}
+	file := g.build(group, proxies)
+	g.cache[key] = file
+	return file
+}
+
+func (g *PACGenerator) build(group *config.PACGroup, proxies string) []byte {
+	domains := g.cfg.BypassDomains
+	cidrs := g.cfg.BypassCIDRs
+	name := "default"
+	if group != nil {
+		domains = append(append([]string{}, domains...), group.BypassDomains...)
+		cidrs = append(append([]string{}, cidrs...), group.BypassCIDRs...)
+		name = group.Name
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Generated by ZulgoProxy (%s)\n", name)
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("  host = host.toLowerCase();\n")
+
+	for _, domain := range domains {
+		domain = strings.ToLower(domain)
+		if rule := g.denyRule(domain); rule != nil {
+			logger.Debug("PAC bypass %s left out: denied by rule %d", domain, rule.ID)
+			continue
+		}
+		if strings.HasPrefix(domain, "*.") {
+			fmt.Fprintf(&b, "  if (host == %q || dnsDomainIs(host, %q)) return \"DIRECT\";\n", domain[2:], domain[1:])
+		} else {
+			fmt.Fprintf(&b, "  if (host == %q) return \"DIRECT\";\n", domain)
+		}
+	}
+
+	if len(cidrs) > 0 {
+		b.WriteString("  var ip = dnsResolve(host);\n")
+		b.WriteString("  if (ip) {\n")
+		for _, cidr := range cidrs {
+			_, ipNet, _ := net.ParseCIDR(cidr)
+			fmt.Fprintf(&b, "    if (isInNet(ip, %q, %q)) return \"DIRECT\";\n", ipNet.IP.String(), net.IP(ipNet.Mask).String())
+		}
+		b.WriteString("  }\n")
+	}
+
+	fmt.Fprintf(&b, "  return %q;\n", proxies)
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
+
+// denyRule returns the deny rule matching a bypass domain, checked against
+// the domain itself for wildcards.
+func (g *PACGenerator) denyRule(domain string) *models.Rule {
+	host := strings.TrimPrefix(domain, "*.")
+	rule := g.rules.Evaluate(host, host)
+	if rule == nil || rule.Action != models.RuleActionDeny {
+		return nil
+	}
+	return rule
+}
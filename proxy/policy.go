@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/database"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+)
+
+// PolicyEnforcer applies per-user and per-role access policies once the proxy
+// user is known. Policies are cached in memory and reloaded on change.
+type PolicyEnforcer struct {
+	byUser map[uint]models.Policy
+	byRole map[string]models.Policy
+	mutex  sync.RWMutex
+}
+
+func NewPolicyEnforcer() *PolicyEnforcer {
+	return &PolicyEnforcer{
+		byUser: make(map[uint]models.Policy),
+		byRole: make(map[string]models.Policy),
+	}
+}
+
+// Reload replaces the cached policies with the active ones in the database.
+func (p *PolicyEnforcer) Reload() error {
+	var policies []models.Policy
+	if err := database.GetDB().Where("is_active = ?", true).Order("id ASC").Find(&policies).Error; err != nil {
+		return fmt.Errorf("failed to load policies: %w", err)
+	}
+
+	byUser := make(map[uint]models.Policy)
+	byRole := make(map[string]models.Policy)
+	for _, policy := range policies {
+		if policy.UserID != nil {
+			if _, exists := byUser[*policy.UserID]; !exists {
+				byUser[*policy.UserID] = policy
+			}
+		} else if policy.Role != "" {
+			if _, exists := byRole[policy.Role]; !exists {
+				byRole[policy.Role] = policy
+			}
+		}
+	}
+
+	p.mutex.Lock()
+	p.byUser = byUser
+	p.byRole = byRole
+	p.mutex.Unlock()
+
+	logger.Info("Loaded %d access policies", len(policies))
+	return nil
+}
+
+// ValidatePolicy checks that a policy has a subject and well-formed windows.
+func ValidatePolicy(policy models.Policy) error {
+	if policy.UserID == nil && policy.Role == "" {
+		return fmt.Errorf("policy needs a user_id or a role")
+	}
+	for _, port := range policy.ConnectPorts {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	for _, window := range policy.TimeWindows {
+		if _, err := parseClock(window.Start); err != nil {
+			return err
+		}
+		if _, err := parseClock(window.End); err != nil {
+			return err
+		}
+		for _, day := range window.Days {
+			if _, ok := weekdays[strings.ToLower(day)]; !ok {
+				return fmt.Errorf("invalid day %q", day)
+			}
+		}
+	}
+	return nil
+}
+
+// For returns the policy governing user, or nil when none applies.
+func (p *PolicyEnforcer) For(user *models.User) *models.Policy {
+	if user == nil {
+		return nil
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if policy, exists := p.byUser[user.ID]; exists {
+		return &policy
+	}
+	if policy, exists := p.byRole[user.Role]; exists {
+		return &policy
+	}
+	return nil
+}
+
+// CheckPolicy returns a reason when policy forbids reaching host now. CONNECT
+// ports are checked separately with CheckConnectPort.
+func CheckPolicy(policy *models.Policy, host string) string {
+	if policy == nil {
+		return ""
+	}
+
+	if len(policy.TimeWindows) > 0 && !inTimeWindows(policy.TimeWindows, time.Now()) {
+		return "outside allowed time window"
+	}
+
+	if len(policy.Destinations) > 0 && !MatchAnyHost(policy.Destinations, host) {
+		return "destination not permitted"
+	}
+
+	return ""
+}
+
+// ConnectPorts returns the ports a tunnel may reach: the policy's own list
+// when it has one, otherwise defaults. An empty list allows any port.
+func ConnectPorts(policy *models.Policy, defaults []int) []int {
+	if policy != nil && len(policy.ConnectPorts) > 0 {
+		return policy.ConnectPorts
+	}
+	return defaults
+}
+
+// CheckConnectPort returns a reason when a tunnel to host uses a port outside
+// ports.
+func CheckConnectPort(ports []int, host string) string {
+	if len(ports) == 0 {
+		return ""
+	}
+	port, ok := connectPort(host)
+	if !ok {
+		return "invalid CONNECT port"
+	}
+	for _, allowed := range ports {
+		if port == allowed {
+			return ""
+		}
+	}
+	return fmt.Sprintf("CONNECT port %d not permitted", port)
+}
+
+// connectPort returns the port of a tunnel target, 443 when it has none.
+func connectPort(host string) (int, bool) {
+	_, portStr, err := net.SplitHostPort(host)
+	if err != nil {
+		return 443, true
+	}
+	port, err := strconv.Atoi(portStr)
+	return port, err == nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func inTimeWindows(windows []models.TimeWindow, now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	for _, window := range windows {
+		start, err := parseClock(window.Start)
+		if err != nil {
+			continue
+		}
+		end, err := parseClock(window.End)
+		if err != nil {
+			continue
+		}
+
+		day := now.Weekday()
+		if start > end && minute < end {
+			// Early hours of a window that started the previous day
+			day = (day + 6) % 7
+		}
+		if !onDay(window.Days, day) {
+			continue
+		}
+
+		if start <= end && minute >= start && minute < end {
+			return true
+		}
+		if start > end && (minute >= start || minute < end) {
+			return true
+		}
+	}
+	return false
+}
+
+func onDay(days []string, day time.Weekday) bool {
+	if len(days) == 0 {
+		return true
+	}
+	for _, d := range days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock converts "HH:MM" to minutes since midnight.
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
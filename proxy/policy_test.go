@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/models"
+)
+
+// at returns the given weekday and time in the week of Sunday 4 January 2026.
+func at(day time.Weekday, hour, minute int) time.Time {
+	return time.Date(2026, time.January, 4+int(day), hour, minute, 0, 0, time.Local)
+}
+
+func TestInTimeWindows(t *testing.T) {
+	overnight := []models.TimeWindow{{Start: "22:00", End: "06:00"}}
+	office := []models.TimeWindow{{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "08:00", End: "18:00"}}
+	fridayNight := []models.TimeWindow{{Days: []string{"Fri"}, Start: "22:00", End: "06:00"}}
+	weekendNight := []models.TimeWindow{{Days: []string{"sun"}, Start: "23:30", End: "00:30"}}
+	split := []models.TimeWindow{
+		{Start: "08:00", End: "12:00"},
+		{Start: "13:00", End: "17:00"},
+	}
+
+	tests := []struct {
+		name    string
+		windows []models.TimeWindow
+		now     time.Time
+		want    bool
+	}{
+		{"overnight before midnight", overnight, at(time.Wednesday, 23, 0), true},
+		{"overnight after midnight", overnight, at(time.Thursday, 5, 0), true},
+		{"overnight at its start", overnight, at(time.Wednesday, 22, 0), true},
+		{"overnight a minute before its start", overnight, at(time.Wednesday, 21, 59), false},
+		{"overnight at midnight", overnight, at(time.Thursday, 0, 0), true},
+		{"overnight last minute", overnight, at(time.Thursday, 5, 59), true},
+		{"overnight at its end", overnight, at(time.Thursday, 6, 0), false},
+		{"overnight at midday", overnight, at(time.Thursday, 12, 0), false},
+
+		{"weekday office hours", office, at(time.Monday, 9, 30), true},
+		{"office at its start", office, at(time.Friday, 8, 0), true},
+		{"office last minute", office, at(time.Friday, 17, 59), true},
+		{"office at its end", office, at(time.Friday, 18, 0), false},
+		{"office on saturday", office, at(time.Saturday, 9, 30), false},
+		{"office on sunday", office, at(time.Sunday, 9, 30), false},
+
+		{"friday night on friday", fridayNight, at(time.Friday, 23, 0), true},
+		{"friday night rolls into saturday", fridayNight, at(time.Saturday, 5, 0), true},
+		{"saturday night is not friday night", fridayNight, at(time.Saturday, 23, 0), false},
+		{"thursday night is not friday night", fridayNight, at(time.Friday, 5, 0), false},
+		{"sunday night rolls into monday", weekendNight, at(time.Monday, 0, 15), true},
+		{"sunday late evening", weekendNight, at(time.Sunday, 23, 45), true},
+		{"saturday night rolls into sunday", weekendNight, at(time.Sunday, 0, 15), false},
+
+		{"first of two windows", split, at(time.Tuesday, 11, 59), true},
+		{"between two windows", split, at(time.Tuesday, 12, 30), false},
+		{"second of two windows", split, at(time.Tuesday, 13, 0), true},
+
+		{"no windows", nil, at(time.Tuesday, 12, 0), false},
+		{"invalid window ignored", []models.TimeWindow{{Start: "8am", End: "18:00"}}, at(time.Tuesday, 12, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inTimeWindows(tt.windows, tt.now); got != tt.want {
+				t.Errorf("inTimeWindows at %s = %v, want %v", tt.now.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePolicyTimeWindows(t *testing.T) {
+	tests := []struct {
+		window models.TimeWindow
+		valid  bool
+	}{
+		{models.TimeWindow{Days: []string{"Mon", "sun"}, Start: "22:00", End: "06:00"}, true},
+		{models.TimeWindow{Start: "24:00", End: "06:00"}, false},
+		{models.TimeWindow{Start: "08:00", End: "6pm"}, false},
+		{models.TimeWindow{Days: []string{"monday"}, Start: "08:00", End: "18:00"}, false},
+	}
+	for _, tt := range tests {
+		policy := models.Policy{Role: models.RoleUser, TimeWindows: []models.TimeWindow{tt.window}}
+		if err := ValidatePolicy(policy); (err == nil) != tt.valid {
+			t.Errorf("ValidatePolicy(%+v) = %v, want valid %v", tt.window, err, tt.valid)
+		}
+	}
+}
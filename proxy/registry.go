@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/models"
+)
+
+var (
+	// ErrConnectionLimit means the proxy as a whole is at its cap.
+	ErrConnectionLimit = errors.New("proxy connection limit reached")
+	// ErrUserConnectionLimit means the user is at their cap.
+	ErrUserConnectionLimit = errors.New("concurrent connection limit reached")
+)
+
+// Connection is a live proxied exchange: an HTTP request, a CONNECT tunnel
+// or a SOCKS5 session.
+type Connection struct {
+	ID         uint64
+	UserID     *uint
+	Username   string
+	ClientAddr string
+	Method     string
+	Target     string
+	Start      time.Time
+
+	user        *models.User
+	mutex       sync.Mutex
+	sent        func() int64
+	received    func() int64
+	metered     int64 // bytes already counted towards the user's usage
+	closer      func()
+	closeReason string // set when the proxy closed the connection
+}
+
+// ConnectionInfo is the admin view of a Connection.
+type ConnectionInfo struct {
+	ID            uint64    `json:"id"`
+	UserID        *uint     `json:"user_id"`
+	Username      string    `json:"username"`
+	ClientIP      string    `json:"client_ip"`
+	Method        string    `json:"method"`
+	Target        string    `json:"target"`
+	StartedAt     time.Time `json:"started_at"`
+	Duration      int64     `json:"duration"` // in milliseconds
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+}
+
+// SetCounters reports the bytes read from and written to the client so far.
+// It is safe to call on a nil Connection.
+func (c *Connection) SetCounters(sent, received func() int64) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	c.sent, c.received = sent, received
+	c.mutex.Unlock()
+}
+
+// SetCloser sets how the connection is torn down when an admin kills it.
+// It is safe to call on a nil Connection.
+func (c *Connection) SetCloser(f func()) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	c.closer = f
+	c.mutex.Unlock()
+}
+
+// Killed reports whether an admin or the proxy closed the connection.
+func (c *Connection) Killed() bool {
+	return c.CloseReason() != ""
+}
+
+// CloseReason returns why the proxy closed the connection, such as
+// CloseKilled, or "" while it did not. It is safe to call on a nil
+// Connection.
+func (c *Connection) CloseReason() string {
+	if c == nil {
+		return ""
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closeReason
+}
+
+func (c *Connection) kill(reason string) {
+	c.mutex.Lock()
+	if c.closeReason == "" {
+		c.closeReason = reason
+	}
+	closer := c.closer
+	c.mutex.Unlock()
+
+	if closer != nil {
+		closer()
+	}
+}
+
+// unmetered returns the bytes moved since the last call. Counters replaced
+// by SetCounters start over, so a total lower than already counted only
+// resets the mark.
+func (c *Connection) unmetered() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var total int64
+	if c.sent != nil {
+		total += c.sent()
+	}
+	if c.received != nil {
+		total += c.received()
+	}
+	delta := total - c.metered
+	c.metered = total
+	if delta < 0 {
+		return 0
+	}
+	return delta
+}
+
+func (c *Connection) info() ConnectionInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	clientIP, _, err := net.SplitHostPort(c.ClientAddr)
+	if err != nil {
+		clientIP = c.ClientAddr
+	}
+	info := ConnectionInfo{
+		ID:        c.ID,
+		UserID:    c.UserID,
+		Username:  c.Username,
+		ClientIP:  clientIP,
+		Method:    c.Method,
+		Target:    c.Target,
+		StartedAt: c.Start,
+		Duration:  time.Since(c.Start).Milliseconds(),
+	}
+	if c.sent != nil {
+		info.BytesSent = c.sent()
+	}
+	if c.received != nil {
+		info.BytesReceived = c.received()
+	}
+	return info
+}
+
+// ConnectionRegistry tracks live connections and enforces the global and
+// per-user concurrency caps.
+type ConnectionRegistry struct {
+	conns   map[uint64]*Connection
+	perUser map[uint]int
+	next    uint64
+	limit   int
+	mutex   sync.Mutex
+	// onRemove is called with each connection once it has finished
+	onRemove func(conn *Connection)
+}
+
+// NewConnectionRegistry returns a registry allowing limit connections in
+// total; zero means unlimited.
+func NewConnectionRegistry(limit int) *ConnectionRegistry {
+	return &ConnectionRegistry{
+		conns:   make(map[uint64]*Connection),
+		perUser: make(map[uint]int),
+		limit:   limit,
+	}
+}
+
+// Register adds a connection for state and sets state.Conn, allowing the user
+// userLimit connections (zero for unlimited). The connection is removed when
+// state finishes.
+func (r *ConnectionRegistry) Register(state *RequestState, method, clientAddr, target string, userLimit int) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.limit > 0 && len(r.conns) >= r.limit {
+		return ErrConnectionLimit
+	}
+	if state.User != nil && userLimit > 0 && r.perUser[state.User.ID] >= userLimit {
+		return ErrUserConnectionLimit
+	}
+
+	r.next++
+	conn := &Connection{
+		ID:         r.next,
+		ClientAddr: clientAddr,
+		Method:     method,
+		Target:     target,
+		Start:      state.Start,
+		user:       state.User,
+		sent:       state.requestCount,
+	}
+	if state.User != nil {
+		userID := state.User.ID
+		conn.UserID = &userID
+		conn.Username = state.User.Username
+		r.perUser[userID]++
+	}
+	r.conns[conn.ID] = conn
+
+	state.Conn = conn
+	state.OnFinish(func() { r.remove(conn) })
+	return nil
+}
+
+func (r *ConnectionRegistry) remove(conn *Connection) {
+	r.mutex.Lock()
+	if _, exists := r.conns[conn.ID]; !exists {
+		r.mutex.Unlock()
+		return
+	}
+	delete(r.conns, conn.ID)
+	if conn.UserID != nil {
+		r.perUser[*conn.UserID]--
+		if r.perUser[*conn.UserID] <= 0 {
+			delete(r.perUser, *conn.UserID)
+		}
+	}
+	onRemove := r.onRemove
+	r.mutex.Unlock()
+
+	if onRemove != nil {
+		onRemove(conn)
+	}
+}
+
+// live returns the connections open at the moment.
+func (r *ConnectionRegistry) live() []*Connection {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	conns := make([]*Connection, 0, len(r.conns))
+	for _, conn := range r.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// List returns the live connections, oldest first.
+func (r *ConnectionRegistry) List() []ConnectionInfo {
+	conns := r.live()
+	infos := make([]ConnectionInfo, 0, len(conns))
+	for _, conn := range conns {
+		infos = append(infos, conn.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// Kill closes the connection with id and reports whether it was found.
+func (r *ConnectionRegistry) Kill(id uint64) bool {
+	r.mutex.Lock()
+	conn, exists := r.conns[id]
+	r.mutex.Unlock()
+
+	if !exists {
+		return false
+	}
+	conn.kill(CloseKilled)
+	return true
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/zulkan/zulgoproxy/models"
+)
+
+func TestConnectionRegistryCaps(t *testing.T) {
+	registry := NewConnectionRegistry(3)
+	users := map[string]*models.User{
+		"alice": {ID: 1, Username: "alice"},
+		"bob":   {ID: 2, Username: "bob"},
+		"":      nil, // anonymous
+	}
+	const userLimit = 2
+
+	var open []*RequestState
+	register := func(username string) (*RequestState, error) {
+		state := NewRequestState(users[username])
+		err := registry.Register(state, "CONNECT", "192.0.2.10:40000", "example.test:443", userLimit)
+		if err == nil {
+			open = append(open, state)
+		}
+		return state, err
+	}
+	steps := []struct {
+		name     string
+		username string
+		finish   int // index in open of a connection to finish first, -1 for none
+		want     error
+	}{
+		{"first for alice", "alice", -1, nil},
+		{"second for alice", "alice", -1, nil},
+		{"alice over her cap", "alice", -1, ErrUserConnectionLimit},
+		{"bob under his cap", "bob", -1, nil},
+		{"bob over the global cap", "bob", -1, ErrConnectionLimit},
+		{"anonymous over the global cap", "", -1, ErrConnectionLimit},
+		{"alice again after one of hers finished", "alice", 0, nil},
+		{"global cap still full", "bob", -1, ErrConnectionLimit},
+		{"finishing twice frees one slot", "bob", 0, ErrConnectionLimit},
+		{"bob after his finished", "bob", 2, nil},
+		{"bob at his cap", "bob", 1, nil},
+		{"bob over his cap with room globally", "bob", 3, ErrUserConnectionLimit},
+		{"anonymous is only globally capped", "", -1, nil},
+	}
+
+	for _, step := range steps {
+		if step.finish >= 0 {
+			open[step.finish].Finish()
+		}
+		if _, err := register(step.username); err != step.want {
+			t.Fatalf("%s: Register = %v, want %v", step.name, err, step.want)
+		}
+	}
+
+	live := registry.List()
+	if len(live) != 3 {
+		t.Fatalf("%d live connections, want 3", len(live))
+	}
+	for _, state := range open {
+		state.Finish()
+	}
+	if live := registry.List(); len(live) != 0 {
+		t.Errorf("%d connections left after all finished", len(live))
+	}
+	if len(registry.perUser) != 0 {
+		t.Errorf("per-user counts left behind: %v", registry.perUser)
+	}
+}
+
+func TestConnectionRegistryUnlimited(t *testing.T) {
+	registry := NewConnectionRegistry(0)
+	user := &models.User{ID: 1, Username: "alice"}
+	for i := 0; i < 100; i++ {
+		state := NewRequestState(user)
+		if err := registry.Register(state, "GET", "192.0.2.10:40000", "example.test", 0); err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+		if state.Conn == nil || state.Conn.Username != "alice" {
+			t.Fatalf("connection %d: state.Conn = %+v", i, state.Conn)
+		}
+	}
+}
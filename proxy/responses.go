@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zulkan/zulgoproxy/models"
+)
+
+// BlockedResponse answers a request denied by rule.
+func BlockedResponse(req *http.Request, host string, rule *models.Rule) *http.Response {
+	reason := fmt.Sprintf("Access to %s is blocked by proxy rule %d (%s)", Hostname(host), rule.ID, rule.Name)
+	return errorPages.Response(req, models.OutcomeBlocked, http.StatusForbidden, reason)
+}
+
+// PolicyDeniedResponse answers a request refused by the user's access policy.
+func PolicyDeniedResponse(req *http.Request, host string, policy *models.Policy, reason string) *http.Response {
+	reason = fmt.Sprintf("Access to %s is denied by policy %d (%s): %s", Hostname(host), policy.ID, policy.Name, reason)
+	return errorPages.Response(req, models.OutcomeBlocked, http.StatusForbidden, reason)
+}
+
+// DestinationDeniedResponse answers a request for an internal destination.
+func DestinationDeniedResponse(req *http.Request, host string, reason string) *http.Response {
+	reason = fmt.Sprintf("Access to %s is denied: %s", Hostname(host), reason)
+	return errorPages.Response(req, models.OutcomeBlocked, http.StatusForbidden, reason)
+}
+
+// PortDeniedResponse answers a CONNECT to a port outside the allowed list.
+func PortDeniedResponse(req *http.Request, host string, reason string, ports []int) *http.Response {
+	allowed := make([]string, len(ports))
+	for i, port := range ports {
+		allowed[i] = strconv.Itoa(port)
+	}
+	reason = fmt.Sprintf("Access to %s is denied: %s. Tunnels may only use ports %s", host, reason, strings.Join(allowed, ", "))
+	return errorPages.Response(req, models.OutcomeBlocked, http.StatusForbidden, reason)
+}
+
+// AuthRequiredResponse asks the client for proxy credentials.
+func AuthRequiredResponse(req *http.Request, realm string) *http.Response {
+	resp := errorPages.Response(req, models.OutcomeAuthRequired, http.StatusProxyAuthRequired, "This proxy requires a username and password")
+	resp.Header.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	return resp
+}
+
+// QuotaExceededResponse answers a request from a user whose traffic quota is
+// used up.
+func QuotaExceededResponse(req *http.Request, reason string) *http.Response {
+	reason = fmt.Sprintf("Traffic quota exceeded: %s", reason)
+	return errorPages.Response(req, models.OutcomeQuotaExceeded, http.StatusForbidden, reason)
+}
+
+// ConnectionLimitResponse answers a request over the user's concurrency cap.
+func ConnectionLimitResponse(req *http.Request, limit int) *http.Response {
+	reason := fmt.Sprintf("Too many concurrent connections (limit %d)", limit)
+	return errorPages.Response(req, models.OutcomeConnectionLimit, http.StatusTooManyRequests, reason)
+}
+
+// ServerBusyResponse answers a request over the proxy-wide concurrency cap.
+func ServerBusyResponse(req *http.Request) *http.Response {
+	return errorPages.Response(req, models.OutcomeConnectionLimit, http.StatusServiceUnavailable, "The proxy is at its connection limit, try again later")
+}
+
+// UpstreamErrorResponse answers a request that could not be forwarded to host
+// because of err, telling name resolution failures apart.
+func UpstreamErrorResponse(req *http.Request, host string, err error) *http.Response {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		reason := fmt.Sprintf("Could not resolve %s: %s", dnsErr.Name, dnsErr.Err)
+		return errorPages.Response(req, models.OutcomeDNSFailure, http.StatusBadGateway, reason)
+	}
+	reason := fmt.Sprintf("Could not connect to %s: %v", host, err)
+	return errorPages.Response(req, models.OutcomeUpstreamUnreachable, http.StatusBadGateway, reason)
+}
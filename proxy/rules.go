@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/zulkan/zulgoproxy/database"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+)
+
+// RuleEngine evaluates destination rules. Rules are kept in memory and
+// reloaded whenever they change through the API.
+type RuleEngine struct {
+	rules    []compiledRule
+	onReload []func()
+	mutex    sync.RWMutex
+}
+
+type compiledRule struct {
+	rule   models.Rule
+	regex  *regexp.Regexp
+	subnet *net.IPNet
+}
+
+func NewRuleEngine() *RuleEngine {
+	return &RuleEngine{}
+}
+
+// Reload replaces the in-memory rules with the active rules in the database.
+func (e *RuleEngine) Reload() error {
+	var rules []models.Rule
+	if err := database.GetDB().Where("is_active = ?", true).Find(&rules).Error; err != nil {
+		return fmt.Errorf("failed to load rules: %w", err)
+	}
+	e.load(rules)
+	return nil
+}
+
+// load puts rules in effect. They are evaluated by ascending priority, ties
+// going to the older rule.
+func (e *RuleEngine) load(rules []models.Rule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority < rules[j].Priority
+		}
+		return rules[i].ID < rules[j].ID
+	})
+
+	compiled := make([]compiledRule, 0, len(rules))
+	for _, rule := range rules {
+		c, err := compileRule(rule)
+		if err != nil {
+			logger.Warn("Skipping invalid rule %d (%s): %v", rule.ID, rule.Name, err)
+			continue
+		}
+		compiled = append(compiled, c)
+	}
+
+	e.mutex.Lock()
+	e.rules = compiled
+	hooks := e.onReload
+	e.mutex.Unlock()
+
+	logger.Info("Loaded %d destination rules", len(compiled))
+	for _, f := range hooks {
+		f()
+	}
+}
+
+// OnReload registers f to run after the rules are reloaded, e.g. to rebuild
+// anything derived from them.
+func (e *RuleEngine) OnReload(f func()) {
+	e.mutex.Lock()
+	e.onReload = append(e.onReload, f)
+	e.mutex.Unlock()
+}
+
+// ValidateRule checks that a rule's type, action and pattern are usable.
+func ValidateRule(rule models.Rule) error {
+	_, err := compileRule(rule)
+	return err
+}
+
+func compileRule(rule models.Rule) (compiledRule, error) {
+	c := compiledRule{rule: rule}
+
+	if rule.Action != models.RuleActionAllow && rule.Action != models.RuleActionDeny {
+		return c, fmt.Errorf("unknown action %q", rule.Action)
+	}
+
+	switch rule.Type {
+	case models.RuleTypeExact, models.RuleTypeWildcard:
+	case models.RuleTypeRegex:
+		regex, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return c, fmt.Errorf("invalid regex: %w", err)
+		}
+		c.regex = regex
+	case models.RuleTypeCIDR:
+		_, subnet, err := net.ParseCIDR(rule.Pattern)
+		if err != nil {
+			return c, fmt.Errorf("invalid CIDR: %w", err)
+		}
+		c.subnet = subnet
+	default:
+		return c, fmt.Errorf("unknown rule type %q", rule.Type)
+	}
+
+	return c, nil
+}
+
+// Evaluate returns the first rule matching the destination, or nil. host is
+// the target host[:port]; rawURL is the full request URL, or the CONNECT
+// target when the URL is not visible.
+func (e *RuleEngine) Evaluate(host, rawURL string) *models.Rule {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	hostname := Hostname(host)
+	for i := range e.rules {
+		if e.rules[i].matches(hostname, rawURL) {
+			rule := e.rules[i].rule
+			return &rule
+		}
+	}
+	return nil
+}
+
+func (c *compiledRule) matches(hostname, rawURL string) bool {
+	switch c.rule.Type {
+	case models.RuleTypeExact:
+		return strings.EqualFold(c.rule.Pattern, hostname)
+	case models.RuleTypeWildcard:
+		return MatchHost(c.rule.Pattern, hostname)
+	case models.RuleTypeRegex:
+		return c.regex.MatchString(rawURL)
+	case models.RuleTypeCIDR:
+		ip := net.ParseIP(hostname)
+		return ip != nil && c.subnet.Contains(ip)
+	}
+	return false
+}
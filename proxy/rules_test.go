@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/zulkan/zulgoproxy/models"
+)
+
+func TestRuleEngineEvaluate(t *testing.T) {
+	rule := func(id uint, priority int, typ, pattern, action string) models.Rule {
+		return models.Rule{ID: id, Name: pattern, Type: typ, Pattern: pattern, Action: action, Priority: priority, IsActive: true}
+	}
+	// Loaded out of order; evaluation follows priority, then ID
+	engine := NewRuleEngine()
+	engine.load([]models.Rule{
+		rule(1, 100, models.RuleTypeWildcard, "*.example.com", models.RuleActionDeny),
+		rule(2, 10, models.RuleTypeExact, "www.example.com", models.RuleActionAllow),
+		rule(3, 50, models.RuleTypeCIDR, "10.0.0.0/8", models.RuleActionDeny),
+		rule(4, 40, models.RuleTypeCIDR, "10.1.0.0/16", models.RuleActionAllow),
+		rule(5, 60, models.RuleTypeRegex, `^https?://[^/]+/admin(/|$)`, models.RuleActionDeny),
+		rule(7, 70, models.RuleTypeExact, "tie.example.org", models.RuleActionDeny),
+		rule(6, 70, models.RuleTypeExact, "tie.example.org", models.RuleActionAllow),
+		rule(8, 80, models.RuleTypeCIDR, "2001:db8::/32", models.RuleActionDeny),
+		rule(9, 0, "glob", "*", models.RuleActionDeny), // invalid, skipped
+	})
+
+	tests := []struct {
+		name   string
+		host   string
+		rawURL string
+		want   uint // matching rule ID, 0 for none
+	}{
+		{"exact beats a later wildcard", "www.example.com:443", "www.example.com:443", 2},
+		{"exact is case-insensitive", "WWW.Example.com", "http://WWW.Example.com/", 2},
+		{"wildcard matches subdomains", "api.example.com", "https://api.example.com/", 1},
+		{"wildcard matches the apex", "example.com", "http://example.com/", 1},
+		{"wildcard is anchored at a dot", "badexample.com", "http://badexample.com/", 0},
+		{"exact does not match subdomains", "a.www.example.com", "http://a.www.example.com/", 1},
+		{"narrower CIDR with higher priority", "10.1.2.3:8080", "http://10.1.2.3:8080/", 4},
+		{"wider CIDR", "10.2.0.1", "http://10.2.0.1/", 3},
+		{"CIDR ignores names", "ten.example.net", "http://ten.example.net/", 0},
+		{"IPv6 CIDR", "[2001:db8::5]:443", "[2001:db8::5]:443", 8},
+		{"IPv6 CIDR without a port", "[2001:db8::5]", "http://[2001:db8::5]/", 8},
+		{"regex on the URL", "intranet.example.net", "https://intranet.example.net/admin/users", 5},
+		{"regex misses other paths", "intranet.example.net", "https://intranet.example.net/administrator", 0},
+		{"equal priority goes to the lower ID", "tie.example.org", "http://tie.example.org/", 6},
+		{"no rule matches", "example.net", "http://example.net/", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got uint
+			if rule := engine.Evaluate(tt.host, tt.rawURL); rule != nil {
+				got = rule.ID
+			}
+			if got != tt.want {
+				t.Errorf("Evaluate(%q, %q) matched rule %d, want %d", tt.host, tt.rawURL, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRule(t *testing.T) {
+	tests := []struct {
+		rule  models.Rule
+		valid bool
+	}{
+		{models.Rule{Type: models.RuleTypeExact, Pattern: "example.com", Action: models.RuleActionAllow}, true},
+		{models.Rule{Type: models.RuleTypeRegex, Pattern: "(", Action: models.RuleActionDeny}, false},
+		{models.Rule{Type: models.RuleTypeCIDR, Pattern: "10.0.0.0", Action: models.RuleActionDeny}, false},
+		{models.Rule{Type: models.RuleTypeExact, Pattern: "example.com", Action: "block"}, false},
+		{models.Rule{Type: "glob", Pattern: "*", Action: models.RuleActionDeny}, false},
+	}
+	for _, tt := range tests {
+		if err := ValidateRule(tt.rule); (err == nil) != tt.valid {
+			t.Errorf("ValidateRule(%+v) = %v, want valid %v", tt.rule, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// TokenBucket limits throughput to rate bytes per second, allowing bursts of
+// up to one second's worth.
+type TokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+func NewTokenBucket(rate int64) *TokenBucket {
+	return &TokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Wait takes n tokens, sleeping until the bucket has refilled enough.
+func (b *TokenBucket) Wait(n int) {
+	time.Sleep(b.take(n, time.Now()))
+}
+
+// take refills the bucket up to now, takes n tokens and returns how long
+// until the bucket is out of debt again.
+func (b *TokenBucket) take(n int, now time.Time) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// readChunk keeps single reads small enough for the bucket to pace them.
+func (b *TokenBucket) readChunk(p []byte) []byte {
+	if max := int(b.rate); max > 0 && len(p) > max {
+		return p[:max]
+	}
+	return p
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	bucket *TokenBucket
+}
+
+// ThrottleReader limits reads from rc to rate bytes per second. A rate of zero
+// or less returns rc unchanged.
+func ThrottleReader(rc io.ReadCloser, rate int64) io.ReadCloser {
+	if rate <= 0 {
+		return rc
+	}
+	return &throttledReader{ReadCloser: rc, bucket: NewTokenBucket(rate)}
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(r.bucket.readChunk(p))
+	r.bucket.Wait(n)
+	return n, err
+}
+
+type throttledConn struct {
+	net.Conn
+	bucket *TokenBucket
+}
+
+// ThrottleConn limits reads from conn to rate bytes per second. A rate of zero
+// or less returns conn unchanged.
+func ThrottleConn(conn net.Conn, rate int64) net.Conn {
+	if rate <= 0 {
+		return conn
+	}
+	return &throttledConn{Conn: conn, bucket: NewTokenBucket(rate)}
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(c.bucket.readChunk(p))
+	c.bucket.Wait(n)
+	return n, err
+}
+
+func (c *throttledConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
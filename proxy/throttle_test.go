@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/models"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	type step struct {
+		after time.Duration // since the previous step
+		take  int
+		want  time.Duration
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"full bucket covers one second's burst", []step{
+			{0, 100, 0},
+			{0, 1, 10 * time.Millisecond},
+		}},
+		{"refills at the rate", []step{
+			{0, 100, 0},
+			{500 * time.Millisecond, 50, 0},
+			{0, 10, 100 * time.Millisecond},
+		}},
+		{"idle refill is capped at the burst", []step{
+			{10 * time.Second, 150, 500 * time.Millisecond},
+		}},
+		{"debt accumulates", []step{
+			{0, 200, time.Second},
+			{0, 100, 2 * time.Second},
+		}},
+		{"waiting repays the debt", []step{
+			{0, 200, time.Second},
+			{time.Second, 0, 0},
+			{0, 100, time.Second},
+		}},
+		{"partial refill", []step{
+			{0, 100, 0},
+			{250 * time.Millisecond, 100, 750 * time.Millisecond},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := NewTokenBucket(100)
+			now := bucket.last
+			for i, s := range tt.steps {
+				now = now.Add(s.after)
+				got := bucket.take(s.take, now)
+				if diff := got - s.want; diff < -time.Millisecond || diff > time.Millisecond {
+					t.Errorf("step %d: take(%d) waits %v, want %v", i, s.take, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketWaitBlocks(t *testing.T) {
+	bucket := NewTokenBucket(1000)
+
+	start := time.Now()
+	bucket.Wait(1000)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("a full burst waited %v", elapsed)
+	}
+
+	start = time.Now()
+	bucket.Wait(250)
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("waited %v for 250 tokens at 1000/s, want about 250ms", elapsed)
+	}
+}
+
+func TestThrottleConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	if ThrottleConn(server, 0) != server {
+		t.Fatal("a zero rate should leave the connection unthrottled")
+	}
+
+	payload := bytes.Repeat([]byte("x"), 3000)
+	go func() {
+		client.Write(payload)
+		client.Close()
+	}()
+
+	// 2000 bytes of burst, then 1000 more at 2000 bytes per second
+	start := time.Now()
+	got, err := io.ReadAll(ThrottleConn(server, 2000))
+	elapsed := time.Since(start)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("read %d bytes (%v), want %d", len(got), err, len(payload))
+	}
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("read took %v, want about 500ms", elapsed)
+	}
+}
+
+func newTestUsageTracker() *UsageTracker {
+	return &UsageTracker{
+		daily:   make(map[uint]int64),
+		monthly: make(map[uint]int64),
+		pending: make(map[usageKey]int64),
+	}
+}
+
+func TestUsageTrackerCheck(t *testing.T) {
+	user := &models.User{ID: 7, Username: "alice"}
+	tests := []struct {
+		name   string
+		used   int64
+		policy *models.Policy
+		want   string // substring of the reason, "" when allowed
+	}{
+		{"no policy", 5000, nil, ""},
+		{"no quotas", 5000, &models.Policy{}, ""},
+		{"under daily quota", 999, &models.Policy{DailyQuota: 1000}, ""},
+		{"daily quota reached", 1000, &models.Policy{DailyQuota: 1000}, "daily quota"},
+		{"under monthly quota", 999, &models.Policy{MonthlyQuota: 1000}, ""},
+		{"monthly quota reached", 1500, &models.Policy{MonthlyQuota: 1000}, "monthly quota"},
+		{"daily reported first", 1500, &models.Policy{DailyQuota: 1000, MonthlyQuota: 1000}, "daily quota"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newTestUsageTracker()
+			tracker.Add(user.ID, tt.used)
+			got := tracker.Check(user, tt.policy)
+			if (tt.want == "") != (got == "") || !strings.Contains(got, tt.want) {
+				t.Errorf("Check = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if got := newTestUsageTracker().Check(nil, &models.Policy{DailyQuota: 1}); got != "" {
+		t.Errorf("Check without a user = %q", got)
+	}
+}
+
+func TestQuotaClosesLiveSession(t *testing.T) {
+	tracker := newTestUsageTracker()
+	registry := NewConnectionRegistry(0)
+	policy := &models.Policy{DailyQuota: 1500}
+	policyFor := func(*models.User) *models.Policy { return policy }
+	tracker.Meter(registry, policyFor)
+
+	user := &models.User{ID: 7, Username: "alice"}
+	state := NewRequestState(user)
+	if err := registry.Register(state, "CONNECT", "192.0.2.10:40000", "example.test:443", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	clientApp, clientSide := net.Pipe()
+	targetSide, targetApp := net.Pipe()
+	defer clientApp.Close()
+	defer targetApp.Close()
+	go io.Copy(io.Discard, targetApp)
+
+	entry := &models.ProxyLog{}
+	done := make(chan struct{})
+	go func() {
+		Pipe(clientSide, targetSide, entry, state.Conn)
+		state.Finish()
+		close(done)
+	}()
+
+	// Write returns once Pipe has the bytes, possibly before it counts them
+	sent := func(n int64) {
+		t.Helper()
+		clientApp.Write(make([]byte, 1000))
+		deadline := time.Now().Add(5 * time.Second)
+		for registry.List()[0].BytesSent != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("connection shows %d bytes sent, want %d", registry.List()[0].BytesSent, n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	sent(1000)
+	tracker.meterLive(registry, policyFor)
+	if state.Conn.Killed() {
+		t.Fatal("session closed while under its quota")
+	}
+
+	sent(2000)
+	tracker.meterLive(registry, policyFor)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session still open after exhausting its quota")
+	}
+
+	if entry.CloseReason != CloseQuotaExceeded {
+		t.Errorf("close reason %q, want %q", entry.CloseReason, CloseQuotaExceeded)
+	}
+	if daily, monthly := tracker.Usage(user.ID); daily != 2000 || monthly != 2000 {
+		t.Errorf("usage = %d daily, %d monthly, want 2000", daily, monthly)
+	}
+	if len(registry.List()) != 0 {
+		t.Error("closed session still listed")
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+)
+
+// Reasons a CONNECT tunnel or WebSocket session ended, stored in
+// ProxyLog.CloseReason
+const (
+	CloseClientClosed   = "client_closed"
+	CloseUpstreamClosed = "upstream_closed"
+	CloseClientError    = "client_error"
+	CloseUpstreamError  = "upstream_error"
+	CloseDialFailed     = "dial_failed"
+	CloseKilled         = "killed" // closed from the live connection table
+	CloseIdleTimeout    = "idle_timeout"
+	CloseQuotaExceeded  = "quota_exceeded" // the user ran out of quota mid-session
+)
+
+// ConnectTunnel returns the action for an accepted CONNECT to host, reached
+// with dial. The tunnel is hijacked so its traffic can be measured, and its
+// ProxyLog row is written when the tunnel closes.
+func ConnectTunnel(host string, dial DialFunc) *goproxy.ConnectAction {
+	return &goproxy.ConnectAction{
+		Action: goproxy.ConnectHijack,
+		Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+			serveTunnel(host, dial, client, ctx)
+		},
+	}
+}
+
+func serveTunnel(host string, dial DialFunc, client net.Conn, ctx *goproxy.ProxyCtx) {
+	defer client.Close()
+
+	state := StateFrom(ctx)
+	if state == nil {
+		state = NewRequestState(nil)
+	}
+	defer state.Finish()
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
+	}
+	entry := state.LogEntry(ctx.Req)
+	entry.Host = host
+
+	target, err := dial(WithState(context.Background(), state), "tcp", host)
+	entry.DNSDuration = state.DNSTime().Milliseconds()
+	if err != nil {
+		logger.Warn("CONNECT to %s failed: %v", host, err)
+		UpstreamErrorResponse(ctx.Req, host, err).Write(client)
+		entry.StatusCode = http.StatusBadGateway
+		entry.CloseReason = CloseDialFailed
+		Record(entry)
+		return
+	}
+	defer target.Close()
+	entry.EgressAddr = LocalIP(target)
+
+	if _, err := io.WriteString(client, "HTTP/1.0 200 OK\r\n\r\n"); err != nil {
+		entry.StatusCode = http.StatusBadGateway
+		entry.CloseReason = CloseClientError
+		Record(entry)
+		return
+	}
+	entry.StatusCode = http.StatusOK
+
+	Pipe(ThrottleConn(client, state.BandwidthLimit), ThrottleConn(target, state.BandwidthLimit), entry, state.Conn)
+	logger.Debug("Tunnel to %s closed (%s): sent=%d received=%d",
+		host, entry.CloseReason, entry.BytesSent, entry.BytesReceived)
+	Record(entry)
+}
+
+// Pipe copies between client and target until both directions are done and
+// fills in the byte counts and close reason of entry. live, if not nil, shows
+// the traffic so far and can close both connections.
+func Pipe(client, target net.Conn, entry *models.ProxyLog, live *Connection) {
+	downstream := NewCountingConn(client)
+	upstream := NewCountingConn(target)
+	live.SetCounters(downstream.BytesRead, downstream.BytesWritten)
+	live.SetCloser(func() {
+		client.Close()
+		target.Close()
+	})
+
+	// The first direction to finish decides why the tunnel closed
+	var once sync.Once
+	closedBy := func(reason string) {
+		once.Do(func() { entry.CloseReason = reason })
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(upstream, downstream)
+		switch {
+		case err == nil:
+			closedBy(CloseClientClosed)
+		case downstream.ReadErr() != nil:
+			closedBy(CloseClientError)
+		default:
+			closedBy(CloseUpstreamError)
+		}
+		upstream.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(downstream, upstream)
+		switch {
+		case err == nil:
+			closedBy(CloseUpstreamClosed)
+		case upstream.ReadErr() != nil:
+			closedBy(CloseUpstreamError)
+		default:
+			closedBy(CloseClientError)
+		}
+		downstream.CloseWrite()
+	}()
+	wg.Wait()
+
+	if reason := live.CloseReason(); reason != "" {
+		entry.CloseReason = reason
+	}
+	entry.RequestSize = downstream.BytesRead()
+	entry.ResponseSize = downstream.BytesWritten()
+	entry.BytesSent = upstream.BytesWritten()
+	entry.BytesReceived = upstream.BytesRead()
+}
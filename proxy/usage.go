@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/database"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	usageFlushInterval = 30 * time.Second
+	usageMeterInterval = 5 * time.Second
+)
+
+type usageKey struct {
+	userID uint
+	date   string
+}
+
+// UsageTracker counts the bytes each proxy user moves so daily and monthly
+// quotas can be enforced. Traffic is metered from the live connection table
+// while it flows, so long tunnels and sessions count before they close.
+// Totals are kept in memory and written to the database periodically, so
+// they survive restarts.
+type UsageTracker struct {
+	day     string
+	month   string
+	daily   map[uint]int64
+	monthly map[uint]int64
+	pending map[usageKey]int64
+	mutex   sync.Mutex
+}
+
+// NewUsageTracker loads the current day's and month's totals.
+func NewUsageTracker() (*UsageTracker, error) {
+	t := &UsageTracker{
+		daily:   make(map[uint]int64),
+		monthly: make(map[uint]int64),
+		pending: make(map[usageKey]int64),
+	}
+	if err := t.load(time.Now()); err != nil {
+		return nil, err
+	}
+
+	go t.flushLoop()
+
+	return t, nil
+}
+
+type usageTotal struct {
+	UserID uint
+	Bytes  int64
+}
+
+func (t *UsageTracker) load(now time.Time) error {
+	t.day = now.Format("2006-01-02")
+	t.month = now.Format("2006-01")
+
+	var totals []usageTotal
+	if err := database.GetDB().Model(&models.Usage{}).
+		Select("user_id, SUM(bytes) AS bytes").
+		Where("date LIKE ?", t.month+"-%").
+		Group("user_id").
+		Scan(&totals).Error; err != nil {
+		return fmt.Errorf("failed to load monthly usage: %w", err)
+	}
+	for _, total := range totals {
+		t.monthly[total.UserID] = total.Bytes
+	}
+
+	var today []models.Usage
+	if err := database.GetDB().Where("date = ?", t.day).Find(&today).Error; err != nil {
+		return fmt.Errorf("failed to load daily usage: %w", err)
+	}
+	for _, usage := range today {
+		t.daily[usage.UserID] = usage.Bytes
+	}
+	return nil
+}
+
+// rollover resets the counters when the day or month changes. Pending bytes
+// keep their own date. The caller holds the mutex.
+func (t *UsageTracker) rollover(now time.Time) {
+	if day := now.Format("2006-01-02"); day != t.day {
+		t.day = day
+		t.daily = make(map[uint]int64)
+	}
+	if month := now.Format("2006-01"); month != t.month {
+		t.month = month
+		t.monthly = make(map[uint]int64)
+	}
+}
+
+// Add counts bytes moved by userID.
+func (t *UsageTracker) Add(userID uint, bytes int64) {
+	if bytes <= 0 {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.rollover(time.Now())
+	t.daily[userID] += bytes
+	t.monthly[userID] += bytes
+	t.pending[usageKey{userID: userID, date: t.day}] += bytes
+}
+
+// Meter counts the traffic of registry's connections towards their users'
+// usage: every few seconds while they are open, and the rest when they
+// finish. Connections of a user who exhausts a quota of the policy returned
+// by policyFor are closed.
+func (t *UsageTracker) Meter(registry *ConnectionRegistry, policyFor func(user *models.User) *models.Policy) {
+	registry.mutex.Lock()
+	registry.onRemove = t.meter
+	registry.mutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(usageMeterInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			t.meterLive(registry, policyFor)
+		}
+	}()
+}
+
+func (t *UsageTracker) meter(conn *Connection) {
+	if conn.UserID != nil {
+		t.Add(*conn.UserID, conn.unmetered())
+	}
+}
+
+func (t *UsageTracker) meterLive(registry *ConnectionRegistry, policyFor func(user *models.User) *models.Policy) {
+	conns := registry.live()
+	for _, conn := range conns {
+		t.meter(conn)
+	}
+
+	// Users are checked once per round, after all their traffic is counted
+	reasons := make(map[uint]string)
+	for _, conn := range conns {
+		if conn.user == nil {
+			continue
+		}
+		reason, checked := reasons[conn.user.ID]
+		if !checked {
+			reason = t.Check(conn.user, policyFor(conn.user))
+			reasons[conn.user.ID] = reason
+		}
+		if reason != "" {
+			logger.Info("Closing %s %s of %s: %s", conn.Method, conn.Target, conn.Username, reason)
+			conn.kill(CloseQuotaExceeded)
+		}
+	}
+}
+
+// Usage returns userID's bytes for the current day and month.
+func (t *UsageTracker) Usage(userID uint) (daily, monthly int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.rollover(time.Now())
+	return t.daily[userID], t.monthly[userID]
+}
+
+// Check returns a reason when user has exhausted a quota of policy.
+func (t *UsageTracker) Check(user *models.User, policy *models.Policy) string {
+	if user == nil || policy == nil || (policy.DailyQuota <= 0 && policy.MonthlyQuota <= 0) {
+		return ""
+	}
+
+	daily, monthly := t.Usage(user.ID)
+	if policy.DailyQuota > 0 && daily >= policy.DailyQuota {
+		return fmt.Sprintf("daily quota of %s exhausted (used %s, resets at midnight)",
+			FormatBytes(policy.DailyQuota), FormatBytes(daily))
+	}
+	if policy.MonthlyQuota > 0 && monthly >= policy.MonthlyQuota {
+		return fmt.Sprintf("monthly quota of %s exhausted (used %s, resets on the 1st)",
+			FormatBytes(policy.MonthlyQuota), FormatBytes(monthly))
+	}
+	return ""
+}
+
+func (t *UsageTracker) flushLoop() {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.Flush()
+	}
+}
+
+// Flush writes pending usage to the database. Rows that fail are kept for
+// the next attempt.
+func (t *UsageTracker) Flush() {
+	t.mutex.Lock()
+	pending := t.pending
+	t.pending = make(map[usageKey]int64)
+	t.mutex.Unlock()
+
+	for key, bytes := range pending {
+		usage := models.Usage{UserID: key.userID, Date: key.date, Bytes: bytes}
+		err := database.GetDB().Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "user_id"}, {Name: "date"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"bytes":      gorm.Expr("usages.bytes + excluded.bytes"),
+				"updated_at": time.Now(),
+			}),
+		}).Create(&usage).Error
+		if err != nil {
+			logger.Error("Failed to save usage of user %d: %v", key.userID, err)
+			t.mutex.Lock()
+			t.pending[key] += bytes
+			t.mutex.Unlock()
+		}
+	}
+}
+
+// FormatBytes renders n with a binary unit, e.g. "1.5 GiB".
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,433 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/logger"
+	"golang.org/x/net/http/httpguts"
+)
+
+// WebSocket status codes (RFC 6455 section 7.4.1)
+const (
+	closeGoingAway = 1001 // sent to both sides of an idle session
+	closeNoStatus  = 1005 // recorded for a Close frame without a status
+)
+
+// webSocketUpgrade carries an upgrade request through goproxy, which would
+// otherwise proxy it itself, bypassing the transport and its checks.
+type webSocketUpgrade struct {
+	protocol string        // the Upgrade header hidden from goproxy
+	state    *RequestState // set once the destination switched protocols
+	req      *http.Request
+	conn     net.Conn // to the destination
+}
+
+type upgradeKey struct{}
+
+// IsWebSocketUpgrade reports whether req asks to switch to the WebSocket
+// protocol.
+func IsWebSocketUpgrade(req *http.Request) bool {
+	return req.Method == http.MethodGet &&
+		httpguts.HeaderValuesContainsToken(req.Header["Connection"], "upgrade") &&
+		httpguts.HeaderValuesContainsToken(req.Header["Upgrade"], "websocket")
+}
+
+// HandleWebSockets wraps the proxy handler so WebSocket upgrades go through
+// the same checks and transport as other requests, forwarded by a
+// WebSocketTransport. Once the destination switches protocols the session is
+// relayed here, counting its messages, and logged when it closes.
+func HandleWebSockets(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !IsWebSocketUpgrade(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		upgrade := &webSocketUpgrade{protocol: req.Header.Get("Upgrade")}
+		req.Header.Del("Upgrade")
+		req = req.WithContext(context.WithValue(req.Context(), upgradeKey{}, upgrade))
+
+		writer := &upgradeWriter{ResponseWriter: w, upgrade: upgrade}
+		next.ServeHTTP(writer, req)
+		if writer.switched {
+			upgrade.serve(w)
+		}
+	})
+}
+
+// upgradeWriter holds back the 101 response goproxy writes, as the session
+// takes over the client connection instead. Refusals and errors pass
+// through.
+type upgradeWriter struct {
+	http.ResponseWriter
+	upgrade  *webSocketUpgrade
+	switched bool
+}
+
+func (w *upgradeWriter) WriteHeader(status int) {
+	if status == http.StatusSwitchingProtocols && w.upgrade.conn != nil {
+		w.switched = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *upgradeWriter) Write(p []byte) (int, error) {
+	if w.switched {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// WebSocketTransport sends the upgrades marked by HandleWebSockets through
+// upgrades, which must not cache, and every other request through next.
+type WebSocketTransport struct {
+	next     http.RoundTripper
+	upgrades http.RoundTripper
+}
+
+func NewWebSocketTransport(next, upgrades http.RoundTripper) *WebSocketTransport {
+	return &WebSocketTransport{next: next, upgrades: upgrades}
+}
+
+func (t *WebSocketTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	upgrade, _ := req.Context().Value(upgradeKey{}).(*webSocketUpgrade)
+	if upgrade == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	// goproxy drops Connection as a hop-by-hop header
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", upgrade.protocol)
+
+	var conn net.Conn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn = info.Conn
+		},
+	}
+	resp, err := t.upgrades.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		return resp, err
+	}
+
+	body, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok || conn == nil {
+		resp.Body.Close()
+		return nil, errors.New("destination switched protocols without a usable connection")
+	}
+	upgrade.state = StateFromContext(req.Context())
+	upgrade.req = req
+	upgrade.conn = &upgradedConn{Conn: conn, body: body}
+	resp.Body = http.NoBody
+	return resp, nil
+}
+
+// upgradedConn reads and writes through the transport's response body, which
+// holds bytes already buffered from the destination.
+type upgradedConn struct {
+	net.Conn
+	body io.ReadWriteCloser
+}
+
+func (c *upgradedConn) Read(p []byte) (int, error)  { return c.body.Read(p) }
+func (c *upgradedConn) Write(p []byte) (int, error) { return c.body.Write(p) }
+func (c *upgradedConn) Close() error                { return c.body.Close() }
+
+// serve takes over the client connection of w and relays the session until
+// either side closes it or it idles out.
+func (u *webSocketUpgrade) serve(w http.ResponseWriter) {
+	defer u.conn.Close()
+	state := u.state
+	if state == nil {
+		state = NewRequestState(nil)
+	}
+	defer state.Finish()
+	entry := state.LogEntry(u.req)
+	entry.StatusCode = http.StatusSwitchingProtocols
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		logger.Warn("WebSocket to %s cannot take over the client connection", u.req.URL.Host)
+		entry.CloseReason = CloseClientError
+		Record(entry)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		logger.Warn("WebSocket to %s could not take over the client connection: %v", u.req.URL.Host, err)
+		entry.CloseReason = CloseClientError
+		Record(entry)
+		return
+	}
+	defer client.Close()
+
+	buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	w.Header().Write(buffered)
+	buffered.WriteString("\r\n")
+	if err := buffered.Flush(); err != nil {
+		entry.CloseReason = CloseClientError
+		Record(entry)
+		return
+	}
+
+	activity := newActivity()
+	sent := &frameCounter{}
+	received := &frameCounter{}
+	fromClient := &frameConn{Conn: &readerConn{Conn: client, reader: buffered.Reader}, frames: sent, activity: activity}
+	fromServer := &frameConn{Conn: u.conn, frames: received, activity: activity}
+
+	var idled int32
+	if timeout := state.WebSocketIdleTimeout; timeout > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			if activity.waitIdle(timeout, stop) {
+				atomic.StoreInt32(&idled, 1)
+				closeIdleSession(client, u.conn)
+			}
+		}()
+	}
+
+	Pipe(ThrottleConn(fromClient, state.BandwidthLimit), ThrottleConn(fromServer, state.BandwidthLimit), entry, state.Conn)
+	if atomic.LoadInt32(&idled) == 1 && !state.Conn.Killed() {
+		entry.CloseReason = CloseIdleTimeout
+	}
+	entry.WebSocketMessagesSent = sent.Messages()
+	entry.WebSocketMessagesReceived = received.Messages()
+	entry.WebSocketCloseCode = sent.CloseCode()
+	if code := received.CloseCode(); entry.WebSocketCloseCode == 0 || (code != 0 && received.closedFirst(sent)) {
+		entry.WebSocketCloseCode = code
+	}
+	if entry.CloseReason == CloseIdleTimeout && entry.WebSocketCloseCode == 0 {
+		entry.WebSocketCloseCode = closeGoingAway
+	}
+	logger.Debug("WebSocket to %s closed (%s): sent=%d received=%d messages",
+		u.req.URL.Host, entry.CloseReason, entry.WebSocketMessagesSent, entry.WebSocketMessagesReceived)
+	Record(entry)
+}
+
+// closeIdleSession tells both sides the session is going away (status 1001)
+// and closes their connections.
+func closeIdleSession(client, destination net.Conn) {
+	deadline := time.Now().Add(time.Second)
+	client.SetWriteDeadline(deadline)
+	client.Write([]byte{0x88, 0x02, 0x03, 0xe9})
+	// Frames sent to a server must be masked; a zero mask leaves the payload
+	destination.SetWriteDeadline(deadline)
+	destination.Write([]byte{0x88, 0x82, 0, 0, 0, 0, 0x03, 0xe9})
+	client.Close()
+	destination.Close()
+}
+
+// readerConn reads through a reader holding bytes already buffered from the
+// connection.
+type readerConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *readerConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// activity is the time of the last read in either direction of a session.
+type activity struct {
+	last int64 // unix nanoseconds
+}
+
+func newActivity() *activity {
+	return &activity{last: time.Now().UnixNano()}
+}
+
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// waitIdle returns true once nothing was read for timeout, or false when
+// stop is closed first.
+func (a *activity) waitIdle(timeout time.Duration, stop <-chan struct{}) bool {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return false
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&a.last))) >= timeout {
+				return true
+			}
+		}
+	}
+}
+
+// frameConn feeds what is read from a connection to a frameCounter.
+type frameConn struct {
+	net.Conn
+	frames   *frameCounter
+	activity *activity
+}
+
+func (c *frameConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.activity.touch()
+		c.frames.feed(p[:n])
+	}
+	return n, err
+}
+
+func (c *frameConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// frameCounter follows the frames (RFC 6455 section 5.2) in one direction of
+// a session, counting complete data messages and noting the status code of
+// the first Close frame.
+type frameCounter struct {
+	header    [14]byte
+	headerLen int
+	need      int    // header bytes needed; 0 before a frame starts
+	remaining uint64 // payload bytes left in the current frame
+	offset    uint64 // payload bytes seen of the current frame
+	opcode    byte
+	fin       bool
+	mask      []byte
+	status    [2]byte
+
+	messages  int64
+	closeCode int64
+	closedAt  int64 // unix nanoseconds of the first Close frame
+}
+
+func (f *frameCounter) feed(p []byte) {
+	for len(p) > 0 {
+		if f.need == 0 || f.headerLen < f.need {
+			if f.need == 0 {
+				f.need = 2
+			}
+			n := copy(f.header[f.headerLen:f.need], p)
+			f.headerLen += n
+			p = p[n:]
+			if f.headerLen < f.need {
+				return
+			}
+			if f.headerLen == 2 {
+				if f.need = headerSize(f.header[1]); f.need > 2 {
+					continue
+				}
+			}
+			f.startFrame()
+			if f.remaining == 0 {
+				f.endFrame()
+			}
+			continue
+		}
+
+		n := uint64(len(p))
+		if n > f.remaining {
+			n = f.remaining
+		}
+		if f.opcode == 0x8 {
+			for i := uint64(0); i < n && f.offset+i < 2; i++ {
+				b := p[i]
+				if f.mask != nil {
+					b ^= f.mask[(f.offset+i)%4]
+				}
+				f.status[f.offset+i] = b
+			}
+		}
+		f.offset += n
+		f.remaining -= n
+		p = p[n:]
+		if f.remaining == 0 {
+			f.endFrame()
+		}
+	}
+}
+
+// headerSize returns the length of a frame header from its second byte.
+func headerSize(b byte) int {
+	size := 2
+	switch b & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if b&0x80 != 0 {
+		size += 4
+	}
+	return size
+}
+
+func (f *frameCounter) startFrame() {
+	f.fin = f.header[0]&0x80 != 0
+	f.opcode = f.header[0] & 0x0f
+	masked := f.header[1]&0x80 != 0
+
+	pos := 2
+	switch length := f.header[1] & 0x7f; length {
+	case 126:
+		f.remaining = uint64(binary.BigEndian.Uint16(f.header[2:4]))
+		pos += 2
+	case 127:
+		f.remaining = binary.BigEndian.Uint64(f.header[2:10])
+		pos += 8
+	default:
+		f.remaining = uint64(length)
+	}
+	f.mask = nil
+	if masked {
+		f.mask = f.header[pos : pos+4]
+	}
+	f.offset = 0
+}
+
+func (f *frameCounter) endFrame() {
+	switch {
+	case f.opcode == 0x8:
+		code := int64(closeNoStatus)
+		if f.offset >= 2 {
+			code = int64(binary.BigEndian.Uint16(f.status[:]))
+		}
+		if atomic.CompareAndSwapInt64(&f.closeCode, 0, code) {
+			atomic.StoreInt64(&f.closedAt, time.Now().UnixNano())
+		}
+	case f.opcode&0x8 == 0 && f.fin:
+		// The last frame of a text, binary or fragmented message
+		atomic.AddInt64(&f.messages, 1)
+	}
+	f.need = 0
+	f.headerLen = 0
+}
+
+// Messages returns the number of complete data messages seen so far.
+func (f *frameCounter) Messages() int64 {
+	return atomic.LoadInt64(&f.messages)
+}
+
+// CloseCode returns the status of the first Close frame, or 0 if none was
+// seen.
+func (f *frameCounter) CloseCode() int {
+	return int(atomic.LoadInt64(&f.closeCode))
+}
+
+// closedFirst reports whether f saw a Close frame before other did.
+func (f *frameCounter) closedFirst(other *frameCounter) bool {
+	otherAt := atomic.LoadInt64(&other.closedAt)
+	return otherAt == 0 || atomic.LoadInt64(&f.closedAt) < otherAt
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// frame encodes a WebSocket frame, masking the payload when mask is set.
+func frame(fin bool, opcode byte, payload []byte, mask []byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	var maskBit byte
+	if mask != nil {
+		maskBit = 0x80
+	}
+
+	buf := []byte{b0}
+	switch n := len(payload); {
+	case n < 126:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xFFFF:
+		buf = append(buf, maskBit|126, byte(n>>8), byte(n))
+	default:
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(n))
+		buf = append(append(buf, maskBit|127), length[:]...)
+	}
+	if mask == nil {
+		return append(buf, payload...)
+	}
+	buf = append(buf, mask...)
+	for i, b := range payload {
+		buf = append(buf, b^mask[i%4])
+	}
+	return buf
+}
+
+func closeFrame(code uint16, reason string, mask []byte) []byte {
+	payload := []byte{byte(code >> 8), byte(code)}
+	return frame(true, 0x8, append(payload, reason...), mask)
+}
+
+func TestFrameCounter(t *testing.T) {
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	payload := func(n int) []byte { return bytes.Repeat([]byte{'x'}, n) }
+
+	tests := []struct {
+		name      string
+		stream    [][]byte
+		messages  int64
+		closeCode int
+	}{
+		{"empty text", [][]byte{frame(true, 0x1, nil, nil)}, 1, 0},
+		{"7-bit length", [][]byte{frame(true, 0x1, payload(125), nil)}, 1, 0},
+		{"7-bit length masked", [][]byte{frame(true, 0x2, payload(125), mask)}, 1, 0},
+		{"16-bit length", [][]byte{frame(true, 0x2, payload(126), nil)}, 1, 0},
+		{"16-bit length masked", [][]byte{frame(true, 0x2, payload(0xFFFF), mask)}, 1, 0},
+		{"64-bit length", [][]byte{frame(true, 0x2, payload(0x10000), nil)}, 1, 0},
+		{"64-bit length masked", [][]byte{frame(true, 0x2, payload(70000), mask)}, 1, 0},
+		{"several messages", [][]byte{
+			frame(true, 0x1, payload(10), mask),
+			frame(true, 0x2, payload(300), mask),
+			frame(true, 0x1, nil, mask),
+		}, 3, 0},
+		{"fragmented message", [][]byte{
+			frame(false, 0x1, payload(200), nil),
+			frame(false, 0x0, payload(70000), nil),
+			frame(true, 0x0, payload(5), nil),
+		}, 1, 0},
+		{"control frames inside a fragmented message", [][]byte{
+			frame(false, 0x2, payload(10), mask),
+			frame(true, 0x9, payload(4), mask),
+			frame(true, 0x0, payload(10), mask),
+			frame(true, 0xA, payload(4), mask),
+		}, 1, 0},
+		{"unfinished message", [][]byte{frame(false, 0x1, payload(10), nil)}, 0, 0},
+		{"close with status", [][]byte{frame(true, 0x1, payload(3), nil), closeFrame(1001, "going away", nil)}, 1, 1001},
+		{"masked close with status", [][]byte{closeFrame(4000, "", mask)}, 0, 4000},
+		{"close without status", [][]byte{frame(true, 0x8, nil, mask)}, 0, closeNoStatus},
+		{"first close counts", [][]byte{closeFrame(1000, "", mask), closeFrame(1011, "", mask)}, 0, 1000},
+	}
+
+	feeds := []struct {
+		name  string
+		chunk int // bytes per feed, 0 for all at once
+	}{
+		{"whole", 0},
+		{"one byte at a time", 1},
+		{"three bytes at a time", 3},
+	}
+
+	for _, tt := range tests {
+		stream := bytes.Join(tt.stream, nil)
+		for _, feed := range feeds {
+			t.Run(tt.name+"/"+feed.name, func(t *testing.T) {
+				f := &frameCounter{}
+				if feed.chunk == 0 {
+					f.feed(stream)
+				} else {
+					for i := 0; i < len(stream); i += feed.chunk {
+						end := i + feed.chunk
+						if end > len(stream) {
+							end = len(stream)
+						}
+						f.feed(stream[i:end])
+					}
+				}
+				if got := f.Messages(); got != tt.messages {
+					t.Errorf("%d messages, want %d", got, tt.messages)
+				}
+				if got := f.CloseCode(); got != tt.closeCode {
+					t.Errorf("close code %d, want %d", got, tt.closeCode)
+				}
+			})
+		}
+	}
+}
+
+func TestFrameCounterBetweenFeeds(t *testing.T) {
+	f := &frameCounter{}
+	data := frame(true, 0x2, bytes.Repeat([]byte{'x'}, 0x10000), []byte{1, 2, 3, 4})
+
+	// Stop inside the extended length, then inside the payload
+	f.feed(data[:5])
+	f.feed(data[5:100])
+	if f.Messages() != 0 {
+		t.Fatal("counted a message before its payload arrived")
+	}
+	f.feed(data[100 : len(data)-1])
+	if f.Messages() != 0 {
+		t.Fatal("counted a message one byte early")
+	}
+	f.feed(data[len(data)-1:])
+	if f.Messages() != 1 {
+		t.Fatalf("%d messages after the last byte, want 1", f.Messages())
+	}
+}
@@ -0,0 +1,370 @@
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/logger"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const maxUDPMessageSize = 4096
+
+var errNoServer = errors.New("no DNS server answered")
+
+// answer is the combined A and AAAA result for one name. A name that does
+// not exist, or has no addresses, is notFound; ttl then says how long that
+// may be cached, or 0 when the server did not say.
+type answer struct {
+	ips      []net.IP
+	ttl      time.Duration
+	notFound bool
+}
+
+// client queries DNS servers directly, so answers come with their TTLs.
+type client struct {
+	servers []*serverState // tried in order
+	timeout time.Duration  // per query
+}
+
+func (c *client) lookup(ctx context.Context, host string) (answer, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return answer{}, err
+	}
+
+	type result struct {
+		answer
+		err error
+	}
+	results := make(chan result, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func(qtype dnsmessage.Type) {
+			a, err := c.query(ctx, name, qtype)
+			results <- result{a, err}
+		}(qtype)
+	}
+
+	var combined answer
+	var errs []error
+	negativeTTL := time.Duration(-1)
+	for i := 0; i < 2; i++ {
+		r := <-results
+		switch {
+		case r.err != nil:
+			errs = append(errs, r.err)
+		case r.notFound:
+			if negativeTTL < 0 || r.ttl < negativeTTL {
+				negativeTTL = r.ttl
+			}
+		default:
+			if len(combined.ips) == 0 || r.ttl < combined.ttl {
+				combined.ttl = r.ttl
+			}
+			combined.ips = append(combined.ips, r.ips...)
+		}
+	}
+
+	if len(combined.ips) > 0 {
+		// IPv4 first, as most destinations are reached over it
+		sortIPv4First(combined.ips)
+		return combined, nil
+	}
+	if len(errs) > 0 {
+		return answer{}, errs[0]
+	}
+	if negativeTTL < 0 {
+		negativeTTL = 0
+	}
+	return answer{notFound: true, ttl: negativeTTL}, nil
+}
+
+// query asks the servers in order for one record type, moving on when one
+// fails or answers with a server error.
+func (c *client) query(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) (answer, error) {
+	err := errNoServer
+	for _, s := range c.servers {
+		var msg *dnsmessage.Message
+		msg, err = c.exchange(ctx, s, name, qtype)
+		if err != nil {
+			if ctx.Err() != nil {
+				return answer{}, ctx.Err()
+			}
+			continue
+		}
+
+		switch msg.RCode {
+		case dnsmessage.RCodeSuccess:
+			return parseAnswer(msg, qtype), nil
+		case dnsmessage.RCodeNameError:
+			return answer{notFound: true, ttl: negativeTTL(msg)}, nil
+		}
+	}
+	return answer{}, err
+}
+
+// exchange sends one query to s and records the outcome in its health.
+func (c *client) exchange(ctx context.Context, s *serverState, name dnsmessage.Name, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	msg, err := s.exchange(ctx, name, qtype)
+	if err == nil && msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		err = fmt.Errorf("server %s answered %s", s, msg.RCode)
+	}
+	s.record(time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// server sends single queries to one DNS server.
+type server interface {
+	exchange(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) (*dnsmessage.Message, error)
+	protocol() string
+	String() string
+}
+
+// plainServer speaks DNS over UDP, retrying over TCP when an answer is
+// truncated.
+type plainServer struct {
+	addr string
+}
+
+func (s *plainServer) protocol() string { return "dns" }
+func (s *plainServer) String() string   { return s.addr }
+
+func (s *plainServer) exchange(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	msg, err := s.exchangeOver(ctx, "udp", name, qtype)
+	if err == nil && msg.Truncated {
+		msg, err = s.exchangeOver(ctx, "tcp", name, qtype)
+	}
+	return msg, err
+}
+
+func (s *plainServer) exchangeOver(ctx context.Context, network string, name dnsmessage.Name, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	packed, err := packQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var reply []byte
+	if network == "tcp" {
+		reply, err = exchangeTCP(conn, packed)
+	} else {
+		reply, err = exchangeUDP(conn, packed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unpackReply(reply, id, name, qtype, s.addr)
+}
+
+func packQuery(id uint16, name dnsmessage.Name, qtype dnsmessage.Type) ([]byte, error) {
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	return query.Pack()
+}
+
+// unpackReply parses a reply and checks that it answers the query.
+func unpackReply(reply []byte, id uint16, name dnsmessage.Name, qtype dnsmessage.Type, server string) (*dnsmessage.Message, error) {
+	msg := &dnsmessage.Message{}
+	if err := msg.Unpack(reply); err != nil {
+		return nil, err
+	}
+	if !msg.Response || msg.ID != id || len(msg.Questions) != 1 ||
+		msg.Questions[0].Type != qtype || !equalNames(msg.Questions[0].Name, name) {
+		return nil, fmt.Errorf("server %s sent a mismatched answer", server)
+	}
+	return msg, nil
+}
+
+func exchangeUDP(conn net.Conn, packed []byte) ([]byte, error) {
+	if _, err := conn.Write(packed); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxUDPMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func exchangeTCP(conn net.Conn, packed []byte) ([]byte, error) {
+	framed := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(framed, uint16(len(packed)))
+	copy(framed[2:], packed)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// parseAnswer collects the addresses of a successful answer. Its TTL is the
+// lowest in the answer section, CNAMEs included.
+func parseAnswer(msg *dnsmessage.Message, qtype dnsmessage.Type) answer {
+	var a answer
+	first := true
+	for _, rr := range msg.Answers {
+		ttl := time.Duration(rr.Header.TTL) * time.Second
+		if first || ttl < a.ttl {
+			a.ttl = ttl
+			first = false
+		}
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			if qtype == dnsmessage.TypeA {
+				a.ips = append(a.ips, net.IP(body.A[:]))
+			}
+		case *dnsmessage.AAAAResource:
+			if qtype == dnsmessage.TypeAAAA {
+				a.ips = append(a.ips, net.IP(body.AAAA[:]))
+			}
+		}
+	}
+	if len(a.ips) == 0 {
+		// No data for this type
+		return answer{notFound: true, ttl: negativeTTL(msg)}
+	}
+	return a
+}
+
+// negativeTTL is how long a negative answer may be cached (RFC 2308 section
+// 5): the lower of the SOA's TTL and its minimum field.
+func negativeTTL(msg *dnsmessage.Message) time.Duration {
+	for _, rr := range msg.Authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			ttl := rr.Header.TTL
+			if soa.MinTTL < ttl {
+				ttl = soa.MinTTL
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return 0
+}
+
+func equalNames(a, b dnsmessage.Name) bool {
+	if a.Length != b.Length {
+		return false
+	}
+	for i := 0; i < int(a.Length); i++ {
+		if lower(a.Data[i]) != lower(b.Data[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func sortIPv4First(ips []net.IP) {
+	v4 := ips[:0:0]
+	var v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	copy(ips, append(v4, v6...))
+}
+
+// serverState tracks how a server has been answering. A server that has not
+// been asked yet counts as healthy.
+type serverState struct {
+	server
+
+	mutex       sync.Mutex
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+	failures    int // consecutive
+	latency     time.Duration
+}
+
+func (s *serverState) record(elapsed time.Duration, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err != nil {
+		if s.failures == 0 {
+			logger.Warn("DNS server %s is failing: %v", s, err)
+		}
+		s.lastFailure = time.Now()
+		s.lastError = err.Error()
+		s.failures++
+		return
+	}
+	if s.failures > 0 {
+		logger.Info("DNS server %s recovered after %d failures", s, s.failures)
+	}
+	s.lastSuccess = time.Now()
+	s.latency = elapsed
+	s.failures = 0
+}
+
+func (s *serverState) health() ServerHealth {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	h := ServerHealth{
+		Server:   s.String(),
+		Protocol: s.protocol(),
+		Healthy:  s.failures == 0,
+		Failures: s.failures,
+		Latency:  s.latency,
+	}
+	if !s.lastSuccess.IsZero() {
+		t := s.lastSuccess
+		h.LastSuccess = &t
+	}
+	if !s.lastFailure.IsZero() {
+		t := s.lastFailure
+		h.LastFailure = &t
+		h.LastError = s.lastError
+	}
+	return h
+}
@@ -0,0 +1,99 @@
+package resolver
+
+import (
+	"context"
+	"net"
+
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/proxy"
+)
+
+// Dialer is a net.Dialer that resolves names with Resolver, trying each
+// address in turn. Without a Resolver it dials like net.Dialer. The Egress
+// of the RequestState carried in ctx, if any, picks the address family and
+// the local address to bind.
+type Dialer struct {
+	net.Dialer
+	Resolver *Resolver
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var egress *proxy.Egress
+	if state := proxy.StateFromContext(ctx); state != nil {
+		egress = state.Egress
+	}
+	if d.Resolver == nil && egress == nil {
+		return d.Dialer.DialContext(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return d.Dialer.DialContext(ctx, network, addr)
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		if ips, err = d.lookupIP(ctx, host); err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+	}
+
+	var firstErr error
+	for _, ip := range egress.Order(ips) {
+		if !suitable(network, ip) {
+			continue
+		}
+		dialer := d.Dialer
+		if source := egress.LocalAddr(ip); source != nil {
+			dialer.LocalAddr = localAddr(network, source)
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			if egress != nil {
+				logger.Debug("Connected to %s from %s", conn.RemoteAddr(), conn.LocalAddr())
+			}
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = &net.OpError{Op: "dial", Net: network, Err: &net.AddrError{Err: "no suitable address found", Addr: host}}
+	}
+	return nil, firstErr
+}
+
+func (d *Dialer) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if d.Resolver != nil {
+		return d.Resolver.LookupIP(ctx, host)
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	sortIPv4First(ips)
+	return ips, nil
+}
+
+func localAddr(network string, ip net.IP) net.Addr {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return &net.UDPAddr{IP: ip}
+	}
+	return &net.TCPAddr{IP: ip}
+}
+
+func suitable(network string, ip net.IP) bool {
+	switch network {
+	case "tcp4", "udp4":
+		return ip.To4() != nil
+	case "tcp6", "udp6":
+		return ip.To4() == nil
+	}
+	return true
+}
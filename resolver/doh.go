@@ -0,0 +1,126 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const dnsMessageType = "application/dns-message"
+
+// dohServer speaks DNS over HTTPS (RFC 8484), POSTing queries so they are not
+// logged as URLs along the way.
+type dohServer struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (s *dohServer) protocol() string { return "doh" }
+func (s *dohServer) String() string   { return s.endpoint }
+
+func (s *dohServer) exchange(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	// The ID is 0 so that identical queries are cacheable (section 4.1)
+	packed, err := packQuery(0, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server %s returned %s", s.endpoint, resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != dnsMessageType {
+		return nil, fmt.Errorf("server %s returned content type %q", s.endpoint, resp.Header.Get("Content-Type"))
+	}
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, 65535+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) > 65535 {
+		return nil, fmt.Errorf("server %s sent an oversized answer", s.endpoint)
+	}
+	return unpackReply(reply, 0, name, qtype, s.endpoint)
+}
+
+// newDoHClient builds the HTTP client shared by the DoH endpoints. Their
+// certificates are checked against the system roots plus those in caFile.
+func newDoHClient(caFile string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Lookups must not go through a proxy, which may well be this one
+	transport.Proxy = nil
+	transport.ForceAttemptHTTP2 = true
+
+	if caFile != "" {
+		pemData, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DoH CA file: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in DoH CA file %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// bootstrapClient returns a copy of client that connects to the bootstrap
+// address instead of looking up the endpoint's host. TLS still verifies the
+// certificate against the host in the URL.
+func bootstrapClient(client *http.Client, bootstrap string) *http.Client {
+	transport := client.Transport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, network, net.JoinHostPort(bootstrap, port))
+	}
+	return &http.Client{Transport: transport}
+}
+
+func validateDoHServer(server config.DoHServer) error {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		return fmt.Errorf("invalid DoH endpoint %q: %w", server.URL, err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("DoH endpoint %q must be an https URL", server.URL)
+	}
+	if server.Bootstrap != "" && net.ParseIP(server.Bootstrap) == nil {
+		return fmt.Errorf("DoH endpoint %q bootstrap %q must be an IP address", server.URL, server.Bootstrap)
+	}
+	// Resolving the name would go through the system resolver in plaintext
+	if server.Bootstrap == "" && net.ParseIP(u.Hostname()) == nil {
+		return fmt.Errorf("DoH endpoint %q needs a bootstrap IP address", server.URL)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package resolver
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dohStub is an RFC 8484 endpoint answering every A query with ip. It fails
+// with fail as status while fail is set, and hangs while hang is, until the
+// test ends.
+type dohStub struct {
+	*httptest.Server
+	ip      net.IP
+	queries int64
+	fail    int64 // HTTP status, 0 to answer
+	hang    int32
+	release chan struct{}
+}
+
+func newDoHStub(t *testing.T, ip string) *dohStub {
+	t.Helper()
+	stub := &dohStub{ip: net.ParseIP(ip).To4(), release: make(chan struct{})}
+	stub.Server = httptest.NewTLSServer(http.HandlerFunc(stub.serveHTTP))
+	t.Cleanup(stub.Close)
+	// Runs before Close, which waits for hanging handlers
+	t.Cleanup(func() { close(stub.release) })
+	return stub
+}
+
+func (s *dohStub) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&s.queries, 1)
+	if atomic.LoadInt32(&s.hang) == 1 {
+		select {
+		case <-req.Context().Done():
+		case <-s.release:
+		}
+		return
+	}
+	if status := atomic.LoadInt64(&s.fail); status != 0 {
+		http.Error(w, "failing", int(status))
+		return
+	}
+	if req.Method != http.MethodPost || req.Header.Get("Content-Type") != dnsMessageType {
+		http.Error(w, "not a DNS query", http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var query dnsmessage.Message
+	if err := query.Unpack(body); err != nil || len(query.Questions) != 1 {
+		http.Error(w, "malformed query", http.StatusBadRequest)
+		return
+	}
+
+	question := query.Questions[0]
+	reply := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true},
+		Questions: query.Questions,
+	}
+	if question.Type == dnsmessage.TypeA {
+		var a [4]byte
+		copy(a[:], s.ip)
+		reply.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.AResource{A: a},
+		}}
+	}
+	packed, err := reply.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Write(packed)
+}
+
+// newDoHResolver returns a resolver using the stubs in order, trusting their
+// certificates.
+func newDoHResolver(t *testing.T, cacheSize int, stubs ...*dohStub) *Resolver {
+	t.Helper()
+	cfg := config.DNSConfig{DoHCAFile: writeCAFile(t, stubs...), Timeout: 1, CacheSize: cacheSize, MaxTTL: 3600}
+	for _, stub := range stubs {
+		cfg.DoH = append(cfg.DoH, config.DoHServer{URL: stub.URL + "/dns-query"})
+	}
+	r, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return r
+}
+
+// writeCAFile returns a file holding the stubs' certificates.
+func writeCAFile(t *testing.T, stubs ...*dohStub) string {
+	t.Helper()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	var pemData []byte
+	for _, stub := range stubs {
+		pemData = append(pemData, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: stub.Certificate().Raw})...)
+	}
+	if err := os.WriteFile(caFile, pemData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return caFile
+}
+
+func lookup(t *testing.T, r *Resolver, host string) []net.IP {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		t.Fatalf("LookupIP(%s): %v", host, err)
+	}
+	return ips
+}
+
+func TestDoHAnswerIsCached(t *testing.T) {
+	stub := newDoHStub(t, "192.0.2.1")
+	r := newDoHResolver(t, 10, stub)
+
+	if ips := lookup(t, r, "www.example.test"); len(ips) != 1 || !ips[0].Equal(stub.ip) {
+		t.Fatalf("got %v, want [%v]", ips, stub.ip)
+	}
+	queries := atomic.LoadInt64(&stub.queries)
+	if queries != 2 {
+		t.Errorf("sent %d queries, want one A and one AAAA", queries)
+	}
+
+	if ips := lookup(t, r, "WWW.example.test."); len(ips) != 1 || !ips[0].Equal(stub.ip) {
+		t.Fatalf("cached lookup got %v, want [%v]", ips, stub.ip)
+	}
+	if n := atomic.LoadInt64(&stub.queries); n != queries {
+		t.Errorf("cached lookup sent %d more queries", n-queries)
+	}
+	if stats := r.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("stats = %+v, want 1 hit, 1 miss and 1 entry", stats)
+	}
+}
+
+func TestDoHFallsOverOnServerError(t *testing.T) {
+	failing := newDoHStub(t, "192.0.2.1")
+	atomic.StoreInt64(&failing.fail, http.StatusServiceUnavailable)
+	backup := newDoHStub(t, "192.0.2.2")
+	r := newDoHResolver(t, 0, failing, backup)
+
+	if ips := lookup(t, r, "www.example.test"); len(ips) != 1 || !ips[0].Equal(backup.ip) {
+		t.Fatalf("got %v, want the backup's [%v]", ips, backup.ip)
+	}
+	if atomic.LoadInt64(&failing.queries) == 0 {
+		t.Error("the first endpoint was not asked")
+	}
+}
+
+func TestDoHFallsOverOnTimeout(t *testing.T) {
+	hanging := newDoHStub(t, "192.0.2.1")
+	atomic.StoreInt32(&hanging.hang, 1)
+	backup := newDoHStub(t, "192.0.2.2")
+	r := newDoHResolver(t, 0, hanging, backup)
+
+	start := time.Now()
+	if ips := lookup(t, r, "www.example.test"); len(ips) != 1 || !ips[0].Equal(backup.ip) {
+		t.Fatalf("got %v, want the backup's [%v]", ips, backup.ip)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("lookup took %v, the per-query timeout is 1s", elapsed)
+	}
+	if health := r.Health(); health[0].Healthy || !health[1].Healthy {
+		t.Errorf("health = %+v, want the hanging endpoint unhealthy", health)
+	}
+}
+
+func TestDoHHealth(t *testing.T) {
+	stub := newDoHStub(t, "192.0.2.1")
+	r := newDoHResolver(t, 0, stub)
+
+	health := r.Health()
+	if len(health) != 1 || !health[0].Healthy || health[0].Protocol != "doh" || health[0].Server != stub.URL+"/dns-query" {
+		t.Fatalf("initial health = %+v, want one healthy doh endpoint", health)
+	}
+
+	lookup(t, r, "www.example.test")
+	if health := r.Health()[0]; !health.Healthy || health.LastSuccess == nil {
+		t.Errorf("after a success, health = %+v", health)
+	}
+
+	atomic.StoreInt64(&stub.fail, http.StatusInternalServerError)
+	if _, err := r.LookupIP(context.Background(), "other.example.test"); err == nil {
+		t.Fatal("lookup succeeded with the only endpoint failing")
+	}
+	health = r.Health()
+	if health[0].Healthy || health[0].Failures == 0 || health[0].LastFailure == nil || health[0].LastError == "" {
+		t.Errorf("after a failure, health = %+v, want unhealthy with the error", health[0])
+	}
+
+	atomic.StoreInt64(&stub.fail, 0)
+	lookup(t, r, "third.example.test")
+	if health := r.Health()[0]; !health.Healthy || health.Failures != 0 {
+		t.Errorf("after recovering, health = %+v", health)
+	}
+}
+
+func TestDoHBootstrap(t *testing.T) {
+	stub := newDoHStub(t, "192.0.2.1")
+	_, port, _ := net.SplitHostPort(stub.Listener.Addr().String())
+
+	// The stub's certificate is for example.com, which is only reachable
+	// here through the bootstrap address
+	r, err := New(config.DNSConfig{
+		DoH:       []config.DoHServer{{URL: "https://example.com:" + port + "/dns-query", Bootstrap: "127.0.0.1"}},
+		DoHCAFile: writeCAFile(t, stub),
+		Timeout:   1,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if ips := lookup(t, r, "www.example.test"); len(ips) != 1 || !ips[0].Equal(stub.ip) {
+		t.Fatalf("got %v, want [%v]", ips, stub.ip)
+	}
+	if atomic.LoadInt64(&stub.queries) == 0 {
+		t.Error("the endpoint was not asked")
+	}
+}
+
+func TestValidateDoHServer(t *testing.T) {
+	tests := []struct {
+		server config.DoHServer
+		valid  bool
+	}{
+		{config.DoHServer{URL: "https://1.1.1.1/dns-query"}, true},
+		{config.DoHServer{URL: "https://[2606:4700:4700::1111]/dns-query"}, true},
+		{config.DoHServer{URL: "https://dns.example/dns-query", Bootstrap: "192.0.2.53"}, true},
+		{config.DoHServer{URL: "https://dns.example/dns-query"}, false},
+		{config.DoHServer{URL: "https://dns.example/dns-query", Bootstrap: "dns.example"}, false},
+		{config.DoHServer{URL: "http://1.1.1.1/dns-query"}, false},
+	}
+	for _, tt := range tests {
+		if err := validateDoHServer(tt.server); (err == nil) != tt.valid {
+			t.Errorf("validateDoHServer(%+v) = %v, want valid %v", tt.server, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+// Package resolver resolves the names of destinations the proxy connects to
+// directly. Admin-managed host overrides are answered first; other names are
+// looked up on the configured DNS-over-HTTPS endpoints or DNS servers, or the
+// system resolver, and cached for their TTL, including names that do not
+// exist.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/config"
+	"github.com/zulkan/zulgoproxy/database"
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+	"github.com/zulkan/zulgoproxy/proxy"
+	"golang.org/x/sync/singleflight"
+)
+
+var hostnamePattern = regexp.MustCompile(`^(\*\.)?[a-z0-9_-]+(\.[a-z0-9_-]+)*$`)
+
+// Stats summarizes the resolver for the admin API.
+type Stats struct {
+	Servers      []string `json:"servers"` // in the order tried; empty when the system resolver is used
+	Entries      int      `json:"entries"`
+	Overrides    int      `json:"overrides"`
+	Hits         int64    `json:"hits"`
+	NegativeHits int64    `json:"negative_hits"`
+	Misses       int64    `json:"misses"`
+	Failures     int64    `json:"failures"`
+}
+
+// ServerHealth is how a DNS server has been answering recent queries.
+type ServerHealth struct {
+	Server      string        `json:"server"`
+	Protocol    string        `json:"protocol"` // "dns" or "doh"
+	Healthy     bool          `json:"healthy"`  // its last query succeeded, or none was sent yet
+	Failures    int           `json:"consecutive_failures"`
+	Latency     time.Duration `json:"latency"` // of the last successful query
+	LastSuccess *time.Time    `json:"last_success,omitempty"`
+	LastFailure *time.Time    `json:"last_failure,omitempty"`
+	LastError   string        `json:"last_error,omitempty"`
+}
+
+type cacheEntry struct {
+	ips      []net.IP // nil for a name that does not exist
+	expires  time.Time
+	notFound bool
+}
+
+type wildcardOverride struct {
+	pattern string // "*.example.com", matching the domain and its subdomains
+	ips     []net.IP
+}
+
+// Resolver looks up destination names. Overrides are kept in memory and
+// reloaded whenever they change through the API.
+type Resolver struct {
+	cfg    config.DNSConfig
+	client *client // nil uses the system resolver
+
+	exact         map[string][]net.IP
+	wildcards     []wildcardOverride // longest pattern first
+	overrideMutex sync.RWMutex
+
+	cache      map[string]*cacheEntry
+	cacheMutex sync.Mutex
+	inflight   singleflight.Group
+
+	hits         int64
+	negativeHits int64
+	misses       int64
+	failures     int64
+}
+
+func New(cfg config.DNSConfig) (*Resolver, error) {
+	r := &Resolver{
+		cfg:   cfg,
+		exact: make(map[string][]net.IP),
+		cache: make(map[string]*cacheEntry),
+	}
+	if len(cfg.DoH) == 0 && len(cfg.Servers) == 0 {
+		return r, nil
+	}
+	if cfg.PlaintextFallback && (len(cfg.DoH) == 0 || len(cfg.Servers) == 0) {
+		return nil, fmt.Errorf("DNS plaintext_fallback needs both doh endpoints and servers")
+	}
+
+	var servers []*serverState
+	if len(cfg.DoH) > 0 {
+		httpClient, err := newDoHClient(cfg.DoHCAFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, doh := range cfg.DoH {
+			if err := validateDoHServer(doh); err != nil {
+				return nil, err
+			}
+			client := httpClient
+			if doh.Bootstrap != "" {
+				client = bootstrapClient(httpClient, doh.Bootstrap)
+			}
+			servers = append(servers, &serverState{server: &dohServer{endpoint: doh.URL, client: client}})
+		}
+	}
+	// With DoH configured, plaintext servers are only asked if allowed, so
+	// lookups do not silently leak onto the network
+	if len(cfg.DoH) == 0 || cfg.PlaintextFallback {
+		for _, addr := range cfg.Servers {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				host, port = addr, "53"
+			}
+			if net.ParseIP(host) == nil {
+				return nil, fmt.Errorf("DNS server %q must be an IP address", addr)
+			}
+			servers = append(servers, &serverState{server: &plainServer{addr: net.JoinHostPort(host, port)}})
+		}
+	}
+	r.client = &client{servers: servers, timeout: time.Duration(cfg.Timeout) * time.Second}
+	return r, nil
+}
+
+// Reload replaces the in-memory overrides with the active overrides in the
+// database.
+func (r *Resolver) Reload() error {
+	var rows []models.HostOverride
+	if err := database.GetDB().Where("is_active = ?", true).Find(&rows).Error; err != nil {
+		return fmt.Errorf("failed to load host overrides: %w", err)
+	}
+	r.load(rows)
+	return nil
+}
+
+// load puts the valid overrides among rows in effect.
+func (r *Resolver) load(rows []models.HostOverride) {
+	exact := make(map[string][]net.IP)
+	var wildcards []wildcardOverride
+	for _, row := range rows {
+		if err := ValidateHostOverride(row); err != nil {
+			logger.Warn("Skipping invalid host override %d (%s): %v", row.ID, row.Hostname, err)
+			continue
+		}
+		ips := make([]net.IP, len(row.Addresses))
+		for i, address := range row.Addresses {
+			ips[i] = net.ParseIP(address)
+		}
+		hostname := strings.ToLower(row.Hostname)
+		if strings.HasPrefix(hostname, "*.") {
+			wildcards = append(wildcards, wildcardOverride{pattern: hostname, ips: ips})
+		} else {
+			exact[hostname] = ips
+		}
+	}
+	sort.Slice(wildcards, func(i, j int) bool { return len(wildcards[i].pattern) > len(wildcards[j].pattern) })
+
+	r.overrideMutex.Lock()
+	r.exact = exact
+	r.wildcards = wildcards
+	r.overrideMutex.Unlock()
+
+	logger.Info("Loaded %d host overrides", len(exact)+len(wildcards))
+}
+
+// ValidateHostOverride checks that an override names a host and gives it
+// valid addresses.
+func ValidateHostOverride(override models.HostOverride) error {
+	if !hostnamePattern.MatchString(strings.ToLower(override.Hostname)) {
+		return fmt.Errorf("invalid hostname %q", override.Hostname)
+	}
+	if net.ParseIP(override.Hostname) != nil {
+		return fmt.Errorf("hostname %q is an IP address", override.Hostname)
+	}
+	if len(override.Addresses) == 0 {
+		return fmt.Errorf("at least one address is required")
+	}
+	for _, address := range override.Addresses {
+		if net.ParseIP(address) == nil {
+			return fmt.Errorf("invalid address %q", address)
+		}
+	}
+	return nil
+}
+
+// LookupIP returns the addresses of host, IPv4 first. The time spent is added
+// to the RequestState carried in ctx. A name that does not exist fails with a
+// *net.DNSError whose IsNotFound is set.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	start := time.Now()
+	defer func() {
+		if state := proxy.StateFromContext(ctx); state != nil {
+			state.AddDNSTime(time.Since(start))
+		}
+	}()
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if ips := r.override(host); ips != nil {
+		return ips, nil
+	}
+	if ips, found, ok := r.cached(host); ok {
+		if !found {
+			return nil, notFoundError(host)
+		}
+		return ips, nil
+	}
+
+	// Concurrent lookups of a name share one query; a caller that gives up
+	// does not cancel it for the others
+	ch := r.inflight.DoChan(host, func() (interface{}, error) {
+		return r.lookup(host)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]net.IP), nil
+	case <-ctx.Done():
+		return nil, &net.DNSError{Err: ctx.Err().Error(), Name: host, IsTimeout: errors.Is(ctx.Err(), context.DeadlineExceeded)}
+	}
+}
+
+func (r *Resolver) override(host string) []net.IP {
+	r.overrideMutex.RLock()
+	defer r.overrideMutex.RUnlock()
+
+	if ips, ok := r.exact[host]; ok {
+		return ips
+	}
+	for _, w := range r.wildcards {
+		if proxy.MatchHost(w.pattern, host) {
+			return w.ips
+		}
+	}
+	return nil
+}
+
+// cached returns a live cache entry for host; found is false for a cached
+// negative answer.
+func (r *Resolver) cached(host string) (ips []net.IP, found, ok bool) {
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+
+	entry, exists := r.cache[host]
+	if !exists {
+		return nil, false, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(r.cache, host)
+		return nil, false, false
+	}
+	if entry.notFound {
+		atomic.AddInt64(&r.negativeHits, 1)
+		return nil, false, true
+	}
+	atomic.AddInt64(&r.hits, 1)
+	return entry.ips, true, true
+}
+
+func (r *Resolver) lookup(host string) ([]net.IP, error) {
+	atomic.AddInt64(&r.misses, 1)
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout())
+	defer cancel()
+
+	var a answer
+	var err error
+	if r.client != nil {
+		a, err = r.client.lookup(ctx, host)
+	} else {
+		a, err = systemLookup(ctx, host, time.Duration(r.cfg.DefaultTTL)*time.Second)
+	}
+	if err != nil {
+		atomic.AddInt64(&r.failures, 1)
+		logger.Warn("DNS lookup of %s failed after %v: %v", host, time.Since(start), err)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			return nil, dnsErr
+		}
+		return nil, &net.DNSError{Err: err.Error(), Name: host, IsTimeout: ctx.Err() != nil}
+	}
+	logger.Debug("DNS lookup of %s took %v: %v (ttl %v)", host, time.Since(start), a.ips, a.ttl)
+
+	if a.notFound {
+		ttl := a.ttl
+		if ttl == 0 {
+			ttl = time.Duration(r.cfg.NegativeTTL) * time.Second
+		}
+		r.store(host, &cacheEntry{notFound: true}, ttl)
+		return nil, notFoundError(host)
+	}
+	r.store(host, &cacheEntry{ips: a.ips}, a.ttl)
+	return a.ips, nil
+}
+
+func (r *Resolver) timeout() time.Duration {
+	if r.cfg.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	// Servers are tried in turn, each taking up to the timeout
+	servers := 1
+	if r.client != nil {
+		servers = len(r.client.servers)
+	}
+	return time.Duration(r.cfg.Timeout*servers) * time.Second
+}
+
+// store caches entry for ttl, bounded by the configured TTL limits.
+func (r *Resolver) store(host string, entry *cacheEntry, ttl time.Duration) {
+	if minTTL := time.Duration(r.cfg.MinTTL) * time.Second; ttl < minTTL {
+		ttl = minTTL
+	}
+	if maxTTL := time.Duration(r.cfg.MaxTTL) * time.Second; maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	if ttl <= 0 || r.cfg.CacheSize <= 0 {
+		return
+	}
+	entry.expires = time.Now().Add(ttl)
+
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+
+	if len(r.cache) >= r.cfg.CacheSize {
+		r.evict()
+	}
+	r.cache[host] = entry
+}
+
+// evict makes room by dropping expired entries, or arbitrary ones when none
+// have expired. The caller holds the cache mutex.
+func (r *Resolver) evict() {
+	now := time.Now()
+	for host, entry := range r.cache {
+		if now.After(entry.expires) {
+			delete(r.cache, host)
+		}
+	}
+	for host := range r.cache {
+		if len(r.cache) < r.cfg.CacheSize {
+			break
+		}
+		delete(r.cache, host)
+	}
+}
+
+// Flush empties the cache and returns how many names it held.
+func (r *Resolver) Flush() int {
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+	n := len(r.cache)
+	r.cache = make(map[string]*cacheEntry)
+	return n
+}
+
+func (r *Resolver) Stats() Stats {
+	stats := Stats{Servers: []string{}}
+	if r.client != nil {
+		for _, s := range r.client.servers {
+			stats.Servers = append(stats.Servers, s.String())
+		}
+	}
+
+	r.cacheMutex.Lock()
+	stats.Entries = len(r.cache)
+	r.cacheMutex.Unlock()
+
+	r.overrideMutex.RLock()
+	stats.Overrides = len(r.exact) + len(r.wildcards)
+	r.overrideMutex.RUnlock()
+
+	stats.Hits = atomic.LoadInt64(&r.hits)
+	stats.NegativeHits = atomic.LoadInt64(&r.negativeHits)
+	stats.Misses = atomic.LoadInt64(&r.misses)
+	stats.Failures = atomic.LoadInt64(&r.failures)
+	return stats
+}
+
+// Health reports each configured server, in the order they are tried. It is
+// empty when the system resolver is used.
+func (r *Resolver) Health() []ServerHealth {
+	health := []ServerHealth{}
+	if r.client != nil {
+		for _, s := range r.client.servers {
+			health = append(health, s.health())
+		}
+	}
+	return health
+}
+
+// systemLookup asks the system resolver, which does not report TTLs.
+func systemLookup(ctx context.Context, host string, ttl time.Duration) (answer, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return answer{notFound: true}, nil
+		}
+		return answer{}, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	sortIPv4First(ips)
+	return answer{ips: ips, ttl: ttl}, nil
+}
+
+func notFoundError(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
@@ -0,0 +1,57 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/zulkan/zulgoproxy/config"
+	"github.com/zulkan/zulgoproxy/models"
+)
+
+func TestHostOverrides(t *testing.T) {
+	r, err := New(config.DNSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.load([]models.HostOverride{
+		{ID: 1, Hostname: "*.example.com", Addresses: []string{"192.0.2.1"}, IsActive: true},
+		{ID: 2, Hostname: "*.internal.example.com", Addresses: []string{"192.0.2.2"}, IsActive: true},
+		{ID: 3, Hostname: "Pinned.Example.com", Addresses: []string{"192.0.2.3", "2001:db8::3"}, IsActive: true},
+		{ID: 4, Hostname: "*.example.net", Addresses: []string{"not-an-ip"}, IsActive: true}, // invalid, skipped
+	})
+
+	tests := []struct {
+		host string
+		want string // first address, "" when not overridden
+	}{
+		{"example.com", "192.0.2.1"},
+		{"www.example.com", "192.0.2.1"},
+		{"internal.example.com", "192.0.2.2"},
+		{"db.internal.example.com", "192.0.2.2"},
+		{"pinned.example.com", "192.0.2.3"},
+		{"badexample.com", ""},
+		{"example.net", ""},
+	}
+	for _, tt := range tests {
+		var got string
+		if ips := r.override(tt.host); len(ips) > 0 {
+			got = ips[0].String()
+		}
+		if got != tt.want {
+			t.Errorf("override(%s) = %s, want %q", tt.host, got, tt.want)
+		}
+	}
+
+	// LookupIP normalizes the name before checking the overrides
+	ips, err := r.LookupIP(context.Background(), "WWW.Example.COM.")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("LookupIP(WWW.Example.COM.) = %v, %v, want the wildcard override", ips, err)
+	}
+	if ips := r.override("pinned.example.com"); len(ips) != 2 || !ips[1].Equal(net.ParseIP("2001:db8::3")) {
+		t.Errorf("override(pinned.example.com) = %v, want both addresses", ips)
+	}
+	if stats := r.Stats(); stats.Overrides != 3 {
+		t.Errorf("%d overrides loaded, want the 3 valid ones", stats.Overrides)
+	}
+}
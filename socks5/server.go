@@ -0,0 +1,385 @@
+// Package socks5 implements a SOCKS5 (RFC 1928) listener with
+// username/password authentication (RFC 1929) that shares the HTTP proxy's
+// user store, access checks and logging.
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+	"github.com/zulkan/zulgoproxy/proxy"
+)
+
+const (
+	version5     = 0x05
+	authVersion1 = 0x01
+
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xFF
+
+	cmdConnect      = 0x01
+	cmdBind         = 0x02
+	cmdUDPAssociate = 0x03
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// Reply codes
+const (
+	replySucceeded           = 0x00
+	replyGeneralFailure      = 0x01
+	replyNotAllowed          = 0x02
+	replyNetworkUnreachable  = 0x03
+	replyHostUnreachable     = 0x04
+	replyConnectionRefused   = 0x05
+	replyCommandNotSupported = 0x07
+	replyAddressNotSupported = 0x08
+)
+
+const handshakeTimeout = 30 * time.Second
+
+// Server accepts SOCKS5 clients. The callbacks connect it to the rest of the
+// proxy so both listeners enforce the same policy.
+type Server struct {
+	// Authenticate verifies username/password credentials.
+	Authenticate func(username, password string) (*models.User, bool)
+	// AllowAnonymous reports whether a client may skip authentication.
+	AllowAnonymous func(remoteAddr string) bool
+	// Authorize returns a reason when the destination is refused.
+	Authorize func(state *proxy.RequestState, host string) string
+	// Acquire reserves a connection slot for the session described by entry,
+	// registering its release on state, and returns a reason when none is
+	// available.
+	Acquire func(state *proxy.RequestState, entry *models.ProxyLog) string
+	// Dial opens the outbound connection for CONNECT.
+	Dial proxy.DialFunc
+	// Lookup resolves UDP destination names; nil uses the system resolver.
+	Lookup proxy.LookupFunc
+	// CheckAddr returns an error when a resolved UDP destination is refused.
+	CheckAddr func(ip net.IP) error
+	// EnableUDP allows UDP ASSOCIATE.
+	EnableUDP bool
+}
+
+// ListenAndServe accepts SOCKS5 connections on addr until the listener fails.
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	user, err := s.negotiate(reader, conn)
+	if err != nil {
+		logger.Debug("SOCKS5 handshake from %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	cmd, host, err := readRequest(reader)
+	if err != nil {
+		logger.Debug("SOCKS5 request from %s failed: %v", conn.RemoteAddr(), err)
+		if errors.Is(err, errAddressType) {
+			writeReply(conn, replyAddressNotSupported, nil)
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	state := proxy.NewRequestState(user)
+	defer state.Finish()
+
+	switch cmd {
+	case cmdConnect:
+		s.handleConnect(&bufferedConn{Conn: conn, reader: reader}, state, host)
+	case cmdUDPAssociate:
+		if !s.EnableUDP {
+			writeReply(conn, replyCommandNotSupported, nil)
+			return
+		}
+		s.handleUDPAssociate(conn, reader, state)
+	default:
+		writeReply(conn, replyCommandNotSupported, nil)
+	}
+}
+
+// negotiate selects an authentication method and runs it. Clients offering
+// credentials are always authenticated so their traffic is attributed.
+func (s *Server) negotiate(reader *bufio.Reader, conn net.Conn) (*models.User, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[0] != version5 {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return nil, err
+	}
+
+	offered := func(method byte) bool {
+		for _, m := range methods {
+			if m == method {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case offered(methodUserPass):
+		if _, err := conn.Write([]byte{version5, methodUserPass}); err != nil {
+			return nil, err
+		}
+		return s.authenticate(reader, conn)
+	case offered(methodNoAuth) && s.AllowAnonymous(conn.RemoteAddr().String()):
+		_, err := conn.Write([]byte{version5, methodNoAuth})
+		return nil, err
+	default:
+		conn.Write([]byte{version5, methodNoAcceptable})
+		return nil, errors.New("no acceptable authentication method")
+	}
+}
+
+func (s *Server) authenticate(reader *bufio.Reader, conn net.Conn) (*models.User, error) {
+	version, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != authVersion1 {
+		return nil, fmt.Errorf("unsupported auth version %d", version)
+	}
+
+	username, err := readString(reader)
+	if err != nil {
+		return nil, err
+	}
+	password, err := readString(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	user, ok := s.Authenticate(username, password)
+	if !ok {
+		conn.Write([]byte{authVersion1, 0x01})
+		logger.Warn("SOCKS5 authentication failed for %s from %s", username, conn.RemoteAddr())
+		return nil, errors.New("invalid credentials")
+	}
+
+	_, err = conn.Write([]byte{authVersion1, 0x00})
+	return user, err
+}
+
+func (s *Server) handleConnect(client *bufferedConn, state *proxy.RequestState, host string) {
+	conn := client.Conn
+
+	entry := state.StreamEntry(conn.RemoteAddr().String(), "SOCKS5 CONNECT", host)
+	reason := s.Authorize(state, host)
+	if reason == "" {
+		reason = s.Acquire(state, entry)
+	}
+	if reason != "" {
+		logger.Info("SOCKS5 CONNECT to %s from %s denied: %s", host, conn.RemoteAddr(), reason)
+		writeReply(conn, replyNotAllowed, nil)
+		entry.DenyReason = reason
+		entry.StatusCode = http.StatusForbidden
+		proxy.Record(entry)
+		return
+	}
+
+	target, err := s.Dial(proxy.WithState(context.Background(), state), "tcp", host)
+	entry.DNSDuration = state.DNSTime().Milliseconds()
+	if err != nil {
+		logger.Warn("SOCKS5 CONNECT to %s failed: %v", host, err)
+		writeReply(conn, dialErrorReply(err), nil)
+		entry.StatusCode = http.StatusBadGateway
+		entry.CloseReason = proxy.CloseDialFailed
+		proxy.Record(entry)
+		return
+	}
+	defer target.Close()
+	entry.EgressAddr = proxy.LocalIP(target)
+
+	if err := writeReply(conn, replySucceeded, target.LocalAddr()); err != nil {
+		entry.StatusCode = http.StatusBadGateway
+		entry.CloseReason = proxy.CloseClientError
+		proxy.Record(entry)
+		return
+	}
+	entry.StatusCode = http.StatusOK
+
+	proxy.Pipe(proxy.ThrottleConn(client, state.BandwidthLimit), proxy.ThrottleConn(target, state.BandwidthLimit), entry, state.Conn)
+	logger.Debug("SOCKS5 tunnel to %s closed (%s): sent=%d received=%d",
+		host, entry.CloseReason, entry.BytesSent, entry.BytesReceived)
+	proxy.Record(entry)
+}
+
+var errAddressType = errors.New("unsupported address type")
+
+// readRequest parses the client's request and returns the command and the
+// destination as host:port.
+func readRequest(reader *bufio.Reader) (byte, string, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != version5 {
+		return 0, "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	host, err := readAddress(reader)
+	return header[1], host, err
+}
+
+// readAddress reads ATYP, DST.ADDR and DST.PORT.
+func readAddress(reader io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(reader, atyp); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		size := net.IPv4len
+		if atyp[0] == atypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case atypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(reader, length); err != nil {
+			return "", err
+		}
+		if length[0] == 0 {
+			return "", fmt.Errorf("%w: empty domain name", errAddressType)
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", errAddressType
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// appendAddress encodes addr as ATYP, BND.ADDR and BND.PORT.
+func appendAddress(buf []byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, atypIPv4)
+		buf = append(buf, ip4...)
+	} else if ip != nil {
+		buf = append(buf, atypIPv6)
+		buf = append(buf, ip.To16()...)
+	} else {
+		buf = append(buf, atypIPv4, 0, 0, 0, 0)
+	}
+	return append(buf, byte(port>>8), byte(port))
+}
+
+func writeReply(conn net.Conn, code byte, bound net.Addr) error {
+	reply := appendAddress([]byte{version5, code, 0x00}, bound)
+	_, err := conn.Write(reply)
+	return err
+}
+
+func readString(reader *bufio.Reader) (string, error) {
+	length, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+func dialErrorReply(err error) byte {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return replyHostUnreachable
+	case errors.As(err, &opErr) && opErr.Timeout():
+		return replyHostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return replyConnectionRefused
+	default:
+		return replyNetworkUnreachable
+	}
+}
+
+// bufferedConn keeps bytes the handshake reader already buffered, such as
+// data a client sends right after its request.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return proxy.CloseWrite(c.Conn)
+}
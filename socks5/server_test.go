@@ -0,0 +1,213 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/models"
+	"github.com/zulkan/zulgoproxy/proxy"
+)
+
+// recordingConn keeps what the server writes to the client.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) { return c.written.Write(p) }
+func (c *recordingConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 40000}
+}
+
+func newTestServer(anonymous bool) *Server {
+	return &Server{
+		Authenticate: func(username, password string) (*models.User, bool) {
+			if username == "alice" && password == "secret" {
+				return &models.User{ID: 7, Username: username}, true
+			}
+			return nil, false
+		},
+		AllowAnonymous: func(string) bool { return anonymous },
+	}
+}
+
+// credentials encodes an RFC 1929 request.
+func credentials(username, password string) []byte {
+	buf := []byte{authVersion1, byte(len(username))}
+	buf = append(buf, username...)
+	buf = append(buf, byte(len(password)))
+	return append(buf, password...)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     []byte
+		anonymous bool
+		user      string // authenticated user, "" for none
+		fails     bool
+		reply     []byte
+	}{
+		{"empty greeting", nil, true, "", true, nil},
+		{"truncated greeting", []byte{version5}, true, "", true, nil},
+		{"truncated methods", []byte{version5, 2, methodNoAuth}, true, "", true, nil},
+		{"SOCKS4 greeting", []byte{0x04, 1, methodNoAuth}, true, "", true, nil},
+		{"no methods", []byte{version5, 0}, true, "", true, []byte{version5, methodNoAcceptable}},
+		{"unsupported method", []byte{version5, 1, 0x01}, true, "", true, []byte{version5, methodNoAcceptable}},
+		{"anonymous refused", []byte{version5, 1, methodNoAuth}, false, "", true, []byte{version5, methodNoAcceptable}},
+		{"anonymous", []byte{version5, 1, methodNoAuth}, true, "", false, []byte{version5, methodNoAuth}},
+		{
+			"credentials preferred", join([]byte{version5, 2, methodNoAuth, methodUserPass}, credentials("alice", "secret")),
+			true, "alice", false, []byte{version5, methodUserPass, authVersion1, 0x00},
+		},
+		{
+			"bad password", join([]byte{version5, 1, methodUserPass}, credentials("alice", "wrong")),
+			true, "", true, []byte{version5, methodUserPass, authVersion1, 0x01},
+		},
+		{
+			"bad auth version", join([]byte{version5, 1, methodUserPass}, []byte{0x05}, credentials("alice", "secret")[1:]),
+			true, "", true, []byte{version5, methodUserPass},
+		},
+		{
+			"truncated credentials", join([]byte{version5, 1, methodUserPass}, credentials("alice", "secret")[:9]),
+			true, "", true, []byte{version5, methodUserPass},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &recordingConn{}
+			user, err := newTestServer(tt.anonymous).negotiate(bufio.NewReader(bytes.NewReader(tt.input)), conn)
+			if (err != nil) != tt.fails {
+				t.Fatalf("negotiate error = %v, want failure %v", err, tt.fails)
+			}
+			var username string
+			if user != nil {
+				username = user.Username
+			}
+			if username != tt.user {
+				t.Errorf("authenticated %q, want %q", username, tt.user)
+			}
+			if !bytes.Equal(conn.written.Bytes(), tt.reply) {
+				t.Errorf("replied % x, want % x", conn.written.Bytes(), tt.reply)
+			}
+		})
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	longName := strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + "." + strings.Repeat("c", 63) + "." + strings.Repeat("d", 63)
+	domain := func(name string, port ...byte) []byte {
+		return join([]byte{version5, cmdConnect, 0x00, atypDomain, byte(len(name))}, []byte(name), port)
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		host  string // "" when the request is refused
+		atyp  bool   // refused as an unsupported address type
+	}{
+		{"IPv4", []byte{version5, cmdConnect, 0x00, atypIPv4, 192, 0, 2, 1, 0x01, 0xBB}, "192.0.2.1:443", false},
+		{"IPv6", join([]byte{version5, cmdConnect, 0x00, atypIPv6}, net.ParseIP("2001:db8::1"), []byte{0x00, 0x50}), "[2001:db8::1]:80", false},
+		{"domain", domain("example.com", 0x00, 0x50), "example.com:80", false},
+		{"255-byte domain", domain(longName, 0x00, 0x50), longName + ":80", false},
+		{"empty domain", domain("", 0x00, 0x50), "", true},
+		{"truncated domain", domain("example.com")[:10], "", false},
+		{"missing port", domain("example.com"), "", false},
+		{"truncated IPv6", []byte{version5, cmdConnect, 0x00, atypIPv6, 0x20, 0x01}, "", false},
+		{"unknown address type", []byte{version5, cmdConnect, 0x00, 0x02, 0, 0}, "", true},
+		{"wrong version", []byte{0x04, cmdConnect, 0x00, atypIPv4, 192, 0, 2, 1, 0, 80}, "", false},
+		{"truncated header", []byte{version5, cmdConnect}, "", false},
+	}
+
+	if len(longName) != 255 {
+		t.Fatalf("test name is %d bytes", len(longName))
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, host, err := readRequest(bufio.NewReader(bytes.NewReader(tt.input)))
+			if tt.host == "" {
+				if err == nil {
+					t.Fatalf("parsed %q, want an error", host)
+				}
+				if errors.Is(err, errAddressType) != tt.atyp {
+					t.Errorf("error %v, want unsupported address type %v", err, tt.atyp)
+				}
+				return
+			}
+			if err != nil || cmd != cmdConnect || host != tt.host {
+				t.Errorf("readRequest = %d, %q, %v, want CONNECT to %q", cmd, host, err, tt.host)
+			}
+		})
+	}
+}
+
+func TestUDPFromClient(t *testing.T) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	targetAddr := target.LocalAddr().(*net.UDPAddr)
+
+	var authorized int32
+	session := &udpSession{
+		server: &Server{Authorize: func(state *proxy.RequestState, host string) string {
+			atomic.AddInt32(&authorized, 1)
+			if strings.HasPrefix(host, "denied.") {
+				return "blocked"
+			}
+			return ""
+		}},
+		state:   proxy.NewRequestState(nil),
+		relay:   relay,
+		allowed: make(map[string]bool),
+		peers:   make(map[string]bool),
+	}
+
+	header := func(frag byte) []byte {
+		return join([]byte{0x00, 0x00, frag, atypIPv4}, targetAddr.IP.To4(), []byte{byte(targetAddr.Port >> 8), byte(targetAddr.Port)})
+	}
+	denied := join([]byte{0x00, 0x00, 0x00, atypDomain, 14}, []byte("denied.example"), []byte{0x00, 0x35})
+
+	session.fromClient(append(header(1), "fragment"...))
+	session.fromClient(append(header(0x80), "last fragment"...))
+	session.fromClient([]byte{0x00, 0x00, 0x00})
+	session.fromClient(header(0)[:6])
+	session.fromClient(append(denied, "denied"...))
+	if n := atomic.LoadInt32(&authorized); n != 1 {
+		t.Errorf("%d destinations authorized, want only the well-formed denied one", n)
+	}
+	session.fromClient(append(header(0), "payload"...))
+
+	target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := target.Read(buf)
+	if err != nil {
+		t.Fatalf("nothing forwarded: %v", err)
+	}
+	if got := string(buf[:n]); got != "payload" {
+		t.Errorf("target received %q first, want only the unfragmented payload", got)
+	}
+	if sent := session.bytesSent(); sent != int64(len("payload")) {
+		t.Errorf("%d bytes counted as sent, want %d", sent, len("payload"))
+	}
+	if !session.peers[targetAddr.String()] {
+		t.Error("the destination may not reply")
+	}
+}
@@ -0,0 +1,200 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/proxy"
+)
+
+const maxDatagram = 65535
+
+// handleUDPAssociate relays datagrams for the client until its control
+// connection closes. Only destinations the client has sent to, and that pass
+// Authorize, can answer through the relay.
+func (s *Server) handleUDPAssociate(conn net.Conn, reader *bufio.Reader, state *proxy.RequestState) {
+	entry := state.StreamEntry(conn.RemoteAddr().String(), "SOCKS5 UDP", "")
+
+	if reason := s.Acquire(state, entry); reason != "" {
+		writeReply(conn, replyNotAllowed, nil)
+		entry.DenyReason = reason
+		entry.StatusCode = http.StatusForbidden
+		proxy.Record(entry)
+		return
+	}
+
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		logger.Error("SOCKS5 UDP relay bind failed: %v", err)
+		writeReply(conn, replyGeneralFailure, nil)
+		entry.StatusCode = http.StatusInternalServerError
+		proxy.Record(entry)
+		return
+	}
+
+	if err := writeReply(conn, replySucceeded, relay.LocalAddr()); err != nil {
+		relay.Close()
+		return
+	}
+	entry.StatusCode = http.StatusOK
+
+	// The association lasts as long as the control connection
+	go func() {
+		io.Copy(io.Discard, reader)
+		relay.Close()
+	}()
+
+	u := &udpSession{
+		server:  s,
+		state:   state,
+		relay:   relay,
+		allowed: make(map[string]bool),
+		peers:   make(map[string]bool),
+	}
+	state.Conn.SetCounters(u.bytesSent, u.bytesReceived)
+	state.Conn.SetCloser(func() {
+		relay.Close()
+		conn.Close()
+	})
+	u.serve(clientIP)
+
+	entry.Host = u.firstHost
+	entry.URL = u.firstHost
+	entry.BytesSent = u.bytesSent()
+	entry.BytesReceived = u.bytesReceived()
+	entry.RequestSize = entry.BytesSent
+	entry.ResponseSize = entry.BytesReceived
+	entry.DNSDuration = state.DNSTime().Milliseconds()
+	entry.CloseReason = proxy.CloseClientClosed
+	if reason := state.Conn.CloseReason(); reason != "" {
+		entry.CloseReason = reason
+	}
+	proxy.Record(entry)
+}
+
+type udpSession struct {
+	server    *Server
+	state     *proxy.RequestState
+	relay     *net.UDPConn
+	client    *net.UDPAddr
+	allowed   map[string]bool // destination host:port -> authorized
+	peers     map[string]bool // resolved destinations that may reply
+	firstHost string
+	sent      int64 // updated atomically; read by the live connection table
+	received  int64
+}
+
+func (u *udpSession) bytesSent() int64 {
+	return atomic.LoadInt64(&u.sent)
+}
+
+func (u *udpSession) bytesReceived() int64 {
+	return atomic.LoadInt64(&u.received)
+}
+
+func (u *udpSession) serve(clientIP net.IP) {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, from, err := u.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if from.IP.Equal(clientIP) && (u.client == nil || from.Port == u.client.Port) {
+			u.client = from
+			u.fromClient(buf[:n])
+			continue
+		}
+
+		if u.client != nil && u.peers[from.String()] {
+			u.toClient(from, buf[:n])
+		}
+	}
+}
+
+// fromClient forwards a client datagram. Fragmented datagrams are dropped.
+func (u *udpSession) fromClient(packet []byte) {
+	if len(packet) < 4 || packet[2] != 0x00 {
+		return
+	}
+
+	reader := bytes.NewReader(packet[3:])
+	host, err := readAddress(reader)
+	if err != nil {
+		return
+	}
+	payload := packet[len(packet)-reader.Len():]
+
+	allowed, seen := u.allowed[host]
+	if !seen {
+		reason := u.server.Authorize(u.state, host)
+		allowed = reason == ""
+		u.allowed[host] = allowed
+		if !allowed {
+			logger.Info("SOCKS5 UDP to %s denied: %s", host, reason)
+		}
+	}
+	if !allowed {
+		return
+	}
+	if u.firstHost == "" {
+		u.firstHost = host
+	}
+
+	target, err := u.resolve(host)
+	if err != nil {
+		logger.Debug("SOCKS5 UDP resolve %s failed: %v", host, err)
+		return
+	}
+	if u.server.CheckAddr != nil {
+		if err := u.server.CheckAddr(target.IP); err != nil {
+			logger.Info("SOCKS5 UDP to %s denied: %v", host, err)
+			return
+		}
+	}
+	u.peers[target.String()] = true
+
+	if n, err := u.relay.WriteToUDP(payload, target); err == nil {
+		atomic.AddInt64(&u.sent, int64(n))
+	}
+}
+
+// resolve turns a destination from a datagram header into an address.
+func (u *udpSession) resolve(host string) (*net.UDPAddr, error) {
+	if u.server.Lookup == nil {
+		return net.ResolveUDPAddr("udp", host)
+	}
+	name, portString, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := u.server.Lookup(proxy.WithState(context.Background(), u.state), name)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no address found", Addr: name}
+	}
+	return &net.UDPAddr{IP: ips[0], Port: port}, nil
+}
+
+// toClient wraps a reply from a destination and returns it to the client.
+func (u *udpSession) toClient(from *net.UDPAddr, payload []byte) {
+	header := appendAddress([]byte{0x00, 0x00, 0x00}, from)
+	if n, err := u.relay.WriteToUDP(append(header, payload...), u.client); err == nil && n > len(header) {
+		atomic.AddInt64(&u.received, int64(n-len(header)))
+	}
+}
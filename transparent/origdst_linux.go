@@ -0,0 +1,41 @@
+//go:build linux
+
+package transparent
+
+import (
+	"net"
+	"syscall"
+)
+
+// soOriginalDst is netfilter's SO_ORIGINAL_DST socket option.
+const soOriginalDst = 80
+
+// originalDestination returns where a connection redirected by an iptables
+// REDIRECT or DNAT rule was headed before it was redirected. Only IPv4 is
+// supported.
+func originalDestination(conn net.Conn) (*net.TCPAddr, bool) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, false
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+
+	var addr *net.TCPAddr
+	raw.Control(func(fd uintptr) {
+		// The option fills a struct sockaddr_in, which fits in the 20 bytes
+		// of an IPv6Mreq
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+		if err != nil {
+			return
+		}
+		sa := mreq.Multiaddr
+		addr = &net.TCPAddr{
+			IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+			Port: int(sa[2])<<8 | int(sa[3]),
+		}
+	})
+	return addr, addr != nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package transparent
+
+import "net"
+
+// originalDestination is only available with netfilter.
+func originalDestination(conn net.Conn) (*net.TCPAddr, bool) {
+	return nil, false
+}
@@ -0,0 +1,247 @@
+// Package transparent accepts TCP connections redirected to the proxy by a
+// firewall rule, for clients that cannot be configured with a proxy. The
+// destination is taken from the Host header of plain HTTP and from the SNI of
+// a TLS ClientHello; TLS is passed through, never terminated. The port of a
+// TLS destination is the one the client originally connected to.
+package transparent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/logger"
+	"github.com/zulkan/zulgoproxy/models"
+	"github.com/zulkan/zulgoproxy/proxy"
+)
+
+const (
+	sniffTimeout = 30 * time.Second
+	// recordTypeHandshake starts every TLS ClientHello
+	recordTypeHandshake = 0x16
+)
+
+// Server accepts redirected connections. Like the SOCKS5 server, the
+// callbacks connect it to the rest of the proxy so every listener enforces
+// the same policy.
+type Server struct {
+	// HTTP serves plain HTTP requests, rewritten to absolute URLs as an
+	// explicit proxy client would send them.
+	HTTP http.Handler
+	// AllowClient reports whether a client may pass TLS through the listener.
+	// Plain HTTP is checked by HTTP itself.
+	AllowClient func(remoteAddr string) bool
+	// Authorize returns a reason when the destination is refused.
+	Authorize func(state *proxy.RequestState, host string) string
+	// Acquire reserves a connection slot for the session described by entry,
+	// registering its release on state, and returns a reason when none is
+	// available.
+	Acquire func(state *proxy.RequestState, entry *models.ProxyLog) string
+	// Dial opens the outbound connection for TLS.
+	Dial proxy.DialFunc
+	// TLSPort is the destination port of TLS whose original port cannot be
+	// recovered from the connection; 0 means 443.
+	TLSPort int
+}
+
+// ListenAndServe accepts redirected connections on addr until the listener
+// fails.
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+
+	// Plain HTTP connections are handed to an http.Server so keep-alive
+	// requests are each checked and logged
+	httpConns := proxy.NewConnListener(listener.Addr())
+	defer httpConns.Close()
+	go (&http.Server{Handler: http.HandlerFunc(s.serveHTTP)}).Serve(httpConns)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(conn, httpConns)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn, httpConns *proxy.ConnListener) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	first, err := reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	client := &bufferedConn{Conn: conn, reader: reader}
+	if first[0] != recordTypeHandshake {
+		if !httpConns.Push(client) {
+			conn.Close()
+		}
+		return
+	}
+
+	defer conn.Close()
+	s.serveTLS(client, httpConns.Addr())
+}
+
+// serveHTTP makes the request look like one sent to an explicit proxy.
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodConnect {
+		http.Error(w, "CONNECT is not supported by the transparent listener", http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Host == "" {
+		http.Error(w, "Missing Host header", http.StatusBadRequest)
+		return
+	}
+
+	req.URL.Scheme = "http"
+	req.URL.Host = req.Host
+	s.HTTP.ServeHTTP(w, req)
+}
+
+// serveTLS tunnels a TLS connection to the server named in its SNI.
+func (s *Server) serveTLS(client *bufferedConn, listenAddr net.Addr) {
+	conn := client.Conn
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	serverName, hello, err := readServerName(client)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		logger.Debug("Transparent TLS from %s dropped: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	host := net.JoinHostPort(serverName, s.destinationPort(conn, listenAddr))
+	state := proxy.NewRequestState(nil)
+	defer state.Finish()
+	entry := state.StreamEntry(conn.RemoteAddr().String(), "TRANSPARENT TLS", host)
+
+	reason := ""
+	if !s.AllowClient(conn.RemoteAddr().String()) {
+		reason = "client address not allowed"
+	}
+	if reason == "" {
+		reason = s.Authorize(state, host)
+	}
+	if reason == "" {
+		reason = s.Acquire(state, entry)
+	}
+	if reason != "" {
+		logger.Info("Transparent TLS to %s from %s denied: %s", host, conn.RemoteAddr(), reason)
+		entry.DenyReason = reason
+		entry.StatusCode = http.StatusForbidden
+		proxy.Record(entry)
+		return
+	}
+
+	target, err := s.Dial(proxy.WithState(context.Background(), state), "tcp", host)
+	entry.DNSDuration = state.DNSTime().Milliseconds()
+	if err != nil {
+		logger.Warn("Transparent TLS to %s failed: %v", host, err)
+		entry.StatusCode = http.StatusBadGateway
+		entry.CloseReason = proxy.CloseDialFailed
+		proxy.Record(entry)
+		return
+	}
+	defer target.Close()
+	entry.EgressAddr = proxy.LocalIP(target)
+	entry.StatusCode = http.StatusOK
+
+	// The ClientHello already read is replayed to the destination
+	client.reader = bufio.NewReader(io.MultiReader(bytes.NewReader(hello), client.reader))
+	proxy.Pipe(proxy.ThrottleConn(client, state.BandwidthLimit), proxy.ThrottleConn(target, state.BandwidthLimit), entry, state.Conn)
+	logger.Debug("Transparent tunnel to %s closed (%s): sent=%d received=%d",
+		host, entry.CloseReason, entry.BytesSent, entry.BytesReceived)
+	proxy.Record(entry)
+}
+
+// destinationPort returns the port a redirected connection was sent to. A
+// REDIRECT or DNAT rule leaves it for SO_ORIGINAL_DST; a TPROXY rule keeps it
+// as the connection's local address. A connection that seems to have been
+// sent to the listener itself gets TLSPort.
+func (s *Server) destinationPort(conn net.Conn, listenAddr net.Addr) string {
+	var port int
+	if addr, ok := originalDestination(conn); ok {
+		port = addr.Port
+	} else if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		port = addr.Port
+	}
+	if listener, ok := listenAddr.(*net.TCPAddr); ok && port == listener.Port {
+		port = 0
+	}
+	if port == 0 {
+		port = s.TLSPort
+	}
+	if port == 0 {
+		port = 443
+	}
+	return strconv.Itoa(port)
+}
+
+var errHelloRead = errors.New("hello read")
+
+// readServerName reads the ClientHello from r and returns its SNI along with
+// the bytes consumed. crypto/tls does the parsing; the handshake is abandoned
+// as soon as the hello has been seen.
+func readServerName(r io.Reader) (string, []byte, error) {
+	var hello bytes.Buffer
+	var serverName string
+	err := tls.Server(helloConn{reader: io.TeeReader(r, &hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloRead) {
+		return "", nil, err
+	}
+	if serverName == "" {
+		return "", nil, errors.New("ClientHello has no server name")
+	}
+	return serverName, hello.Bytes(), nil
+}
+
+// helloConn lets crypto/tls read a ClientHello without writing anything back.
+type helloConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error)  { return c.reader.Read(p) }
+func (c helloConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// bufferedConn keeps bytes read while sniffing the protocol.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return proxy.CloseWrite(c.Conn)
+}
@@ -0,0 +1,126 @@
+package transparent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// captureConn records what crypto/tls writes and reads nothing back, so a
+// client handshake stops right after sending its ClientHello.
+type captureConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *captureConn) Write(p []byte) (int, error) { return c.written.Write(p) }
+func (c *captureConn) Read(p []byte) (int, error)  { return 0, io.EOF }
+
+func clientHello(t *testing.T, config *tls.Config) []byte {
+	t.Helper()
+	conn := &captureConn{}
+	tls.Client(conn, config).Handshake()
+	if conn.written.Len() == 0 {
+		t.Fatal("the client sent no ClientHello")
+	}
+	return conn.written.Bytes()
+}
+
+// extensionsOffset returns where the extensions length field of hello is.
+func extensionsOffset(t *testing.T, hello []byte) int {
+	t.Helper()
+	// Record and handshake headers, version and random
+	offset := 5 + 4 + 2 + 32
+	offset += 1 + int(hello[offset])                                   // session ID
+	offset += 2 + int(binary.BigEndian.Uint16(hello[offset:offset+2])) // cipher suites
+	offset += 1 + int(hello[offset])                                   // compression methods
+	if offset+2 > len(hello) {
+		t.Fatal("ClientHello has no extensions")
+	}
+	return offset
+}
+
+func TestReadServerName(t *testing.T) {
+	hello := clientHello(t, &tls.Config{ServerName: "www.example.com"})
+
+	name, consumed, err := readServerName(bytes.NewReader(hello))
+	if err != nil || name != "www.example.com" {
+		t.Fatalf("readServerName = %q, %v, want www.example.com", name, err)
+	}
+	if !bytes.Equal(consumed, hello) {
+		t.Errorf("consumed %d bytes, want the %d-byte ClientHello to replay", len(consumed), len(hello))
+	}
+
+	// Followed by more data, as when the client pipelines
+	name, consumed, err = readServerName(io.MultiReader(bytes.NewReader(hello), strings.NewReader("early data")))
+	if err != nil || name != "www.example.com" || !bytes.HasPrefix(consumed, hello) {
+		t.Errorf("with trailing data, readServerName = %q, %v", name, err)
+	}
+}
+
+func TestReadServerNameSplitAcrossReads(t *testing.T) {
+	hello := clientHello(t, &tls.Config{ServerName: "split.example.com"})
+
+	name, consumed, err := readServerName(iotest.OneByteReader(bytes.NewReader(hello)))
+	if err != nil || name != "split.example.com" {
+		t.Fatalf("readServerName one byte at a time = %q, %v", name, err)
+	}
+	if !bytes.Equal(consumed, hello) {
+		t.Errorf("consumed %d bytes, want %d", len(consumed), len(hello))
+	}
+
+	// The same hello split over two TLS records
+	body := hello[5:]
+	half := len(body) / 2
+	var records []byte
+	for _, part := range [][]byte{body[:half], body[half:]} {
+		records = append(records, hello[0], hello[1], hello[2], byte(len(part)>>8), byte(len(part)))
+		records = append(records, part...)
+	}
+	if name, _, err := readServerName(bytes.NewReader(records)); err != nil || name != "split.example.com" {
+		t.Errorf("readServerName over two records = %q, %v", name, err)
+	}
+}
+
+func TestReadServerNameRejectsMalformedHellos(t *testing.T) {
+	hello := clientHello(t, &tls.Config{ServerName: "www.example.com"})
+	extensions := extensionsOffset(t, hello)
+
+	withUint16 := func(offset int, value uint16) []byte {
+		mutated := append([]byte(nil), hello...)
+		binary.BigEndian.PutUint16(mutated[offset:], value)
+		return mutated
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"plain HTTP", []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")},
+		{"no server name", clientHello(t, &tls.Config{ServerName: "192.0.2.1", InsecureSkipVerify: true})},
+		{"oversized record", withUint16(3, 0xFFFF)},
+		{"oversized extensions", withUint16(extensions, 0xFFFF)},
+		{"oversized first extension", withUint16(extensions+4, 0xFFFF)},
+		{"extensions cut short", withUint16(extensions, binary.BigEndian.Uint16(hello[extensions:])-3)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if name, _, err := readServerName(bytes.NewReader(tt.input)); err == nil {
+				t.Errorf("readServerName = %q, want an error", name)
+			}
+		})
+	}
+
+	// Every truncation of a valid hello fails cleanly
+	for n := 0; n < len(hello); n++ {
+		if name, _, err := readServerName(bytes.NewReader(hello[:n])); err == nil {
+			t.Fatalf("readServerName of the first %d bytes = %q, want an error", n, name)
+		}
+	}
+}
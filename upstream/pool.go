@@ -0,0 +1,240 @@
+package upstream
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/config"
+	"github.com/zulkan/zulgoproxy/logger"
+)
+
+// Pool load-balancing strategies
+const (
+	StrategyRoundRobin       = "round_robin"
+	StrategyLeastConnections = "least_connections"
+	StrategyConsistentHash   = "consistent_hash"
+)
+
+// Virtual nodes per member on the consistent hash ring
+const ringReplicas = 100
+
+// Pool balances connections across its healthy members. Members are probed
+// in the background; a member failing several probes in a row is ejected
+// until it passes several in a row again.
+type Pool struct {
+	name     string
+	strategy string
+	members  []*member
+	ring     []ringPoint
+	next     uint32
+	check    config.HealthCheckConfig
+}
+
+type member struct {
+	upstream *Upstream
+
+	mutex     sync.RWMutex
+	healthy   bool
+	failures  int
+	successes int
+	lastCheck time.Time
+	lastError string
+}
+
+type ringPoint struct {
+	hash  uint32
+	index int
+}
+
+// PoolStatus is the admin view of a pool.
+type PoolStatus struct {
+	Name     string         `json:"name"`
+	Strategy string         `json:"strategy"`
+	Members  []MemberStatus `json:"members"`
+}
+
+type MemberStatus struct {
+	Name                string     `json:"name"`
+	URL                 string     `json:"url"`
+	Healthy             bool       `json:"healthy"`
+	ActiveConnections   int64      `json:"active_connections"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastCheck           *time.Time `json:"last_check"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+func newPool(cfg config.UpstreamPool, upstreams map[string]*Upstream) (*Pool, error) {
+	if cfg.Strategy == "" {
+		cfg.Strategy = StrategyRoundRobin
+	}
+	switch cfg.Strategy {
+	case StrategyRoundRobin, StrategyLeastConnections, StrategyConsistentHash:
+	default:
+		return nil, fmt.Errorf("pool %s: unknown strategy %q", cfg.Name, cfg.Strategy)
+	}
+	if len(cfg.Members) == 0 {
+		return nil, fmt.Errorf("pool %s has no members", cfg.Name)
+	}
+
+	if cfg.HealthCheck.Interval <= 0 {
+		cfg.HealthCheck.Interval = 10
+	}
+	if cfg.HealthCheck.Timeout <= 0 {
+		cfg.HealthCheck.Timeout = 3
+	}
+	if cfg.HealthCheck.Failures <= 0 {
+		cfg.HealthCheck.Failures = 3
+	}
+	if cfg.HealthCheck.Successes <= 0 {
+		cfg.HealthCheck.Successes = 2
+	}
+
+	p := &Pool{
+		name:     cfg.Name,
+		strategy: cfg.Strategy,
+		check:    cfg.HealthCheck,
+	}
+	for i, name := range cfg.Members {
+		up, exists := upstreams[name]
+		if !exists {
+			return nil, fmt.Errorf("pool %s: unknown upstream %q", cfg.Name, name)
+		}
+		p.members = append(p.members, &member{upstream: up, healthy: true})
+
+		for r := 0; r < ringReplicas; r++ {
+			p.ring = append(p.ring, ringPoint{hash: hashKey(name + "#" + strconv.Itoa(r)), index: i})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+
+	return p, nil
+}
+
+// pick chooses a healthy member. key is used by the consistent hash strategy;
+// without one it falls back to round robin.
+func (p *Pool) pick(key string) (*Upstream, error) {
+	if p.strategy == StrategyConsistentHash && key != "" {
+		return p.pickHashed(key)
+	}
+
+	healthy := make([]*Upstream, 0, len(p.members))
+	for _, m := range p.members {
+		if m.isHealthy() {
+			healthy = append(healthy, m.upstream)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil, fmt.Errorf("no healthy upstream in pool %s", p.name)
+	}
+
+	if p.strategy == StrategyLeastConnections {
+		best := healthy[0]
+		for _, up := range healthy[1:] {
+			if up.ActiveConnections() < best.ActiveConnections() {
+				best = up
+			}
+		}
+		return best, nil
+	}
+
+	n := atomic.AddUint32(&p.next, 1)
+	return healthy[int(n-1)%len(healthy)], nil
+}
+
+// pickHashed walks the ring from key's position to the first healthy member,
+// so a user only moves when their upstream is ejected.
+func (p *Pool) pickHashed(key string) (*Upstream, error) {
+	h := hashKey(key)
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	for i := 0; i < len(p.ring); i++ {
+		m := p.members[p.ring[(start+i)%len(p.ring)].index]
+		if m.isHealthy() {
+			return m.upstream, nil
+		}
+	}
+	return nil, fmt.Errorf("no healthy upstream in pool %s", p.name)
+}
+
+func hashKey(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// Status reports the pool's members and their health.
+func (p *Pool) Status() PoolStatus {
+	status := PoolStatus{Name: p.name, Strategy: p.strategy}
+	for _, m := range p.members {
+		m.mutex.RLock()
+		ms := MemberStatus{
+			Name:                m.upstream.Name,
+			URL:                 m.upstream.URL.Redacted(),
+			Healthy:             m.healthy,
+			ActiveConnections:   m.upstream.ActiveConnections(),
+			ConsecutiveFailures: m.failures,
+			LastError:           m.lastError,
+		}
+		if !m.lastCheck.IsZero() {
+			lastCheck := m.lastCheck
+			ms.LastCheck = &lastCheck
+		}
+		m.mutex.RUnlock()
+		status.Members = append(status.Members, ms)
+	}
+	return status
+}
+
+func (p *Pool) healthCheck() {
+	ticker := time.NewTicker(time.Duration(p.check.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, m := range p.members {
+			go p.probe(m)
+		}
+	}
+}
+
+// probe opens a TCP connection to the member and updates its health.
+func (p *Pool) probe(m *member) {
+	timeout := time.Duration(p.check.Timeout) * time.Second
+	conn, err := net.DialTimeout("tcp", m.upstream.addr, timeout)
+	if err == nil {
+		conn.Close()
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.lastCheck = time.Now()
+	if err != nil {
+		m.lastError = err.Error()
+		m.failures++
+		m.successes = 0
+		if m.healthy && m.failures >= p.check.Failures {
+			m.healthy = false
+			logger.Warn("Upstream %s ejected from pool %s: %v", m.upstream.Name, p.name, err)
+		}
+		return
+	}
+
+	m.lastError = ""
+	m.failures = 0
+	m.successes++
+	if !m.healthy && m.successes >= p.check.Successes {
+		m.healthy = true
+		logger.Info("Upstream %s restored to pool %s", m.upstream.Name, p.name)
+	}
+}
+
+func (m *member) isHealthy() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.healthy
+}
@@ -0,0 +1,187 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zulkan/zulgoproxy/config"
+)
+
+func newTestPool(t *testing.T, strategy string, check config.HealthCheckConfig, addrs ...string) *Pool {
+	t.Helper()
+	upstreams := make(map[string]*Upstream)
+	cfg := config.UpstreamPool{Name: "pool", Strategy: strategy, HealthCheck: check}
+	for i, addr := range addrs {
+		name := fmt.Sprintf("up%d", i)
+		upstreams[name] = &Upstream{Name: name, addr: addr}
+		cfg.Members = append(cfg.Members, name)
+	}
+	pool, err := newPool(cfg, upstreams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func mustPick(t *testing.T, p *Pool, key string) string {
+	t.Helper()
+	up, err := p.pick(key)
+	if err != nil {
+		t.Fatalf("pick(%q): %v", key, err)
+	}
+	return up.Name
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	pool := newTestPool(t, StrategyRoundRobin, config.HealthCheckConfig{}, "a:1", "b:1", "c:1")
+
+	var got []string
+	for i := 0; i < 6; i++ {
+		got = append(got, mustPick(t, pool, "alice"))
+	}
+	if fmt.Sprint(got) != "[up0 up1 up2 up0 up1 up2]" {
+		t.Errorf("picked %v, want each member in turn", got)
+	}
+
+	pool.members[1].healthy = false
+	got = got[:0]
+	for i := 0; i < 4; i++ {
+		got = append(got, mustPick(t, pool, ""))
+	}
+	for _, name := range got {
+		if name == "up1" {
+			t.Fatalf("picked %v, including the ejected up1", got)
+		}
+	}
+}
+
+func TestPoolLeastConnections(t *testing.T) {
+	pool := newTestPool(t, StrategyLeastConnections, config.HealthCheckConfig{}, "a:1", "b:1", "c:1")
+	set := func(active ...int64) {
+		for i, n := range active {
+			atomic.StoreInt64(&pool.members[i].upstream.active, n)
+		}
+	}
+
+	tests := []struct {
+		active  []int64
+		ejected int // member index, -1 for none
+		want    string
+	}{
+		{[]int64{0, 0, 0}, -1, "up0"},
+		{[]int64{2, 1, 3}, -1, "up1"},
+		{[]int64{2, 3, 0}, -1, "up2"},
+		{[]int64{2, 3, 0}, 2, "up0"},
+		{[]int64{1, 1, 1}, 0, "up1"},
+	}
+	for _, tt := range tests {
+		set(tt.active...)
+		for i, m := range pool.members {
+			m.healthy = i != tt.ejected
+		}
+		if got := mustPick(t, pool, ""); got != tt.want {
+			t.Errorf("active %v, ejected %d: picked %s, want %s", tt.active, tt.ejected, got, tt.want)
+		}
+	}
+}
+
+func TestPoolConsistentHash(t *testing.T) {
+	pool := newTestPool(t, StrategyConsistentHash, config.HealthCheckConfig{}, "a:1", "b:1", "c:1")
+
+	users := make([]string, 50)
+	assigned := make(map[string]string)
+	spread := make(map[string]int)
+	for i := range users {
+		users[i] = fmt.Sprintf("user%d", i)
+		assigned[users[i]] = mustPick(t, pool, users[i])
+		spread[assigned[users[i]]]++
+	}
+	if len(spread) != 3 {
+		t.Errorf("users spread over %v, want all three members", spread)
+	}
+	for _, user := range users {
+		if got := mustPick(t, pool, user); got != assigned[user] {
+			t.Fatalf("%s moved from %s to %s", user, assigned[user], got)
+		}
+	}
+
+	// Ejecting a member only moves its own users, who come back on restore
+	pool.members[1].healthy = false
+	for _, user := range users {
+		got := mustPick(t, pool, user)
+		switch {
+		case assigned[user] == "up1" && got == "up1":
+			t.Errorf("%s still on the ejected up1", user)
+		case assigned[user] != "up1" && got != assigned[user]:
+			t.Errorf("%s moved from %s to %s when up1 was ejected", user, assigned[user], got)
+		}
+	}
+	pool.members[1].healthy = true
+	for _, user := range users {
+		if got := mustPick(t, pool, user); got != assigned[user] {
+			t.Errorf("%s on %s after up1 was restored, want %s", user, got, assigned[user])
+		}
+	}
+}
+
+func TestPoolNoHealthyMember(t *testing.T) {
+	for _, strategy := range []string{StrategyRoundRobin, StrategyLeastConnections, StrategyConsistentHash} {
+		pool := newTestPool(t, strategy, config.HealthCheckConfig{}, "a:1", "b:1")
+		for _, m := range pool.members {
+			m.healthy = false
+		}
+		if up, err := pool.pick("alice"); err == nil {
+			t.Errorf("%s picked %s with every member ejected", strategy, up.Name)
+		}
+	}
+}
+
+func TestPoolHealthCheckEjectsAndRestores(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	pool := newTestPool(t, StrategyRoundRobin, config.HealthCheckConfig{Timeout: 1, Failures: 2, Successes: 2}, addr, "b:1")
+	m := pool.members[0]
+
+	pool.probe(m)
+	if !m.isHealthy() {
+		t.Fatal("ejected after one failed probe, want two")
+	}
+	pool.probe(m)
+	if m.isHealthy() {
+		t.Fatal("still healthy after two failed probes")
+	}
+	status := pool.Status().Members[0]
+	if status.Healthy || status.ConsecutiveFailures != 2 || status.LastError == "" || status.LastCheck == nil {
+		t.Errorf("status = %+v, want ejected with the probe error", status)
+	}
+	for i := 0; i < 4; i++ {
+		if got := mustPick(t, pool, ""); got != "up1" {
+			t.Fatalf("picked the ejected %s", got)
+		}
+	}
+
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("could not listen on %s again: %v", addr, err)
+	}
+	defer listener.Close()
+
+	pool.probe(m)
+	if m.isHealthy() {
+		t.Fatal("restored after one successful probe, want two")
+	}
+	pool.probe(m)
+	if !m.isHealthy() {
+		t.Fatal("still ejected after two successful probes")
+	}
+	if status := pool.Status().Members[0]; status.ConsecutiveFailures != 0 || status.LastError != "" {
+		t.Errorf("status = %+v, want the failures cleared", status)
+	}
+}
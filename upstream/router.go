@@ -0,0 +1,422 @@
+// Package upstream chains the proxy through other HTTP or SOCKS5 proxies,
+// choosing per destination between a direct connection, a named upstream and
+// a load-balanced pool of upstreams.
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zulkan/zulgoproxy/config"
+	"github.com/zulkan/zulgoproxy/proxy"
+	"github.com/zulkan/zulgoproxy/resolver"
+	xproxy "golang.org/x/net/proxy"
+)
+
+// Direct is the route name for connecting without an upstream.
+const Direct = "direct"
+
+// target is what a route resolves to: a single upstream or a pool.
+type target interface {
+	pick(key string) (*Upstream, error)
+}
+
+// Upstream is a configured upstream proxy.
+type Upstream struct {
+	Name string
+	URL  *url.URL
+
+	addr   string // host:port of the proxy itself
+	active int64
+}
+
+func (u *Upstream) pick(string) (*Upstream, error) {
+	return u, nil
+}
+
+// ActiveConnections returns the number of requests and tunnels in flight
+// through u. Idle keep-alive connections do not count.
+func (u *Upstream) ActiveConnections() int64 {
+	return atomic.LoadInt64(&u.active)
+}
+
+type route struct {
+	hosts  []string
+	target target // nil for direct
+}
+
+// Router picks the upstream for each destination. The first route whose host
+// patterns match wins; otherwise the default route applies.
+type Router struct {
+	upstreams map[string]*Upstream
+	byAddr    map[string]*Upstream
+	pools     map[string]*Pool
+	routes    []route
+	fallback  target
+	dialer    net.Dialer      // to upstream proxies
+	direct    resolver.Dialer // to destinations
+}
+
+// NewRouter builds the router for cfg. Direct connections resolve names with
+// res, when set, and are checked by guard, when set, at connect time.
+func NewRouter(cfg config.UpstreamConfig, guard *proxy.DestinationGuard, res *resolver.Resolver) (*Router, error) {
+	r := &Router{
+		upstreams: make(map[string]*Upstream),
+		byAddr:    make(map[string]*Upstream),
+		pools:     make(map[string]*Pool),
+	}
+	r.direct.Resolver = res
+	if guard != nil {
+		r.direct.Control = guard.Control
+	}
+
+	for _, p := range cfg.Proxies {
+		if err := r.checkUnused(p.Name); err != nil {
+			return nil, err
+		}
+		u, err := url.Parse(p.URL)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: invalid url: %w", p.Name, err)
+		}
+		port := u.Port()
+		switch u.Scheme {
+		case "http":
+			if port == "" {
+				port = "80"
+			}
+		case "https":
+			if port == "" {
+				port = "443"
+			}
+		case "socks5", "socks5h":
+			if port == "" {
+				port = "1080"
+			}
+		default:
+			return nil, fmt.Errorf("upstream %s: unsupported scheme %q", p.Name, u.Scheme)
+		}
+		if p.Username != "" {
+			u.User = url.UserPassword(p.Username, p.Password)
+		}
+
+		up := &Upstream{Name: p.Name, URL: u, addr: net.JoinHostPort(u.Hostname(), port)}
+		r.upstreams[p.Name] = up
+		r.byAddr[up.addr] = up
+	}
+
+	for _, p := range cfg.Pools {
+		if err := r.checkUnused(p.Name); err != nil {
+			return nil, err
+		}
+		pool, err := newPool(p, r.upstreams)
+		if err != nil {
+			return nil, err
+		}
+		r.pools[p.Name] = pool
+	}
+
+	for _, rt := range cfg.Routes {
+		t, err := r.resolve(rt.Upstream)
+		if err != nil {
+			return nil, err
+		}
+		r.routes = append(r.routes, route{hosts: rt.Hosts, target: t})
+	}
+
+	fallback, err := r.resolve(cfg.Default)
+	if err != nil {
+		return nil, err
+	}
+	r.fallback = fallback
+
+	for _, pool := range r.pools {
+		go pool.healthCheck()
+	}
+
+	return r, nil
+}
+
+func (r *Router) checkUnused(name string) error {
+	if name == "" || name == Direct {
+		return fmt.Errorf("invalid upstream name %q", name)
+	}
+	if _, exists := r.upstreams[name]; exists {
+		return fmt.Errorf("duplicate upstream name %q", name)
+	}
+	if _, exists := r.pools[name]; exists {
+		return fmt.Errorf("duplicate upstream name %q", name)
+	}
+	return nil
+}
+
+func (r *Router) resolve(name string) (target, error) {
+	if name == "" || name == Direct {
+		return nil, nil
+	}
+	if up, exists := r.upstreams[name]; exists {
+		return up, nil
+	}
+	if pool, exists := r.pools[name]; exists {
+		return pool, nil
+	}
+	return nil, fmt.Errorf("unknown upstream %q", name)
+}
+
+// Pools returns the state of every upstream pool.
+func (r *Router) Pools() []PoolStatus {
+	statuses := make([]PoolStatus, 0, len(r.pools))
+	for _, pool := range r.pools {
+		statuses = append(statuses, pool.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// pick returns the upstream for host, or nil for a direct connection. Pools
+// hash on the proxy user carried in ctx.
+func (r *Router) pick(ctx context.Context, host string) (*Upstream, error) {
+	t := r.fallback
+	for _, rt := range r.routes {
+		if proxy.MatchAnyHost(rt.hosts, host) {
+			t = rt.target
+			break
+		}
+	}
+	if t == nil {
+		return nil, nil
+	}
+
+	var key string
+	if state := proxy.StateFromContext(ctx); state != nil && state.User != nil {
+		key = state.User.Username
+	}
+	return t.pick(key)
+}
+
+// routeKey carries the upstream Transport picked for a request, so that
+// ProxyURL sends the request where Transport counted it.
+type routeKey struct{}
+
+type routedTo struct {
+	upstream *Upstream // nil for direct
+}
+
+// ProxyURL is used as http.Transport.Proxy for plain HTTP requests.
+func (r *Router) ProxyURL(req *http.Request) (*url.URL, error) {
+	if routed, ok := req.Context().Value(routeKey{}).(routedTo); ok {
+		if routed.upstream == nil {
+			return nil, nil
+		}
+		return routed.upstream.URL, nil
+	}
+
+	up, err := r.pick(req.Context(), req.URL.Host)
+	if up == nil || err != nil {
+		return nil, err
+	}
+	return up.URL, nil
+}
+
+// Transport wraps next, whose Proxy must be ProxyURL, so that requests count
+// towards their upstream's active connections until their body is closed.
+func (r *Router) Transport(next http.RoundTripper) http.RoundTripper {
+	return &routedTransport{router: r, next: next}
+}
+
+type routedTransport struct {
+	router *Router
+	next   http.RoundTripper
+}
+
+func (t *routedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	up, err := t.router.pick(req.Context(), req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(context.WithValue(req.Context(), routeKey{}, routedTo{upstream: up}))
+	if up == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	atomic.AddInt64(&up.active, 1)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		atomic.AddInt64(&up.active, -1)
+		return nil, err
+	}
+	resp.Body = trackBody(up, resp.Body)
+	return resp, nil
+}
+
+// TransportDial is used as http.Transport.DialContext. Connections to
+// upstreams are not counted here, since an idle keep-alive connection carries
+// no load; Transport counts the requests using them instead.
+func (r *Router) TransportDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if _, exists := r.byAddr[addr]; exists {
+		return r.dialer.DialContext(ctx, network, addr)
+	}
+	return r.direct.DialContext(ctx, network, addr)
+}
+
+// Dial is used as goproxy's ConnectDial.
+func (r *Router) Dial(network, addr string) (net.Conn, error) {
+	return r.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr directly or through its upstream. It is used
+// for CONNECT tunnels and SOCKS5 sessions.
+func (r *Router) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	up, err := r.pick(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if up == nil {
+		return r.direct.DialContext(ctx, network, addr)
+	}
+
+	conn, err := r.dialVia(ctx, up, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return track(up, conn), nil
+}
+
+func (r *Router) dialVia(ctx context.Context, up *Upstream, network, addr string) (net.Conn, error) {
+	switch up.URL.Scheme {
+	case "socks5", "socks5h":
+		var auth *xproxy.Auth
+		if up.URL.User != nil {
+			password, _ := up.URL.User.Password()
+			auth = &xproxy.Auth{User: up.URL.User.Username(), Password: password}
+		}
+		socks, err := xproxy.SOCKS5("tcp", up.addr, auth, &r.dialer)
+		if err != nil {
+			return nil, err
+		}
+		if cd, ok := socks.(xproxy.ContextDialer); ok {
+			return cd.DialContext(ctx, network, addr)
+		}
+		return socks.Dial(network, addr)
+	default:
+		return r.connectVia(ctx, up, addr)
+	}
+}
+
+// connectVia opens a tunnel to addr through an HTTP(S) upstream with CONNECT.
+func (r *Router) connectVia(ctx context.Context, up *Upstream, addr string) (net.Conn, error) {
+	conn, err := r.dialer.DialContext(ctx, "tcp", up.addr)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s unreachable: %w", up.Name, err)
+	}
+	if up.URL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: up.URL.Hostname()})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if up.URL.User != nil {
+		password, _ := up.URL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(up.URL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream %s refused CONNECT to %s: %s", up.Name, addr, strings.TrimSpace(resp.Status))
+	}
+
+	// Bytes the destination sent right after the 200, such as an SSH
+	// banner, may already be buffered
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn reads through the reader that parsed the CONNECT response.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return proxy.CloseWrite(c.Conn)
+}
+
+// trackedConn counts towards its upstream's active connections until closed.
+type trackedConn struct {
+	net.Conn
+	upstream *Upstream
+	once     sync.Once
+}
+
+func track(up *Upstream, conn net.Conn) net.Conn {
+	atomic.AddInt64(&up.active, 1)
+	return &trackedConn{Conn: conn, upstream: up}
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.upstream.active, -1) })
+	return c.Conn.Close()
+}
+
+func (c *trackedConn) CloseWrite() error {
+	return proxy.CloseWrite(c.Conn)
+}
+
+// trackedBody counts towards its upstream's active connections until closed.
+type trackedBody struct {
+	io.ReadCloser
+	upstream *Upstream
+	once     sync.Once
+}
+
+// trackedUpgradeBody is the body of a 101 response, which stays writable.
+type trackedUpgradeBody struct {
+	*trackedBody
+	writer io.Writer
+}
+
+func trackBody(up *Upstream, body io.ReadCloser) io.ReadCloser {
+	tracked := &trackedBody{ReadCloser: body, upstream: up}
+	if rw, ok := body.(io.ReadWriteCloser); ok {
+		return &trackedUpgradeBody{trackedBody: tracked, writer: rw}
+	}
+	return tracked
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(func() { atomic.AddInt64(&b.upstream.active, -1) })
+	return b.ReadCloser.Close()
+}
+
+func (b *trackedUpgradeBody) Write(p []byte) (int, error) {
+	return b.writer.Write(p)
+}
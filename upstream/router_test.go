@@ -0,0 +1,177 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zulkan/zulgoproxy/config"
+)
+
+// connectUpstream is an HTTP proxy answering one CONNECT with reply, written
+// in a single segment.
+func connectUpstream(t *testing.T, reply string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		io.WriteString(conn, reply)
+		// Hold the tunnel open until the client is done
+		io.Copy(io.Discard, conn)
+	}()
+	return listener.Addr().String()
+}
+
+func newConnectRouter(t *testing.T, addr string) *Router {
+	t.Helper()
+	r, err := NewRouter(config.UpstreamConfig{
+		Proxies: []config.UpstreamProxy{{Name: "up", URL: "http://" + addr}},
+		Default: "up",
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestConnectViaKeepsBytesSentWithTheResponse(t *testing.T) {
+	const banner = "SSH-2.0-OpenSSH_9.6\r\n"
+	addr := connectUpstream(t, "HTTP/1.1 200 Connection established\r\n\r\n"+banner)
+	r := newConnectRouter(t, addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := r.DialContext(ctx, "tcp", "ssh.example.test:22")
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(banner))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("reading the banner: %v", err)
+	}
+	if string(got) != banner {
+		t.Errorf("read %q, want the banner %q", got, banner)
+	}
+}
+
+func TestConnectViaRefused(t *testing.T) {
+	addr := connectUpstream(t, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+	r := newConnectRouter(t, addr)
+
+	_, err := r.DialContext(context.Background(), "tcp", "ssh.example.test:22")
+	if err == nil || !strings.Contains(err.Error(), "403 Forbidden") {
+		t.Fatalf("DialContext error = %v, want the upstream's refusal", err)
+	}
+	if active := r.upstreams["up"].ActiveConnections(); active != 0 {
+		t.Errorf("%d active connections after a refused CONNECT", active)
+	}
+}
+
+// TestActiveConnectionsCountRequests checks that least connections sees the
+// requests and tunnels in flight, not the idle keep-alive connections.
+func TestActiveConnectionsCountRequests(t *testing.T) {
+	release := make(chan struct{})
+	var started int32
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&started, 1)
+		if req.URL.Path == "/slow" {
+			<-release
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer proxyServer.Close()
+	addr := proxyServer.Listener.Addr().String()
+	tunnelAddr := connectUpstream(t, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+	r, err := NewRouter(config.UpstreamConfig{
+		Proxies: []config.UpstreamProxy{
+			{Name: "a", URL: "http://" + addr},
+			{Name: "b", URL: "http://" + tunnelAddr},
+		},
+		Pools:   []config.UpstreamPool{{Name: "pool", Strategy: StrategyLeastConnections, Members: []string{"a", "b"}}},
+		Routes:  []config.UpstreamRoute{{Hosts: []string{"*.example.test"}, Upstream: "a"}},
+		Default: "pool",
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := r.upstreams["a"], r.upstreams["b"]
+	client := &http.Client{Transport: r.Transport(&http.Transport{Proxy: r.ProxyURL, DialContext: r.TransportDial})}
+	defer client.CloseIdleConnections()
+
+	get := func(url string) {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Errorf("GET %s: %v", url, err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	// A request counts until its body is closed; its connection then idles
+	get("http://www.example.test/")
+	if active := a.ActiveConnections(); active != 0 {
+		t.Fatalf("%d active connections with only an idle keep-alive connection", active)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		get("http://www.example.test/slow")
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&started) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the slow request never reached the upstream")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if active := a.ActiveConnections(); active != 1 {
+		t.Errorf("%d active connections during a request, want 1", active)
+	}
+
+	// The pool sends the next request past the busy member
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := r.DialContext(ctx, "tcp", "other.test:443")
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	if active := b.ActiveConnections(); active != 1 {
+		t.Errorf("tunnel went elsewhere: b has %d active connections, want 1", active)
+	}
+	conn.Close()
+	if active := b.ActiveConnections(); active != 0 {
+		t.Errorf("%d active connections after the tunnel closed", active)
+	}
+
+	close(release)
+	<-done
+	if active := a.ActiveConnections(); active != 0 {
+		t.Errorf("%d active connections after the request finished", active)
+	}
+}